@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"myproxy/pkg/util/tls"
+	"os"
+	"time"
+)
+
+const (
+	certCommonName = "cn"
+	certDays       = "days"
+	certOut        = "out"
+	certSan        = "san"
+	certCaCrt      = "ca-crt"
+	certCaKey      = "ca-key"
+)
+
+func init() {
+	certCaCmd.Flags().String(certCommonName, "myproxy CA", "common name of the CA")
+	certCaCmd.Flags().Int(certDays, 3650, "validity in days")
+	certCaCmd.Flags().StringP(certOut, "o", "ca", "output path, written as <out>.crt and <out>.key")
+
+	certServerCmd.Flags().String(certCommonName, "myproxy", "common name of the server")
+	certServerCmd.Flags().StringSlice(certSan, nil, "IP addresses and DNS names the certificate is valid for")
+	certServerCmd.Flags().Int(certDays, 825, "validity in days")
+	certServerCmd.Flags().StringP(certOut, "o", "server", "output path, written as <out>.crt and <out>.key")
+	_ = certServerCmd.MarkFlagRequired(certSan)
+
+	certClientCmd.Flags().String(certCommonName, "", "user the endpoint authenticates the client as")
+	certClientCmd.Flags().Int(certDays, 825, "validity in days")
+	certClientCmd.Flags().StringP(certOut, "o", "client", "output path, written as <out>.crt and <out>.key")
+	_ = certClientCmd.MarkFlagRequired(certCommonName)
+
+	for _, c := range []*cobra.Command{certServerCmd, certClientCmd} {
+		c.Flags().String(certCaCrt, "ca.crt", "path of the CA certificate")
+		c.Flags().String(certCaKey, "ca.key", "path of the CA key")
+	}
+
+	certCmd.AddCommand(certCaCmd, certServerCmd, certClientCmd, certPinCmd)
+	rootCmd.AddCommand(certCmd)
+}
+
+var certCmd = &cobra.Command{
+	Use:   "cert",
+	Short: "Create a private CA and issue tunnel certificates",
+}
+
+var certCaCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Create a private certificate authority",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cn, _ := cmd.Flags().GetString(certCommonName)
+		days, _ := cmd.Flags().GetInt(certDays)
+		out, _ := cmd.Flags().GetString(certOut)
+
+		ca, err := tls.NewCA(cn, validity(days))
+		if err != nil {
+			return err
+		}
+		return writeCert(out, ca.Cert, ca.Key)
+	},
+}
+
+var certServerCmd = &cobra.Command{
+	Use:   "server",
+	Short: "Issue an endpoint certificate signed by the CA",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cn, _ := cmd.Flags().GetString(certCommonName)
+		sans, _ := cmd.Flags().GetStringSlice(certSan)
+		days, _ := cmd.Flags().GetInt(certDays)
+		out, _ := cmd.Flags().GetString(certOut)
+
+		ca, err := loadIssuer(cmd)
+		if err != nil {
+			return err
+		}
+
+		cert, key, err := ca.IssueServer(cn, sans, validity(days))
+		if err != nil {
+			return err
+		}
+		if err = writeCert(out, cert, key); err != nil {
+			return err
+		}
+
+		fmt.Println("pin: " + tls.Pin(cert))
+		return nil
+	},
+}
+
+var certClientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "Issue a client certificate signed by the CA",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cn, _ := cmd.Flags().GetString(certCommonName)
+		days, _ := cmd.Flags().GetInt(certDays)
+		out, _ := cmd.Flags().GetString(certOut)
+
+		ca, err := loadIssuer(cmd)
+		if err != nil {
+			return err
+		}
+
+		cert, key, err := ca.IssueClient(cn, validity(days))
+		if err != nil {
+			return err
+		}
+		return writeCert(out, cert, key)
+	},
+}
+
+var certPinCmd = &cobra.Command{
+	Use:   "pin <file>",
+	Short: "Print the SPKI SHA-256 pin of a PEM certificate or key",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		b, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+
+		pin, err := tls.PinOfPEM(b)
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(pin)
+		return nil
+	},
+}
+
+func validity(days int) time.Duration {
+	return time.Duration(days) * 24 * time.Hour
+}
+
+func loadIssuer(cmd *cobra.Command) (*tls.Issuer, error) {
+	crtPath, _ := cmd.Flags().GetString(certCaCrt)
+	keyPath, _ := cmd.Flags().GetString(certCaKey)
+
+	crt, err := os.ReadFile(crtPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.LoadIssuer(crt, key)
+}
+
+// writeCert writes <out>.crt and <out>.key, refusing to overwrite either.
+func writeCert(out string, cert *x509.Certificate, key crypto.Signer) error {
+	crtPath, keyPath := out+".crt", out+".key"
+	for _, p := range []string{crtPath, keyPath} {
+		if _, err := os.Stat(p); err == nil {
+			return errors.New(p + " already exists")
+		}
+	}
+
+	keyPEM, err := tls.EncodeKey(key)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return err
+	}
+	if err = os.WriteFile(crtPath, tls.EncodeCertificate(cert), 0644); err != nil {
+		return err
+	}
+
+	fmt.Println("wrote " + crtPath + " and " + keyPath)
+	return nil
+}
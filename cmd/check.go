@@ -0,0 +1,30 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"myproxy/config"
+)
+
+func init() {
+	checkCmd.Flags().StringP(configPath, "c", "config.yaml", "path for config file")
+	rootCmd.AddCommand(checkCmd)
+}
+
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Validate a config file without starting it",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cPath, err := cmd.Flags().GetString(configPath)
+		if err != nil {
+			return err
+		}
+
+		if _, err = config.Check(cPath); err != nil {
+			return err
+		}
+
+		fmt.Println("config ok")
+		return nil
+	},
+}
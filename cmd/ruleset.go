@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"myproxy/internal/router"
+	"os"
+)
+
+const (
+	ruleSetType   = "type"
+	ruleSetInput  = "input"
+	ruleSetOutput = "output"
+)
+
+func init() {
+	ruleSetCmd.Flags().StringP(ruleSetType, "t", router.RuleSetDomain, "rule set type, domain or ip")
+	ruleSetCmd.Flags().StringP(ruleSetInput, "i", "", "path of the plain list")
+	ruleSetCmd.Flags().StringP(ruleSetOutput, "o", "", "path of the binary rule set")
+	_ = ruleSetCmd.MarkFlagRequired(ruleSetInput)
+	_ = ruleSetCmd.MarkFlagRequired(ruleSetOutput)
+	rootCmd.AddCommand(ruleSetCmd)
+}
+
+var ruleSetCmd = &cobra.Command{
+	Use:   "ruleset",
+	Short: "Compile a plain domain or IP list into a binary rule set",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		typ, _ := cmd.Flags().GetString(ruleSetType)
+		in, _ := cmd.Flags().GetString(ruleSetInput)
+		out, _ := cmd.Flags().GetString(ruleSetOutput)
+
+		src, err := os.Open(in)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		entries, err := router.ReadEntries(src)
+		if err != nil {
+			return err
+		}
+
+		dst, err := os.Create(out)
+		if err != nil {
+			return err
+		}
+		if err = router.EncodeRuleSet(dst, typ, entries); err != nil {
+			_ = dst.Close()
+			return err
+		}
+		// A failed close may leave the rule set truncated.
+		return dst.Close()
+	},
+}
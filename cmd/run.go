@@ -3,7 +3,9 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"github.com/fsnotify/fsnotify"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"myproxy/config"
 	"myproxy/internal"
@@ -17,6 +19,9 @@ import (
 
 const (
 	configPath = "config"
+
+	// reloadDelay lets editors finish writing before the config is reloaded.
+	reloadDelay = 500 * time.Millisecond
 )
 
 func init() {
@@ -24,6 +29,8 @@ func init() {
 }
 
 var rootCmd = &cobra.Command{
+	SilenceUsage:  true,
+	SilenceErrors: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		cPath, err := cmd.Flags().GetString(configPath)
 		if err != nil {
@@ -40,6 +47,20 @@ func Run() {
 	}
 }
 
+// reload applies the config at cPath to instance. An invalid config is
+// reported and the running one is kept.
+func reload(cPath string, instance *internal.Instance) {
+	c, err := config.Load(cPath)
+	if err != nil {
+		mlog.Error("reload " + cPath + " failed, keeping the running config: " + err.Error())
+		return
+	}
+
+	if err = instance.Reload(c); err != nil {
+		mlog.Error("reload "+cPath, zap.Error(err))
+	}
+}
+
 func execute(cPath string) error {
 	c, err := config.Init(cPath)
 	if err != nil {
@@ -61,10 +82,31 @@ func execute(cPath string) error {
 		}
 	}(instance)
 
-	{
-		osSignals := make(chan os.Signal, 1)
-		signal.Notify(osSignals, os.Interrupt, syscall.SIGTERM)
-		<-osSignals
+	changed := make(chan struct{}, 1)
+	var debounce *time.Timer
+	viper.OnConfigChange(func(fsnotify.Event) {
+		if debounce != nil {
+			debounce.Stop()
+		}
+		debounce = time.AfterFunc(reloadDelay, func() {
+			select {
+			case changed <- struct{}{}:
+			default:
+			}
+		})
+	})
+	viper.WatchConfig()
+
+	osSignals := make(chan os.Signal, 1)
+	signal.Notify(osSignals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case s := <-osSignals:
+			if s != syscall.SIGHUP {
+				return nil
+			}
+		case <-changed:
+		}
+		reload(cPath, instance)
 	}
-	return nil
 }
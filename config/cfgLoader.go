@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/oschwald/geoip2-golang"
 	"github.com/spf13/viper"
+	"myproxy/internal/auth"
 	"myproxy/internal/mlog"
 	"myproxy/pkg/models"
 	"myproxy/pkg/protocol"
@@ -16,7 +17,7 @@ import (
 )
 
 func Init(path string) (*models.Config, error) {
-	if c, err := loadConfig(path); err != nil {
+	if c, err := Load(path); err != nil {
 		return nil, err
 	} else {
 		if c.Transfer != nil {
@@ -24,6 +25,9 @@ func Init(path string) (*models.Config, error) {
 			if c.Transfer.Obfuscation != nil {
 				packet.InitObfuscation(c.Transfer.Obfuscation.XorKey, c.Transfer.Obfuscation.Padding)
 			}
+			if err := auth.LoadIdentity(c.Transfer.TLS); err != nil {
+				return nil, err
+			}
 		}
 
 		readFile, err := content.ReadFile("cn.mmdb")
@@ -42,12 +46,51 @@ func Init(path string) (*models.Config, error) {
 	}
 }
 
-func loadConfig(path string) (*models.Config, error) {
+// Load reads and validates the config at path and fills in defaults. Unlike
+// Init it leaves the process wide settings alone, so it can be used to
+// reload a running instance.
+func Load(path string) (*models.Config, error) {
+	c, err := Check(path)
+	if err != nil {
+		return nil, err
+	}
+
+	setDefaults(c)
+	return c, nil
+}
+
+// Check loads the config at path and validates it without applying it.
+func Check(path string) (*models.Config, error) {
+	c, raw, err := loadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = Validate(c, raw); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func setDefaults(c *models.Config) {
+	if c.Routing == nil {
+		c.Routing = &models.Routing{}
+	}
+	// Validate requires a final when more than one outbound is declared.
+	if c.Routing.Final == "" {
+		c.Routing.Final = shared.OutboundDirect
+		if len(c.Outbounds) == 1 {
+			c.Routing.Final = c.Outbounds[0].Tag
+		}
+	}
+}
+
+func loadConfig(path string) (*models.Config, map[string]any, error) {
 	if path == "" {
 		wd, _ := os.Getwd()
 		path = wd + shared.ConfigBase
 		if file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600); err != nil {
-			return nil, err
+			return nil, nil, err
 		} else {
 			_ = file.Close()
 		}
@@ -58,21 +101,27 @@ func loadConfig(path string) (*models.Config, error) {
 	viper.SetConfigFile(path)
 
 	if err := viper.ReadInConfig(); err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	var cfg models.Config
 
-	m, err := json.Marshal(viper.AllSettings())
+	settings := viper.AllSettings()
+	m, err := json.Marshal(settings)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	err = json.Unmarshal(m, &cfg)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	var raw map[string]any
+	if err = json.Unmarshal(m, &raw); err != nil {
+		return nil, nil, err
 	}
 
-	return &cfg, nil
+	return &cfg, raw, nil
 }
 
 var (
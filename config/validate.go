@@ -0,0 +1,485 @@
+package config
+
+import (
+	"fmt"
+	"myproxy/internal/dns"
+	"myproxy/internal/mlog"
+	"myproxy/internal/router"
+	"myproxy/pkg/models"
+	"myproxy/pkg/shared"
+	net2 "myproxy/pkg/util/net"
+	"myproxy/pkg/util/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Errors lists every problem found in a config, one path-qualified message
+// per entry.
+type Errors []string
+
+func (e Errors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+var inboundProtocols = map[string][]string{
+	shared.SOCKS: {shared.NetworkTCP, shared.NetworkUDP},
+	shared.HTTP:  {shared.NetworkTCP},
+	shared.DNS:   {shared.NetworkTCP, shared.NetworkUDP},
+}
+
+type checker struct {
+	errs Errors
+}
+
+func (c *checker) fail(path, format string, args ...any) {
+	c.errs = append(c.errs, path+": "+fmt.Sprintf(format, args...))
+}
+
+// Validate checks c and the raw settings it was decoded from. It returns
+// Errors listing every problem, or nil.
+func Validate(c *models.Config, raw map[string]any) error {
+	v := &checker{}
+
+	v.checkKeys("", raw, reflect.TypeOf(c))
+	v.checkLog(c.Log)
+	if c.Transfer != nil {
+		v.checkTLS("transfer.tls", c.Transfer.TLS)
+	}
+	v.checkEndpoint(c.Endpoint)
+	v.checkListeners(c)
+	outTags := v.checkOutbounds(c)
+	v.checkRouting(c, outTags)
+	v.checkDNS(c.DNS)
+	v.checkDirect(c.Direct)
+	v.checkAdmin(c.Admin)
+	v.checkMetrics(c.Metrics)
+
+	if len(v.errs) > 0 {
+		return v.errs
+	}
+	return nil
+}
+
+// checkKeys reports keys of raw that match no json field of t. Viper lowers
+// the case of keys, so they are matched case-insensitively.
+func (c *checker) checkKeys(path string, raw any, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := raw.(map[string]any)
+		if !ok {
+			return
+		}
+		fields := make(map[string]reflect.StructField)
+		collectFields(t, fields)
+		keys := make([]string, 0, len(m))
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := m[k]
+			f, ok := fields[strings.ToLower(k)]
+			if !ok {
+				c.fail(join(path, k), "unknown key")
+				continue
+			}
+			c.checkKeys(join(path, jsonName(f)), v, f.Type)
+		}
+	case reflect.Slice:
+		s, ok := raw.([]any)
+		if !ok {
+			return
+		}
+		for i, v := range s {
+			c.checkKeys(fmt.Sprintf("%s[%d]", path, i), v, t.Elem())
+		}
+	}
+}
+
+func collectFields(t reflect.Type, fields map[string]reflect.StructField) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			ft := f.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			collectFields(ft, fields)
+			continue
+		}
+		if name := jsonName(f); name != "" && name != "-" {
+			fields[strings.ToLower(name)] = f
+		}
+	}
+}
+
+func jsonName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return name
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (c *checker) checkLog(l *models.Log) {
+	if l == nil {
+		return
+	}
+	if l.ConsoleLevel != "" && !mlog.ValidLevel(l.ConsoleLevel) {
+		c.fail("log.consoleLevel", "unknown level %q", l.ConsoleLevel)
+	}
+	if l.FileLevel != "" && !mlog.ValidLevel(l.FileLevel) {
+		c.fail("log.fileLevel", "unknown level %q", l.FileLevel)
+	}
+	if l.LogFilePath != "" {
+		c.checkDir("log.logFilePath", l.LogFilePath)
+	}
+	if l.Output != "" && l.Output != mlog.OutputStderr && l.Output != mlog.OutputJournal {
+		c.fail("log.output", "unknown output %q", l.Output)
+	}
+	if l.Format != "" && l.Format != mlog.FormatConsole && l.Format != mlog.FormatJSON {
+		c.fail("log.format", "unknown format %q", l.Format)
+	}
+	if l.MaxSize < 0 || l.MaxAge < 0 || l.MaxBackups < 0 {
+		c.fail("log", "negative rotation limit")
+	}
+	if a := l.Access; a != nil {
+		if !mlog.ValidAccessFormat(a.Format) {
+			c.fail("log.access.format", "unknown format %q", a.Format)
+		}
+		if a.Path != "" && a.Path != "stdout" {
+			c.checkDir("log.access.path", filepath.Dir(a.Path))
+		}
+	}
+}
+
+func (c *checker) checkTLS(path string, t *models.Tls) {
+	if t == nil {
+		return
+	}
+
+	switch {
+	case t.Crt != "" && t.Key == "":
+		c.fail(path+".key", "required with crt")
+	case t.Crt == "" && t.Key != "":
+		c.fail(path+".crt", "required with key")
+	case t.Crt != "":
+		if c.checkFile(path+".crt", t.Crt) && c.checkFile(path+".key", t.Key) {
+			if _, err := tls.LoadKeyPair(t.Crt, t.Key); err != nil {
+				c.fail(path+".crt", "%v", err)
+			}
+		}
+	}
+
+	if t.Ca != "" && c.checkFile(path+".ca", t.Ca) {
+		if _, err := tls.LoadCertPool(t.Ca); err != nil {
+			c.fail(path+".ca", "%v", err)
+		}
+	}
+	if t.ClientCa != "" && c.checkFile(path+".clientCa", t.ClientCa) {
+		if _, err := tls.LoadCertPool(t.ClientCa); err != nil {
+			c.fail(path+".clientCa", "%v", err)
+		}
+	}
+	if _, err := tls.ClientAuthType(t); err != nil {
+		c.fail(path+".clientAuth", "%v", err)
+	}
+	if t.GeneratedKey != "" {
+		c.checkDir(path+".generatedKey", filepath.Dir(t.GeneratedKey))
+	}
+}
+
+func (c *checker) checkFile(path, name string) bool {
+	fi, err := os.Stat(name)
+	if err != nil {
+		c.fail(path, "%v", err)
+		return false
+	}
+	if fi.IsDir() {
+		c.fail(path, "%s is a directory", name)
+		return false
+	}
+	return true
+}
+
+func (c *checker) checkDir(path, name string) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		c.fail(path, "%v", err)
+		return
+	}
+	if !fi.IsDir() {
+		c.fail(path, "%s is not a directory", name)
+	}
+}
+
+func (c *checker) checkEndpoint(e *models.Endpoint) {
+	if e == nil {
+		return
+	}
+	if e.NetAddr == nil || e.Port == 0 {
+		c.fail("endpoint.port", "required")
+	}
+	if e.NetAddr != nil && e.Address != "" && net.ParseIP(e.Address) == nil {
+		c.fail("endpoint.address", "invalid IP address %q", e.Address)
+	}
+
+	if e.Auth == nil {
+		return
+	}
+	if e.Auth.Psk == "" && len(e.Auth.Users) == 0 {
+		c.fail("endpoint.auth", "neither psk nor users set")
+	}
+	names := make(map[string]bool)
+	for i, u := range e.Auth.Users {
+		path := fmt.Sprintf("endpoint.auth.users[%d]", i)
+		if u.Name == "" {
+			c.fail(path+".name", "required")
+		} else if names[u.Name] {
+			c.fail(path+".name", "duplicate user %s", u.Name)
+		}
+		names[u.Name] = true
+		if u.Token == "" {
+			c.fail(path+".token", "required")
+		}
+	}
+}
+
+type listener struct {
+	path    string
+	network string
+	address string
+	port    uint16
+}
+
+func (l listener) conflicts(o listener) bool {
+	if l.network != o.network || l.port != o.port {
+		return false
+	}
+	return l.address == o.address || wildcard(l.address) || wildcard(o.address)
+}
+
+// tcpListener returns the listener of a host:port address. Unix sockets and
+// malformed addresses, reported by their own checks, have none.
+func tcpListener(path, addr string) (listener, bool) {
+	if strings.HasPrefix(addr, "unix:") {
+		return listener{}, false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return listener{}, false
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || p == 0 {
+		return listener{}, false
+	}
+	return listener{path, shared.NetworkTCP, host, uint16(p)}, true
+}
+
+func wildcard(address string) bool {
+	ip := net.ParseIP(address)
+	return address == "" || ip != nil && ip.IsUnspecified()
+}
+
+// checkListeners checks the inbounds and reports local ports bound twice,
+// by inbounds, the endpoint, the admin API or the metrics endpoint.
+func (c *checker) checkListeners(cfg *models.Config) {
+	var ls []listener
+	if e := cfg.Endpoint; e != nil && e.NetAddr != nil && e.Port != 0 {
+		ls = append(ls, listener{"endpoint.port", shared.NetworkQUIC, e.Address, e.Port})
+	}
+
+	tags := make(map[string]bool)
+	for i, inb := range cfg.Inbounds {
+		path := fmt.Sprintf("inbounds[%d]", i)
+		if inb.Tag == "" {
+			c.fail(path+".tag", "required")
+		} else if tags[inb.Tag] {
+			c.fail(path+".tag", "duplicate tag %s", inb.Tag)
+		}
+		tags[inb.Tag] = true
+
+		if inb.Address != "" && net.ParseIP(inb.Address) == nil {
+			c.fail(path+".address", "invalid IP address %q", inb.Address)
+		}
+		if inb.Port == 0 {
+			c.fail(path+".port", "required")
+		}
+
+		networks, ok := inboundProtocols[inb.Protocol]
+		if !ok {
+			c.fail(path+".protocol", "unknown protocol %q", inb.Protocol)
+			continue
+		}
+		for _, network := range networks {
+			ls = append(ls, listener{path + ".port", network, inb.Address, inb.Port})
+		}
+	}
+	if a := cfg.Admin; a != nil {
+		if l, ok := tcpListener("admin.listen", a.Listen); ok {
+			ls = append(ls, l)
+		}
+	}
+	if m := cfg.Metrics; m != nil {
+		if l, ok := tcpListener("metrics.listen", m.Listen); ok {
+			ls = append(ls, l)
+		}
+	}
+
+	for i, l := range ls {
+		for _, o := range ls[:i] {
+			if l.path != o.path && l.conflicts(o) {
+				c.fail(l.path, "%s port %d already used by %s", l.network, l.port, o.path)
+				break
+			}
+		}
+	}
+}
+
+// checkOutbounds checks outbounds and groups and returns every tag a rule
+// may route to.
+func (c *checker) checkOutbounds(cfg *models.Config) map[string]bool {
+	tags := map[string]bool{
+		shared.OutboundDirect: true,
+		shared.OutboundBlock:  true,
+		shared.OutboundReject: true,
+	}
+
+	for i, o := range cfg.Outbounds {
+		path := fmt.Sprintf("outbounds[%d]", i)
+		switch {
+		case o.Tag == "":
+			c.fail(path+".tag", "required")
+		case o.Tag == shared.OutboundDirect || o.Tag == shared.OutboundBlock || o.Tag == shared.OutboundReject:
+			c.fail(path+".tag", "%s is a built-in outbound", o.Tag)
+		case tags[o.Tag]:
+			c.fail(path+".tag", "duplicate tag %s", o.Tag)
+		}
+		tags[o.Tag] = true
+
+		if o.Address == "" {
+			c.fail(path+".address", "required")
+		}
+		if o.Port == 0 {
+			c.fail(path+".port", "required")
+		}
+		if o.User != "" && o.Token == "" {
+			c.fail(path+".token", "required with user")
+		}
+		if _, err := tls.ParsePins(o.Pins); err != nil {
+			c.fail(path+".pins", "%v", err)
+		}
+		if h := o.Health; h != nil {
+			if h.Interval < 0 || h.Timeout < 0 || h.Rise < 0 || h.Fall < 0 {
+				c.fail(path+".health", "negative value")
+			}
+		}
+	}
+
+	if err := router.CheckGroups(cfg.OutboundGroups); err != nil {
+		c.errs = append(c.errs, err.Error())
+	}
+	declared := make(map[string]bool, len(tags))
+	for tag := range tags {
+		declared[tag] = true
+	}
+	for i, g := range cfg.OutboundGroups {
+		path := fmt.Sprintf("outboundGroups[%d]", i)
+		if g.Tag != "" && tags[g.Tag] {
+			c.fail(path+".tag", "duplicate tag %s", g.Tag)
+		}
+		tags[g.Tag] = true
+		for j, m := range g.Outbounds {
+			if !declared[m] {
+				c.fail(fmt.Sprintf("%s.outbounds[%d]", path, j), "unknown outbound %s", m)
+			}
+		}
+	}
+
+	return tags
+}
+
+func (c *checker) checkRouting(cfg *models.Config, outTags map[string]bool) {
+	r := cfg.Routing
+	if (r == nil || r.Final == "") && len(cfg.Outbounds)+len(cfg.OutboundGroups) > 1 {
+		c.fail("routing.final", "required when more than one outbound is declared")
+	}
+	if r == nil {
+		return
+	}
+
+	inTags := make(map[string]bool)
+	for _, inb := range cfg.Inbounds {
+		inTags[inb.Tag] = true
+	}
+
+	for i, rule := range r.Rules {
+		path := fmt.Sprintf("routing.rules[%d]", i)
+		if rule.OutTag == "" {
+			c.fail(path+".outTag", "required")
+		} else if !outTags[rule.OutTag] {
+			c.fail(path+".outTag", "unknown outbound %s", rule.OutTag)
+		}
+		if rule.InTag != "" && !inTags[rule.InTag] {
+			c.fail(path+".inTag", "unknown inbound %s", rule.InTag)
+		}
+	}
+	if r.Final != "" && !outTags[r.Final] {
+		c.fail("routing.final", "unknown outbound %s", r.Final)
+	}
+
+	if err := router.Check(r); err != nil {
+		c.errs = append(c.errs, err.Error())
+	}
+}
+
+func (c *checker) checkDNS(d *models.DNS) {
+	if err := dns.Check(d); err != nil {
+		c.errs = append(c.errs, err.Error())
+	}
+}
+
+func (c *checker) checkDirect(d *models.Direct) {
+	if err := net2.CheckDirect(d); err != nil {
+		c.errs = append(c.errs, err.Error())
+	}
+}
+
+// checkAdmin requires the admin API to listen on a unix socket or a loopback
+// address, as it can reconfigure the whole instance.
+func (c *checker) checkAdmin(a *models.Admin) {
+	if a == nil || a.Listen == "" || strings.HasPrefix(a.Listen, "unix:") {
+		return
+	}
+
+	host, _, err := net.SplitHostPort(a.Listen)
+	if err != nil {
+		c.fail("admin.listen", "%v", err)
+		return
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		c.fail("admin.listen", "%s is not a loopback address", host)
+	}
+}
+
+func (c *checker) checkMetrics(m *models.Metrics) {
+	if m == nil || m.Listen == "" {
+		return
+	}
+	if _, _, err := net.SplitHostPort(m.Listen); err != nil {
+		c.fail("metrics.listen", "%v", err)
+	}
+}
@@ -0,0 +1,248 @@
+package config
+
+import (
+	"errors"
+	"myproxy/pkg/models"
+	"myproxy/pkg/shared"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *models.Config
+		want []string
+	}{
+		{
+			"inbounds",
+			&models.Config{Inbounds: []*models.Inbound{
+				{Tag: "a", Port: 1080, Protocol: shared.SOCKS},
+				{Tag: "a", Address: "0.0.0.0", Port: 1080, Protocol: shared.HTTP},
+				{Tag: "b", Address: "localhost", Protocol: "ftp"},
+			}},
+			[]string{
+				"inbounds[1].tag: duplicate tag a",
+				"inbounds[1].port: tcp port 1080 already used by inbounds[0].port",
+				`inbounds[2].address: invalid IP address "localhost"`,
+				"inbounds[2].port: required",
+				`inbounds[2].protocol: unknown protocol "ftp"`,
+			},
+		},
+		{
+			"tcp and udp port conflict",
+			&models.Config{Inbounds: []*models.Inbound{
+				{Tag: "s", Address: "127.0.0.1", Port: 53, Protocol: shared.SOCKS},
+				{Tag: "d", Address: "127.0.0.1", Port: 53, Protocol: shared.DNS},
+			}},
+			[]string{
+				"inbounds[1].port: tcp port 53 already used by inbounds[0].port",
+				"inbounds[1].port: udp port 53 already used by inbounds[0].port",
+			},
+		},
+		{
+			"outbounds",
+			&models.Config{
+				Outbounds: []*models.Outbound{
+					{Tag: shared.OutboundDirect, Address: "192.0.2.1", Port: 1},
+					{Tag: "p", User: "alice"},
+				},
+				OutboundGroups: []*models.OutboundGroup{{Tag: "p", Outbounds: []string{"p", "gone"}}},
+			},
+			[]string{
+				"outbounds[0].tag: direct is a built-in outbound",
+				"outbounds[1].address: required",
+				"outbounds[1].port: required",
+				"outbounds[1].token: required with user",
+				"outboundGroups[0].tag: duplicate tag p",
+				"outboundGroups[0].outbounds[1]: unknown outbound gone",
+				"routing.final: required when more than one outbound is declared",
+			},
+		},
+		{
+			"final required",
+			&models.Config{
+				Outbounds: []*models.Outbound{
+					{Tag: "a", Address: "192.0.2.1", Port: 443},
+					{Tag: "b", Address: "192.0.2.2", Port: 443},
+				},
+				Routing: &models.Routing{},
+			},
+			[]string{"routing.final: required when more than one outbound is declared"},
+		},
+		{
+			"routing",
+			&models.Config{
+				Inbounds: []*models.Inbound{{Tag: "in", Port: 1080, Protocol: shared.SOCKS}},
+				Routing: &models.Routing{
+					Final: "gone",
+					Rules: []*models.Rule{
+						{InTag: "in", OutTag: shared.OutboundBlock},
+						{InTag: "out", OutTag: "nowhere"},
+						{Domain: []string{"a.com"}},
+					},
+				},
+			},
+			[]string{
+				"routing.rules[1].outTag: unknown outbound nowhere",
+				"routing.rules[1].inTag: unknown inbound out",
+				"routing.rules[2].outTag: required",
+				"routing.final: unknown outbound gone",
+			},
+		},
+		{
+			"endpoint",
+			&models.Config{Endpoint: &models.Endpoint{
+				NetAddr: &models.NetAddr{Address: "example.com"},
+				Auth:    &models.Auth{Users: []*models.User{{Name: "a", Token: "t"}, {Name: "a"}}},
+			}},
+			[]string{
+				"endpoint.port: required",
+				`endpoint.address: invalid IP address "example.com"`,
+				"endpoint.auth.users[1].name: duplicate user a",
+				"endpoint.auth.users[1].token: required",
+			},
+		},
+		{
+			"endpoint without credentials",
+			&models.Config{Endpoint: &models.Endpoint{NetAddr: &models.NetAddr{Port: 443}, Auth: &models.Auth{}}},
+			[]string{"endpoint.auth: neither psk nor users set"},
+		},
+		{
+			"log",
+			&models.Config{Log: &models.Log{ConsoleLevel: "loud", Format: "xml", MaxAge: -1}},
+			[]string{
+				`log.consoleLevel: unknown level "loud"`,
+				`log.format: unknown format "xml"`,
+				"log: negative rotation limit",
+			},
+		},
+		{
+			"tls",
+			&models.Config{Transfer: &models.Transfer{TLS: &models.Tls{Key: "k.pem", ClientAuth: "sometimes"}}},
+			[]string{
+				"transfer.tls.crt: required with key",
+				"transfer.tls.clientAuth: unknown client auth policy sometimes",
+			},
+		},
+		{
+			"admin and metrics",
+			&models.Config{Admin: &models.Admin{Listen: "0.0.0.0:9090"}, Metrics: &models.Metrics{Listen: "9100"}},
+			[]string{
+				"admin.listen: 0.0.0.0 is not a loopback address",
+				"metrics.listen: ",
+			},
+		},
+		{
+			"admin and metrics port conflict",
+			&models.Config{
+				Inbounds: []*models.Inbound{{Tag: "s", Address: "127.0.0.1", Port: 9090, Protocol: shared.SOCKS}},
+				Admin:    &models.Admin{Listen: "127.0.0.1:9090"},
+				Metrics:  &models.Metrics{Listen: ":9090"},
+			},
+			[]string{
+				"admin.listen: tcp port 9090 already used by inbounds[0].port",
+				"metrics.listen: tcp port 9090 already used by inbounds[0].port",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.c, nil)
+			var errs Errors
+			if !errors.As(err, &errs) {
+				t.Fatalf("Validate() = %v, want Errors", err)
+			}
+			if len(errs) != len(tt.want) {
+				t.Errorf("Validate() found %d problems, want %d:\n%v", len(errs), len(tt.want), err)
+			}
+			for _, want := range tt.want {
+				if !contains(errs, want) {
+					t.Errorf("Validate() does not report %q:\n%v", want, err)
+				}
+			}
+		})
+	}
+}
+
+func contains(errs Errors, prefix string) bool {
+	for _, e := range errs {
+		if strings.HasPrefix(e, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestValidateOK(t *testing.T) {
+	c := &models.Config{
+		Log: &models.Log{ConsoleLevel: "info", Output: "stderr"},
+		Inbounds: []*models.Inbound{
+			{Tag: "socks", Address: "127.0.0.1", Port: 1080, Protocol: shared.SOCKS},
+			{Tag: "http", Address: "127.0.0.1", Port: 1081, Protocol: shared.HTTP},
+			{Tag: "dns", Address: "127.0.0.2", Port: 1080, Protocol: shared.DNS},
+		},
+		Outbounds:      []*models.Outbound{{Tag: "p", Address: "192.0.2.1", Port: 443, User: "alice", Token: "t"}},
+		OutboundGroups: []*models.OutboundGroup{{Tag: "g", Outbounds: []string{"p", shared.OutboundDirect}}},
+		Routing: &models.Routing{
+			Final: "g",
+			Rules: []*models.Rule{{InTag: "socks", Domain: []string{"a.com"}, OutTag: "p"}},
+		},
+		Admin: &models.Admin{Listen: "unix:/run/myproxy.sock"},
+	}
+	if err := Validate(c, nil); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+}
+
+func TestValidateKeys(t *testing.T) {
+	raw := map[string]any{
+		"log":      map[string]any{"consolelevel": "info", "colour": true},
+		"inbounds": []any{map[string]any{"tag": "a", "prot": "socks"}},
+		"extra":    1,
+	}
+	err := Validate(&models.Config{}, raw)
+	var errs Errors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Validate() = %v, want Errors", err)
+	}
+	want := Errors{"extra: unknown key", "inbounds[0].prot: unknown key", "log.colour: unknown key"}
+	if err.Error() != want.Error() {
+		t.Errorf("Validate() = %q, want %q", err, want)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	data := "inbounds:\n  - tag: a\n    port: 1080\n    protocol: socks\n    listen: 127.0.0.1\n"
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := Check(path)
+	if err == nil || !strings.Contains(err.Error(), "inbounds[0].listen: unknown key") {
+		t.Errorf("Check() = %v, want an unknown key error", err)
+	}
+}
+
+func TestSetDefaults(t *testing.T) {
+	tests := []struct {
+		name      string
+		outbounds []*models.Outbound
+		want      string
+	}{
+		{"no outbound", nil, shared.OutboundDirect},
+		{"one outbound", []*models.Outbound{{Tag: "p"}}, "p"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &models.Config{Outbounds: tt.outbounds}
+			setDefaults(c)
+			if c.Routing.Final != tt.want {
+				t.Errorf("final = %q, want %q", c.Routing.Final, tt.want)
+			}
+		})
+	}
+}
@@ -4,6 +4,7 @@ go 1.22
 
 require (
 	github.com/bwmarrin/snowflake v0.3.0
+	github.com/fsnotify/fsnotify v1.7.0
 	github.com/oschwald/geoip2-golang v1.11.0
 	github.com/sagernet/sing v0.3.8
 	github.com/spf13/cobra v1.8.1
@@ -13,7 +14,6 @@ require (
 )
 
 require (
-	github.com/fsnotify/fsnotify v1.7.0 // indirect
 	github.com/hashicorp/hcl v1.0.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/magiconair/properties v1.8.7 // indirect
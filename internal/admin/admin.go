@@ -0,0 +1,409 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"myproxy/config"
+	"myproxy/internal"
+	"myproxy/internal/conntrack"
+	"myproxy/internal/health"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/models"
+	net2 "myproxy/pkg/util/net"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// UnixPrefix marks a listen address as a unix socket path.
+const UnixPrefix = "unix:"
+
+var (
+	errNotFound = errors.New("not found")
+	errConflict = errors.New("tag already in use")
+)
+
+// Server serves the admin API of an instance. Changes made through it are
+// applied to the running instance only, the config file is not rewritten.
+type Server struct {
+	cfg      *models.Admin
+	instance *internal.Instance
+	srv      *http.Server
+}
+
+func New(cfg *models.Admin, instance *internal.Instance) *Server {
+	s := &Server{cfg: cfg, instance: instance}
+	s.srv = &http.Server{Handler: s.handler(), ReadHeaderTimeout: 10 * time.Second}
+	return s
+}
+
+// Start listens on the configured address and serves in the background.
+func (s *Server) Start() error {
+	l, err := Listen(s.cfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	mlog.Warn("admin API listening on " + s.cfg.Listen)
+
+	go func() {
+		err := s.srv.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			mlog.Error("admin API: " + err.Error())
+		}
+	}()
+	return nil
+}
+
+// Close stops listening and drops open connections right away. Requests in
+// flight may be waiting for the instance lock held by the caller.
+func (s *Server) Close() error {
+	return s.srv.Close()
+}
+
+// Listen opens addr, which is "unix:" followed by a socket path or a
+// host:port. A stale socket left by a previous run is removed first.
+func Listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, UnixPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(path, 0600); err != nil {
+		_ = l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /inbounds", s.listInbounds)
+	mux.HandleFunc("POST /inbounds", s.addInbound)
+	mux.HandleFunc("DELETE /inbounds/{tag}", s.removeInbound)
+
+	mux.HandleFunc("GET /outbounds", s.listOutbounds)
+	mux.HandleFunc("POST /outbounds", s.addOutbound)
+	mux.HandleFunc("DELETE /outbounds/{tag}", s.removeOutbound)
+
+	mux.HandleFunc("GET /rules", s.listRules)
+	mux.HandleFunc("POST /rules", s.addRule)
+	mux.HandleFunc("DELETE /rules/{index}", s.removeRule)
+
+	mux.HandleFunc("GET /connections", s.listConnections)
+	mux.HandleFunc("DELETE /connections", s.killUser)
+	mux.HandleFunc("DELETE /connections/{id}", s.killConnection)
+
+	mux.HandleFunc("GET /health", s.health)
+	mux.HandleFunc("GET /dns/cache", s.dnsCache)
+
+	mux.HandleFunc("GET /log", s.logLevels)
+	mux.HandleFunc("PUT /log", s.setLogLevels)
+
+	return s.authorize(mux)
+}
+
+// authorize guards the API against other local users and against pages in
+// a local browser. Over TCP the Host header must name a loopback host, which
+// defeats DNS rebinding, and bodies must be sent as application/json, which
+// a cross-site form cannot do without a preflight.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(s.cfg.Listen, UnixPrefix) && !loopbackHost(r.Host) {
+			writeError(w, http.StatusForbidden, fmt.Errorf("host %q not allowed", r.Host))
+			return
+		}
+		if r.Method == http.MethodPost || r.Method == http.MethodPut {
+			if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t != "application/json" {
+				writeError(w, http.StatusUnsupportedMediaType, errors.New("content type must be application/json"))
+				return
+			}
+		}
+		if s.cfg.Token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.Token)) != 1 {
+				writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loopbackHost reports whether the host of a Host header is localhost or a
+// loopback address.
+func loopbackHost(hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]")
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func (s *Server) listInbounds(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, nonNil(s.instance.Current().Inbounds))
+}
+
+func (s *Server) addInbound(w http.ResponseWriter, r *http.Request) {
+	var inb models.Inbound
+	if !readJSON(w, r, &inb) {
+		return
+	}
+
+	s.update(w, http.StatusCreated, &inb, func(c *models.Config) error {
+		if slices.ContainsFunc(c.Inbounds, func(i *models.Inbound) bool { return i.Tag == inb.Tag }) {
+			return errConflict
+		}
+		c.Inbounds = append(c.Inbounds, &inb)
+		return nil
+	})
+}
+
+func (s *Server) removeInbound(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	s.update(w, http.StatusNoContent, nil, func(c *models.Config) error {
+		n := len(c.Inbounds)
+		c.Inbounds = slices.DeleteFunc(c.Inbounds, func(i *models.Inbound) bool { return i.Tag == tag })
+		if len(c.Inbounds) == n {
+			return errNotFound
+		}
+		return nil
+	})
+}
+
+func (s *Server) listOutbounds(w http.ResponseWriter, r *http.Request) {
+	outbounds := make([]*models.Outbound, 0)
+	for _, o := range s.instance.Current().Outbounds {
+		masked := *o
+		masked.Token = ""
+		outbounds = append(outbounds, &masked)
+	}
+	writeJSON(w, http.StatusOK, outbounds)
+}
+
+func (s *Server) addOutbound(w http.ResponseWriter, r *http.Request) {
+	var oub models.Outbound
+	if !readJSON(w, r, &oub) {
+		return
+	}
+
+	s.update(w, http.StatusCreated, nil, func(c *models.Config) error {
+		if slices.ContainsFunc(c.Outbounds, func(o *models.Outbound) bool { return o.Tag == oub.Tag }) {
+			return errConflict
+		}
+		c.Outbounds = append(c.Outbounds, &oub)
+		return nil
+	})
+}
+
+func (s *Server) removeOutbound(w http.ResponseWriter, r *http.Request) {
+	tag := r.PathValue("tag")
+	s.update(w, http.StatusNoContent, nil, func(c *models.Config) error {
+		n := len(c.Outbounds)
+		c.Outbounds = slices.DeleteFunc(c.Outbounds, func(o *models.Outbound) bool { return o.Tag == tag })
+		if len(c.Outbounds) == n {
+			return errNotFound
+		}
+		return nil
+	})
+}
+
+func (s *Server) listRules(w http.ResponseWriter, r *http.Request) {
+	var rules []*models.Rule
+	if routing := s.instance.Current().Routing; routing != nil {
+		rules = routing.Rules
+	}
+	writeJSON(w, http.StatusOK, nonNil(rules))
+}
+
+// addRule appends a rule, or inserts it before the rule at the "index" query
+// parameter, since rules are matched in order.
+func (s *Server) addRule(w http.ResponseWriter, r *http.Request) {
+	var rule models.Rule
+	if !readJSON(w, r, &rule) {
+		return
+	}
+
+	index := -1
+	if v := r.URL.Query().Get("index"); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil || i < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid index %q", v))
+			return
+		}
+		index = i
+	}
+
+	s.update(w, http.StatusCreated, &rule, func(c *models.Config) error {
+		if c.Routing == nil {
+			c.Routing = &models.Routing{}
+		}
+		if index < 0 || index > len(c.Routing.Rules) {
+			c.Routing.Rules = append(c.Routing.Rules, &rule)
+		} else {
+			c.Routing.Rules = slices.Insert(c.Routing.Rules, index, &rule)
+		}
+		return nil
+	})
+}
+
+func (s *Server) removeRule(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid index %q", r.PathValue("index")))
+		return
+	}
+
+	s.update(w, http.StatusNoContent, nil, func(c *models.Config) error {
+		if c.Routing == nil || index < 0 || index >= len(c.Routing.Rules) {
+			return errNotFound
+		}
+		c.Routing.Rules = slices.Delete(c.Routing.Rules, index, index+1)
+		return nil
+	})
+}
+
+// listConnections lists live connections, only those of the "user" query
+// parameter when given.
+func (s *Server) listConnections(w http.ResponseWriter, r *http.Request) {
+	conns := conntrack.List()
+	if r.URL.Query().Has("user") {
+		user := r.URL.Query().Get("user")
+		conns = slices.DeleteFunc(conns, func(c conntrack.Info) bool { return c.User != user })
+	}
+	writeJSON(w, http.StatusOK, conns)
+}
+
+func (s *Server) killConnection(w http.ResponseWriter, r *http.Request) {
+	if !conntrack.Kill(r.PathValue("id")) {
+		writeError(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// killUser closes every connection of the "user" query parameter.
+func (s *Server) killUser(w http.ResponseWriter, r *http.Request) {
+	if !r.URL.Query().Has("user") {
+		writeError(w, http.StatusBadRequest, errors.New("user required"))
+		return
+	}
+	n := conntrack.KillUser(r.URL.Query().Get("user"))
+	writeJSON(w, http.StatusOK, map[string]int{"killed": n})
+}
+
+func (s *Server) health(w http.ResponseWriter, r *http.Request) {
+	statuses := make([]health.Status, 0)
+	health.Range(func(s health.Status) bool {
+		statuses = append(statuses, s)
+		return true
+	})
+	slices.SortFunc(statuses, func(a, b health.Status) int { return strings.Compare(a.Tag, b.Tag) })
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *Server) dnsCache(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, net2.DNSCacheStats())
+}
+
+type logLevels struct {
+	Console string `json:"console"`
+	File    string `json:"file"`
+}
+
+func (s *Server) logLevels(w http.ResponseWriter, r *http.Request) {
+	console, file := mlog.Levels()
+	writeJSON(w, http.StatusOK, logLevels{Console: console, File: file})
+}
+
+func (s *Server) setLogLevels(w http.ResponseWriter, r *http.Request) {
+	var l logLevels
+	if !readJSON(w, r, &l) {
+		return
+	}
+
+	if err := mlog.SetLevels(l.Console, l.File); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.logLevels(w, r)
+}
+
+// update validates and applies a change to the running config, answering
+// with status and body on success.
+func (s *Server) update(w http.ResponseWriter, status int, body any, f func(c *models.Config) error) {
+	err := s.instance.Update(func(c *models.Config) error {
+		if err := f(c); err != nil {
+			return err
+		}
+		return config.Validate(c, nil)
+	})
+
+	switch {
+	case err == nil:
+	case errors.Is(err, errNotFound):
+		writeError(w, http.StatusNotFound, err)
+		return
+	case errors.Is(err, errConflict):
+		writeError(w, http.StatusConflict, err)
+		return
+	case errors.As(err, new(config.Errors)):
+		writeError(w, http.StatusBadRequest, err)
+		return
+	default:
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if body == nil {
+		w.WriteHeader(status)
+		return
+	}
+	writeJSON(w, status, body)
+}
+
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	d.DisallowUnknownFields()
+	if err := d.Decode(v); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func nonNil[T any](s []T) []T {
+	if s == nil {
+		return []T{}
+	}
+	return s
+}
@@ -0,0 +1,211 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"myproxy/internal"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/di"
+	"myproxy/pkg/models"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// section stands in for the futures of the control package, which the admin
+// API only reaches through the instance.
+type section struct {
+	reloaded any
+}
+
+func (s *section) Run() error   { return nil }
+func (s *section) Close() error { return nil }
+
+func (s *section) Reload(v any) error {
+	s.reloaded = v
+	return nil
+}
+
+var routing = &section{}
+
+func TestMain(m *testing.M) {
+	if err := mlog.Init(&models.Log{Output: mlog.OutputStderr, ConsoleLevel: "fatal"}); err != nil {
+		panic(err)
+	}
+	for _, v := range []any{[]*models.Inbound{}, []*models.Outbound{}} {
+		di.ServerContext[reflect.TypeOf(v)] = func(context.Context, any) (any, error) { return &section{}, nil }
+	}
+	di.ServerContext[reflect.TypeOf(&models.Routing{})] = func(context.Context, any) (any, error) { return routing, nil }
+	os.Exit(m.Run())
+}
+
+func newServer(t *testing.T, token string) *Server {
+	t.Helper()
+	instance, err := internal.New(&models.Config{
+		Inbounds:  []*models.Inbound{{Tag: "socks", Protocol: "socks", Address: "127.0.0.1", Port: 1080}},
+		Outbounds: []*models.Outbound{{Tag: "proxy", Address: "192.0.2.1", Port: 443, User: "alice", Token: "secret"}},
+		Routing:   &models.Routing{Final: "proxy", Rules: []*models.Rule{{OutTag: "proxy", Domain: []string{"example.com"}}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return New(&models.Admin{Token: token}, instance)
+}
+
+// do serves one request and returns the status and body.
+func do(s *Server, method, target, token, body string) (int, string) {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Host = "localhost:9090"
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.handler().ServeHTTP(w, req)
+	return w.Code, w.Body.String()
+}
+
+func TestAuthorize(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{"no token configured", "", "", http.StatusOK},
+		{"valid", "t0ken", "t0ken", http.StatusOK},
+		{"missing", "t0ken", "", http.StatusUnauthorized},
+		{"wrong", "t0ken", "t0kem", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, body := do(newServer(t, tt.token), "GET", "/rules", tt.header, ""); got != tt.want {
+				t.Errorf("status = %d, want %d: %s", got, tt.want, body)
+			}
+		})
+	}
+}
+
+func TestAuthorizeBrowser(t *testing.T) {
+	tests := []struct {
+		name        string
+		listen      string
+		host        string
+		method      string
+		contentType string
+		want        int
+	}{
+		{"loopback", "", "127.0.0.1:9090", "GET", "", http.StatusOK},
+		{"loopback v6", "", "[::1]:9090", "GET", "", http.StatusOK},
+		{"localhost", "", "localhost", "GET", "", http.StatusOK},
+		{"rebound name", "", "attacker.example:9090", "GET", "", http.StatusForbidden},
+		{"unix socket", UnixPrefix + "/run/myproxy.sock", "unix", "GET", "", http.StatusOK},
+		{"json", "", "localhost", "POST", "application/json; charset=utf-8", http.StatusCreated},
+		{"form", "", "localhost", "POST", "text/plain", http.StatusUnsupportedMediaType},
+		{"no content type", "", "localhost", "POST", "", http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newServer(t, "")
+			s.cfg.Listen = tt.listen
+			req := httptest.NewRequest(tt.method, "/rules", strings.NewReader(`{"outTag":"direct"}`))
+			req.Host = tt.host
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			s.handler().ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+	s := newServer(t, "")
+	steps := []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"POST", "/rules", `{"outTag":"direct","domain":["example.org"]}`, http.StatusCreated},
+		{"POST", "/rules?index=0", `{"outTag":"block","port":"25"}`, http.StatusCreated},
+		{"POST", "/rules?index=-1", `{"outTag":"block"}`, http.StatusBadRequest},
+		{"POST", "/rules", `{"outTag":"missing"}`, http.StatusBadRequest},
+		{"POST", "/rules", `{"outTag":"direct","unknown":1}`, http.StatusBadRequest},
+		{"DELETE", "/rules/3", "", http.StatusNotFound},
+		{"DELETE", "/rules/first", "", http.StatusBadRequest},
+		{"DELETE", "/rules/1", "", http.StatusNoContent},
+	}
+	for _, st := range steps {
+		if got, body := do(s, st.method, st.target, "", st.body); got != st.want {
+			t.Fatalf("%s %s = %d, want %d: %s", st.method, st.target, got, st.want, body)
+		}
+	}
+
+	_, body := do(s, "GET", "/rules", "", "")
+	var rules []models.Rule
+	if err := json.Unmarshal([]byte(body), &rules); err != nil {
+		t.Fatal(err)
+	}
+	var tags []string
+	for _, r := range rules {
+		tags = append(tags, r.OutTag)
+	}
+	if got, want := strings.Join(tags, ","), "block,direct"; got != want {
+		t.Errorf("rules = %s, want %s", got, want)
+	}
+	if r, _ := routing.reloaded.(*models.Routing); r == nil || len(r.Rules) != 2 {
+		t.Errorf("routing reloaded with %+v", routing.reloaded)
+	}
+}
+
+func TestOutbounds(t *testing.T) {
+	s := newServer(t, "")
+	_, body := do(s, "GET", "/outbounds", "", "")
+	if strings.Contains(body, "secret") || !strings.Contains(body, `"alice"`) {
+		t.Errorf("GET /outbounds = %s, want the token masked", body)
+	}
+
+	steps := []struct {
+		method, target, body string
+		want                 int
+	}{
+		{"POST", "/outbounds", `{"tag":"proxy","address":"192.0.2.2","port":443}`, http.StatusConflict},
+		{"POST", "/outbounds", `{"tag":"direct","address":"192.0.2.2","port":443}`, http.StatusBadRequest},
+		{"POST", "/outbounds", `{"tag":"backup","address":"192.0.2.2","port":443}`, http.StatusCreated},
+		{"DELETE", "/outbounds/missing", "", http.StatusNotFound},
+		{"DELETE", "/outbounds/backup", "", http.StatusNoContent},
+		{"POST", "/inbounds", `{"tag":"socks","protocol":"http","port":8080}`, http.StatusConflict},
+		{"POST", "/inbounds", `{"tag":"http","protocol":"http","address":"127.0.0.1","port":1080}`, http.StatusBadRequest},
+		{"DELETE", "/inbounds/socks", "", http.StatusNoContent},
+	}
+	for _, st := range steps {
+		if got, body := do(s, st.method, st.target, "", st.body); got != st.want {
+			t.Fatalf("%s %s = %d, want %d: %s", st.method, st.target, got, st.want, body)
+		}
+	}
+}
+
+func TestConnections(t *testing.T) {
+	s := newServer(t, "")
+	tests := []struct {
+		method, target string
+		want           int
+	}{
+		{"GET", "/connections", http.StatusOK},
+		{"DELETE", "/connections", http.StatusBadRequest},
+		{"DELETE", "/connections?user=alice", http.StatusOK},
+		{"DELETE", "/connections/42", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if got, body := do(s, tt.method, tt.target, "", ""); got != tt.want {
+			t.Errorf("%s %s = %d, want %d: %s", tt.method, tt.target, got, tt.want, body)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"myproxy/pkg/models"
+	tls2 "myproxy/pkg/util/tls"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const maxSkew = 2 * time.Minute
+
+var (
+	errNoProof    = errors.New("missing credentials")
+	errUnknown    = errors.New("unknown user")
+	errBadMAC     = errors.New("invalid credentials")
+	errExpired    = errors.New("credentials expired")
+	errReplayed   = errors.New("credentials replayed")
+	errNoPassword = errors.New("empty token")
+	errNoCert     = errors.New("missing client certificate")
+)
+
+var (
+	verifier   *Verifier
+	verifierMu sync.RWMutex
+)
+
+// Verifier checks proofs against the client CA, the pre-shared key and the
+// per-user tokens configured on the endpoint, and rejects proofs it has
+// already seen.
+type Verifier struct {
+	psk   string
+	users map[string]string
+
+	clientCAs   *x509.CertPool
+	requireCert bool
+
+	mu    sync.Mutex
+	seen  map[string]int64
+	prune time.Time
+}
+
+// Init installs the credentials accepted by the endpoint. Clients presenting
+// a certificate signed by the client CA of t are authenticated as the
+// certificate's common name. Without either config authentication is off.
+func Init(c *models.Auth, t *models.Tls) error {
+	v, err := newVerifier(c, t)
+	if err != nil {
+		return err
+	}
+
+	verifierMu.Lock()
+	verifier = v
+	verifierMu.Unlock()
+	return nil
+}
+
+// Check loads the credentials of c and t without installing them.
+func Check(c *models.Auth, t *models.Tls) error {
+	_, err := newVerifier(c, t)
+	return err
+}
+
+func newVerifier(c *models.Auth, t *models.Tls) (*Verifier, error) {
+	var v *Verifier
+	if c != nil || t != nil && t.ClientCa != "" {
+		v = &Verifier{users: make(map[string]string), seen: make(map[string]int64)}
+	}
+	if c != nil {
+		v.psk = c.Psk
+		for _, u := range c.Users {
+			v.users[u.Name] = u.Token
+		}
+	}
+	if t != nil && t.ClientCa != "" {
+		pool, err := tls2.LoadCertPool(t.ClientCa)
+		if err != nil {
+			return nil, err
+		}
+		policy, err := tls2.ClientAuthType(t)
+		if err != nil {
+			return nil, err
+		}
+		v.clientCAs = pool
+		v.requireCert = policy == tls.RequireAndVerifyClientCert
+	}
+	return v, nil
+}
+
+func Enabled() bool {
+	verifierMu.RLock()
+	defer verifierMu.RUnlock()
+	return verifier != nil
+}
+
+// Verify checks p and returns the authenticated user name, which is empty
+// for clients using the pre-shared key. Every proof is accepted only once.
+// Without authentication every client is accepted as the empty user, since
+// the name it claims cannot be checked.
+func Verify(p *models.Proof) (string, error) {
+	verifierMu.RLock()
+	v := verifier
+	verifierMu.RUnlock()
+
+	if v == nil {
+		return "", nil
+	}
+	return v.verify(p)
+}
+
+func (v *Verifier) verify(p *models.Proof) (string, error) {
+	if p == nil {
+		return "", errNoProof
+	}
+
+	var (
+		user string
+		err  error
+	)
+	switch {
+	case v.clientCAs != nil && p.Cert != nil:
+		user, err = v.verifyCert(p)
+	case v.requireCert:
+		err = errNoCert
+	default:
+		user, err = v.verifyMAC(p)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	t := time.Unix(p.Time, 0)
+	if t.Before(now.Add(-maxSkew)) || t.After(now.Add(maxSkew)) {
+		return "", errExpired
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if now.After(v.prune) {
+		for k, seen := range v.seen {
+			if now.Sub(time.Unix(seen, 0)) > maxSkew {
+				delete(v.seen, k)
+			}
+		}
+		v.prune = now.Add(maxSkew)
+	}
+	if _, ok := v.seen[p.Nonce]; ok {
+		return "", errReplayed
+	}
+	v.seen[p.Nonce] = p.Time
+
+	return user, nil
+}
+
+// verifyCert checks that Cert chains to the client CA and that Sig was made
+// with its key, and returns the certificate's common name.
+func (v *Verifier) verifyCert(p *models.Proof) (string, error) {
+	cert, err := x509.ParseCertificate(p.Cert)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:     v.clientCAs,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if err = verifySignature(cert.PublicKey, message(p.User, p.Time, p.Nonce), p.Sig); err != nil {
+		return "", err
+	}
+
+	return cert.Subject.CommonName, nil
+}
+
+func (v *Verifier) verifyMAC(p *models.Proof) (string, error) {
+	if p.MAC == "" {
+		return "", errNoPassword
+	}
+
+	token := v.psk
+	if p.User != "" {
+		t, ok := v.users[p.User]
+		if !ok {
+			return "", errUnknown
+		}
+		token = t
+	}
+	if token == "" {
+		return "", errNoPassword
+	}
+
+	if !hmac.Equal([]byte(p.MAC), []byte(mac(token, p.User, p.Time, p.Nonce))) {
+		return "", errBadMAC
+	}
+	return p.User, nil
+}
+
+// Sign returns a fresh proof that the client knows token and, once an
+// identity is loaded, holds the key of its certificate. An empty user signs
+// with the pre-shared key. Sign returns nil without any credentials.
+func Sign(user, token string) *models.Proof {
+	identityMu.RLock()
+	cert := identity
+	identityMu.RUnlock()
+
+	if token == "" && cert == nil {
+		return nil
+	}
+
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+
+	p := &models.Proof{
+		User:  user,
+		Time:  time.Now().Unix(),
+		Nonce: base64.RawStdEncoding.EncodeToString(b),
+	}
+	if token != "" {
+		p.MAC = mac(token, p.User, p.Time, p.Nonce)
+	}
+	if cert != nil {
+		sig, err := sign(cert, message(p.User, p.Time, p.Nonce))
+		if err == nil {
+			p.Cert = cert.Certificate[0]
+			p.Sig = sig
+		}
+	}
+	return p
+}
+
+func message(user string, t int64, nonce string) []byte {
+	return []byte(user + "|" + strconv.FormatInt(t, 10) + "|" + nonce)
+}
+
+func mac(token, user string, t int64, nonce string) string {
+	h := hmac.New(sha256.New, []byte(token))
+	h.Write(message(user, t, nonce))
+	return base64.RawStdEncoding.EncodeToString(h.Sum(nil))
+}
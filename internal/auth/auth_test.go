@@ -0,0 +1,113 @@
+package auth
+
+import (
+	"errors"
+	"myproxy/pkg/models"
+	"testing"
+	"time"
+)
+
+// setup installs c as the endpoint credentials for the duration of the test.
+func setup(t *testing.T, c *models.Auth, tlsCfg *models.Tls) {
+	t.Helper()
+	if err := Init(c, tlsCfg); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = Init(nil, nil) })
+}
+
+// proof returns a proof for user signed with token at t.
+func proof(user, token string, t time.Time, nonce string) *models.Proof {
+	p := &models.Proof{User: user, Time: t.Unix(), Nonce: nonce}
+	p.MAC = mac(token, p.User, p.Time, p.Nonce)
+	return p
+}
+
+func TestVerifyMAC(t *testing.T) {
+	setup(t, &models.Auth{
+		Psk:   "shared",
+		Users: []*models.User{{Name: "alice", Token: "a-token"}},
+	}, nil)
+
+	now := time.Now()
+	tests := []struct {
+		name     string
+		p        *models.Proof
+		wantUser string
+		wantErr  error
+	}{
+		{"psk", proof("", "shared", now, "n1"), "", nil},
+		{"user token", proof("alice", "a-token", now, "n2"), "alice", nil},
+		{"user with psk", proof("alice", "shared", now, "n3"), "", errBadMAC},
+		{"unknown user", proof("bob", "shared", now, "n4"), "", errUnknown},
+		{"wrong token", proof("", "guess", now, "n5"), "", errBadMAC},
+		{"no mac", &models.Proof{Time: now.Unix(), Nonce: "n6"}, "", errNoPassword},
+		{"no proof", nil, "", errNoProof},
+		{"expired", proof("", "shared", now.Add(-maxSkew-time.Minute), "n7"), "", errExpired},
+		{"from the future", proof("", "shared", now.Add(maxSkew+time.Minute), "n8"), "", errExpired},
+		{"within skew", proof("alice", "a-token", now.Add(-maxSkew/2), "n9"), "alice", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := Verify(tt.p)
+			if !errors.Is(err, tt.wantErr) || user != tt.wantUser {
+				t.Errorf("Verify() = %q, %v, want %q, %v", user, err, tt.wantUser, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyReplay(t *testing.T) {
+	setup(t, &models.Auth{Psk: "shared"}, nil)
+
+	p := proof("", "shared", time.Now(), "once")
+	if _, err := Verify(p); err != nil {
+		t.Fatalf("first Verify() = %v", err)
+	}
+	if _, err := Verify(p); !errors.Is(err, errReplayed) {
+		t.Errorf("second Verify() = %v, want %v", err, errReplayed)
+	}
+
+	// A rejected proof does not use up its nonce.
+	if _, err := Verify(proof("", "guess", time.Now(), "later")); !errors.Is(err, errBadMAC) {
+		t.Fatalf("Verify() = %v, want %v", err, errBadMAC)
+	}
+	if _, err := Verify(proof("", "shared", time.Now(), "later")); err != nil {
+		t.Errorf("Verify() after a rejected proof = %v", err)
+	}
+}
+
+func TestVerifyDisabled(t *testing.T) {
+	setup(t, nil, nil)
+
+	if Enabled() {
+		t.Fatal("Enabled() without credentials")
+	}
+	for _, p := range []*models.Proof{nil, {User: "mallory"}} {
+		user, err := Verify(p)
+		if err != nil || user != "" {
+			t.Errorf("Verify(%+v) = %q, %v, want the empty user", p, user, err)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	setup(t, &models.Auth{Users: []*models.User{{Name: "alice", Token: "a-token"}}}, nil)
+	if err := LoadIdentity(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if p := Sign("alice", ""); p != nil {
+		t.Errorf("Sign() without credentials = %+v, want nil", p)
+	}
+
+	a, b := Sign("alice", "a-token"), Sign("alice", "a-token")
+	if a.Nonce == b.Nonce {
+		t.Error("Sign() reused a nonce")
+	}
+	for _, p := range []*models.Proof{a, b} {
+		if user, err := Verify(p); err != nil || user != "alice" {
+			t.Errorf("Verify(Sign()) = %q, %v", user, err)
+		}
+	}
+}
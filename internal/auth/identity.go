@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"myproxy/pkg/models"
+	tls2 "myproxy/pkg/util/tls"
+	"sync"
+)
+
+var (
+	errUnsupportedKey = errors.New("unsupported certificate key type")
+	errBadSig         = errors.New("invalid certificate signature")
+)
+
+var (
+	identity   *tls.Certificate
+	identityMu sync.RWMutex
+)
+
+// LoadIdentity loads the certificate of t as the client identity that Sign
+// proves to endpoints. Without a certificate no identity is used.
+func LoadIdentity(t *models.Tls) error {
+	var cert *tls.Certificate
+	if t != nil && t.Crt != "" && t.Key != "" {
+		c, err := tls2.LoadKeyPair(t.Crt, t.Key)
+		if err != nil {
+			return err
+		}
+		cert = c
+	}
+
+	identityMu.Lock()
+	identity = cert
+	identityMu.Unlock()
+	return nil
+}
+
+// sign signs msg with the key of cert, hashing it with SHA-256 unless the
+// key is Ed25519.
+func sign(cert *tls.Certificate, msg []byte) ([]byte, error) {
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errUnsupportedKey
+	}
+	if _, ok = signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	digest := sha256.Sum256(msg)
+	return signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+}
+
+func verifySignature(pub any, msg, sig []byte) error {
+	digest := sha256.Sum256(msg)
+
+	var ok bool
+	switch k := pub.(type) {
+	case *ecdsa.PublicKey:
+		ok = ecdsa.VerifyASN1(k, digest[:], sig)
+	case *rsa.PublicKey:
+		ok = rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) == nil
+	case ed25519.PublicKey:
+		ok = ed25519.Verify(k, msg, sig)
+	default:
+		return errUnsupportedKey
+	}
+	if !ok {
+		return errBadSig
+	}
+	return nil
+}
+
+type userKey struct{}
+
+// WithUser returns a copy of ctx carrying the authenticated user.
+func WithUser(ctx context.Context, user string) context.Context {
+	return context.WithValue(ctx, userKey{}, user)
+}
+
+// User returns the authenticated user carried by ctx.
+func User(ctx context.Context) string {
+	user, _ := ctx.Value(userKey{}).(string)
+	return user
+}
@@ -0,0 +1,180 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"myproxy/pkg/models"
+	tls2 "myproxy/pkg/util/tls"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA signs client certificates for the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newCA writes a fresh CA certificate to dir and returns it with its path.
+func newCA(t *testing.T, dir, name string) (*testCA, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name+".crt")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}, path
+}
+
+// useIdentity issues a client certificate for cn and loads it as the client
+// identity for the duration of the test.
+func useIdentity(t *testing.T, ca *testCA, dir, cn string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &models.Tls{Crt: filepath.Join(dir, cn+".crt"), Key: filepath.Join(dir, cn+".key")}
+	if err = os.WriteFile(c.Crt, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(c.Key, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err = LoadIdentity(c); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = LoadIdentity(nil) })
+}
+
+func TestVerifyCert(t *testing.T) {
+	dir := t.TempDir()
+	ca, caPath := newCA(t, dir, "ca")
+	other, _ := newCA(t, dir, "other")
+
+	tests := []struct {
+		name     string
+		issuer   *testCA
+		policy   string
+		token    string
+		tamper   bool
+		wantUser string
+		wantErr  bool
+	}{
+		{"trusted", ca, "", "", false, "dev-1", false},
+		{"untrusted", other, "", "", false, "", true},
+		{"bad signature", ca, "", "", true, "", true},
+		{"verify if given", ca, tls2.ClientAuthVerifyIfGiven, "shared", false, "dev-1", false},
+		{"untrusted with psk", other, tls2.ClientAuthVerifyIfGiven, "shared", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t, &models.Auth{Psk: "shared"}, &models.Tls{ClientCa: caPath, ClientAuth: tt.policy})
+			useIdentity(t, tt.issuer, t.TempDir(), "dev-1")
+
+			// The claimed user is ignored in favour of the certificate.
+			p := Sign("root", tt.token)
+			if tt.tamper {
+				p.Nonce += "x"
+			}
+			user, err := Verify(p)
+			if (err != nil) != tt.wantErr || user != tt.wantUser {
+				t.Errorf("Verify() = %q, %v, want %q, error %v", user, err, tt.wantUser, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyCertPolicy(t *testing.T) {
+	dir := t.TempDir()
+	_, caPath := newCA(t, dir, "ca")
+
+	tests := []struct {
+		policy  string
+		wantErr error
+	}{
+		{"", errNoCert},
+		{tls2.ClientAuthRequire, errNoCert},
+		{tls2.ClientAuthVerifyIfGiven, nil},
+		{tls2.ClientAuthRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			setup(t, &models.Auth{Psk: "shared"}, &models.Tls{ClientCa: caPath, ClientAuth: tt.policy})
+
+			if _, err := Verify(proof("", "shared", time.Now(), "n")); !errors.Is(err, tt.wantErr) {
+				t.Errorf("Verify() without a certificate = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestVerifyCertReplay(t *testing.T) {
+	dir := t.TempDir()
+	ca, caPath := newCA(t, dir, "ca")
+	setup(t, nil, &models.Tls{ClientCa: caPath})
+	useIdentity(t, ca, dir, "dev-1")
+
+	p := Sign("", "")
+	if _, err := Verify(p); err != nil {
+		t.Fatalf("first Verify() = %v", err)
+	}
+	if _, err := Verify(p); !errors.Is(err, errReplayed) {
+		t.Errorf("second Verify() = %v, want %v", err, errReplayed)
+	}
+}
+
+func TestCheckBadCA(t *testing.T) {
+	dir := t.TempDir()
+	if err := Check(nil, &models.Tls{ClientCa: filepath.Join(dir, "none.crt")}); err == nil {
+		t.Error("Check accepted a missing client CA")
+	}
+	_, caPath := newCA(t, dir, "ca")
+	if err := Check(nil, &models.Tls{ClientCa: caPath, ClientAuth: "sometimes"}); err == nil {
+		t.Error("Check accepted an unknown client auth policy")
+	}
+}
@@ -1,16 +1,26 @@
 package internal
 
-import "sync"
+import (
+	"myproxy/pkg/models"
+	"sync"
+)
 
 type Message struct {
-	Tag      string `json:"tag"`
-	NodePort uint16 `json:"nodePort"`
+	Tag      string        `json:"tag"`
+	NodePort uint16        `json:"nodePort"`
+	Proof    *models.Proof `json:"proof,omitempty"`
 }
 
 type OutSeverInfo struct {
 	Tag      string `json:"tag"`
 	Address  string `json:"address"`
 	NodePort uint16 `json:"nodePort"`
+	User     string `json:"user"`
+	Token    string `json:"-"`
+}
+
+func (o OutSeverInfo) NodeAddr() *models.NetAddr {
+	return &models.NetAddr{Address: o.Address, Port: o.NodePort}
 }
 
 var (
@@ -31,6 +41,15 @@ func SetOsi(key string, v OutSeverInfo) {
 	osiMu.Unlock()
 }
 
+// SwapOsi replaces the info stored under key and returns the previous one.
+func SwapOsi(key string, v OutSeverInfo) (OutSeverInfo, bool) {
+	osiMu.Lock()
+	old, ok := osi[key]
+	osi[key] = v
+	osiMu.Unlock()
+	return old, ok
+}
+
 func RangeOsi(f func(key string, v OutSeverInfo) bool) {
 	osiMu.RLock()
 	defer osiMu.RUnlock()
@@ -40,3 +59,12 @@ func RangeOsi(f func(key string, v OutSeverInfo) bool) {
 		}
 	}
 }
+
+// DelOsi removes the info stored under key and returns it.
+func DelOsi(key string) (OutSeverInfo, bool) {
+	osiMu.Lock()
+	old, ok := osi[key]
+	delete(osi, key)
+	osiMu.Unlock()
+	return old, ok
+}
@@ -0,0 +1,81 @@
+package conntrack
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/models"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccessRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	err := mlog.Init(&models.Log{Output: mlog.OutputStderr, ConsoleLevel: "fatal", Access: &models.AccessLog{Path: path}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = mlog.Close() })
+
+	info := Info{Inbound: "socks", User: "alice", Network: "tcp", Src: "127.0.0.1:5000", Host: "a.test", Outbound: "proxy", Rule: "2"}
+	closed := Open(info, nil)
+	closed.AddUp(10)
+	closed.AddDown(20)
+	_ = closed.Close()
+	_ = closed.Close()
+
+	failed := Open(info, nil)
+	failed.Fail(errors.New("refused"))
+	_ = failed.Close()
+
+	killed := Open(info, &closer{})
+	Kill(killed.ID())
+
+	if err = mlog.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []map[string]any
+	for s := bufio.NewScanner(f); s.Scan(); {
+		var r map[string]any
+		if err = json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("record %q is not JSON: %v", s.Text(), err)
+		}
+		records = append(records, r)
+	}
+
+	tests := []struct {
+		c      *Conn
+		reason string
+		err    any
+	}{
+		{closed, ReasonClosed, nil},
+		{failed, ReasonFailed, "refused"},
+		{killed, ReasonKilled, nil},
+	}
+	if len(records) != len(tests) {
+		t.Fatalf("%d records, want one per connection", len(records))
+	}
+	for i, tt := range tests {
+		r := records[i]
+		if r["id"] != tt.c.ID() || r["reason"] != tt.reason || r["error"] != tt.err {
+			t.Errorf("record %d = %v, want %s closed as %s", i, r, tt.c.ID(), tt.reason)
+		}
+		for k, want := range map[string]string{"inbound": "socks", "user": "alice", "network": "tcp",
+			"src": "127.0.0.1:5000", "host": "a.test", "outbound": "proxy", "rule": "2"} {
+			if r[k] != want {
+				t.Errorf("record %d %s = %v, want %s", i, k, r[k], want)
+			}
+		}
+	}
+	if r := records[0]; r["up"] != 10.0 || r["down"] != 20.0 {
+		t.Errorf("record counts %v up and %v down", r["up"], r["down"])
+	}
+}
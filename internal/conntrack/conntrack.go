@@ -0,0 +1,266 @@
+package conntrack
+
+import (
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	"myproxy/internal/metrics"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/util/id"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Close reasons written to the access log.
+const (
+	ReasonClosed = "closed"
+	ReasonFailed = "failed"
+	ReasonKilled = "killed"
+)
+
+// ErrNoOutbound fails connections routed to an outbound that is not
+// registered.
+var ErrNoOutbound = errors.New("outbound not found")
+
+// Info describes a tracked connection. Rule is the index of the routing rule
+// that chose Outbound. Up counts bytes sent by the client, Down bytes sent
+// back to it. Inbound and Src are empty for streams accepted by the endpoint,
+// IP is empty until the destination address is known.
+type Info struct {
+	ID       string    `json:"id"`
+	Inbound  string    `json:"inbound"`
+	User     string    `json:"user"`
+	Network  string    `json:"network"`
+	Src      string    `json:"src"`
+	Host     string    `json:"host"`
+	IP       string    `json:"ip"`
+	Outbound string    `json:"outbound"`
+	Rule     string    `json:"rule"`
+	Start    time.Time `json:"start"`
+	Up       int64     `json:"up"`
+	Down     int64     `json:"down"`
+}
+
+// Conn is a live entry of the table. It is removed by Close. Its ID is the
+// connection ID carried through the tunnel, so a node serving both ends of a
+// connection holds two entries with the same ID.
+type Conn struct {
+	mu     sync.Mutex
+	info   Info
+	reason string
+	err    error
+
+	up     atomic.Int64
+	down   atomic.Int64
+	closer io.Closer
+
+	upTotal   *metrics.Counter
+	downTotal *metrics.Counter
+	once      sync.Once
+	logger    mlog.Logger
+}
+
+var (
+	conns   = make(map[*Conn]struct{})
+	connsMu sync.RWMutex
+)
+
+// Open registers a connection described by info and returns its entry.
+// closer is closed when the connection is killed. info.ID is generated when
+// empty, and info.IP defaults to info.Host when it is an IP address.
+func Open(info Info, closer io.Closer) *Conn {
+	if info.ID == "" {
+		info.ID = id.GetSnowflakeID().String()
+	}
+	if info.IP == "" && net.ParseIP(info.Host) != nil {
+		info.IP = info.Host
+	}
+	info.Start = time.Now()
+
+	c := &Conn{
+		info:      info,
+		closer:    closer,
+		logger:    mlog.ForConn(info.ID),
+		upTotal:   metrics.Bytes.With("up", info.Inbound, info.Outbound, info.Rule),
+		downTotal: metrics.Bytes.With("down", info.Inbound, info.Outbound, info.Rule),
+	}
+	metrics.Connections.With(info.Inbound, info.Outbound, info.Rule).Inc()
+
+	connsMu.Lock()
+	conns[c] = struct{}{}
+	connsMu.Unlock()
+	return c
+}
+
+func (c *Conn) ID() string {
+	return c.info.ID
+}
+
+// Log returns a logger tagging records with the connection ID.
+func (c *Conn) Log() mlog.Logger {
+	return c.logger
+}
+
+// SetRemote records the address the connection was dialed to.
+func (c *Conn) SetRemote(addr net.Addr) {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return
+	}
+	c.mu.Lock()
+	c.info.IP = host
+	c.mu.Unlock()
+}
+
+func (c *Conn) AddUp(n int) {
+	c.up.Add(int64(n))
+	c.upTotal.Add(uint64(n))
+}
+
+func (c *Conn) AddDown(n int) {
+	c.down.Add(int64(n))
+	c.downTotal.Add(uint64(n))
+}
+
+// Fail counts the connection as failed to reach its outbound because of err.
+func (c *Conn) Fail(err error) {
+	metrics.Errors.With(c.info.Inbound, c.info.Outbound, c.info.Rule).Inc()
+	c.setReason(ReasonFailed, err)
+}
+
+// setReason records why the connection closed. The first reason wins.
+func (c *Conn) setReason(reason string, err error) {
+	c.mu.Lock()
+	if c.reason == "" {
+		c.reason = reason
+		c.err = err
+	}
+	c.mu.Unlock()
+}
+
+// Info returns a snapshot of the entry.
+func (c *Conn) Info() Info {
+	c.mu.Lock()
+	info := c.info
+	c.mu.Unlock()
+	info.Up = c.up.Load()
+	info.Down = c.down.Load()
+	return info
+}
+
+// Close removes the entry and closes its connection. It is safe to call more
+// than once.
+func (c *Conn) Close() error {
+	var err error
+	c.once.Do(func() {
+		connsMu.Lock()
+		delete(conns, c)
+		connsMu.Unlock()
+		if c.closer != nil {
+			err = c.closer.Close()
+		}
+		c.log()
+	})
+	return err
+}
+
+func (c *Conn) log() {
+	if !mlog.AccessEnabled() {
+		return
+	}
+
+	c.setReason(ReasonClosed, nil)
+	info := c.Info()
+	c.mu.Lock()
+	reason, err := c.reason, c.err
+	c.mu.Unlock()
+
+	fields := []zap.Field{
+		zap.String("id", info.ID),
+		zap.Time("start", info.Start),
+		zap.Duration("duration", time.Since(info.Start)),
+		zap.String("network", info.Network),
+		zap.String("inbound", info.Inbound),
+		zap.String("user", info.User),
+		zap.String("src", info.Src),
+		zap.String("host", info.Host),
+		zap.String("ip", info.IP),
+		zap.String("rule", info.Rule),
+		zap.String("outbound", info.Outbound),
+		zap.Int64("up", info.Up),
+		zap.Int64("down", info.Down),
+		zap.String("reason", reason),
+	}
+	if err != nil {
+		fields = append(fields, zap.String("error", err.Error()))
+	}
+	mlog.Access("connection", fields...)
+}
+
+// Wrap counts what is read from rwc as sent by the client and what is written
+// to it as sent back. rwc must be the client side of the connection.
+func (c *Conn) Wrap(rwc io.ReadWriteCloser) io.ReadWriteCloser {
+	return &counted{ReadWriteCloser: rwc, c: c}
+}
+
+type counted struct {
+	io.ReadWriteCloser
+	c *Conn
+}
+
+func (r *counted) Read(b []byte) (int, error) {
+	n, err := r.ReadWriteCloser.Read(b)
+	r.c.AddUp(n)
+	return n, err
+}
+
+func (r *counted) Write(b []byte) (int, error) {
+	n, err := r.ReadWriteCloser.Write(b)
+	r.c.AddDown(n)
+	return n, err
+}
+
+// List returns every live connection, oldest first.
+func List() []Info {
+	connsMu.RLock()
+	infos := make([]Info, 0, len(conns))
+	for c := range conns {
+		infos = append(infos, c.Info())
+	}
+	connsMu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Start.Before(infos[j].Start)
+	})
+	return infos
+}
+
+// Kill closes the connection id and reports whether it was live.
+func Kill(id string) bool {
+	return kill(func(c *Conn) bool { return c.info.ID == id }) > 0
+}
+
+// KillUser closes every connection of user and returns how many there were.
+func KillUser(user string) int {
+	return kill(func(c *Conn) bool { return c.Info().User == user })
+}
+
+func kill(match func(c *Conn) bool) int {
+	connsMu.RLock()
+	var victims []*Conn
+	for c := range conns {
+		if match(c) {
+			victims = append(victims, c)
+		}
+	}
+	connsMu.RUnlock()
+
+	for _, c := range victims {
+		c.setReason(ReasonKilled, nil)
+		_ = c.Close()
+	}
+	return len(victims)
+}
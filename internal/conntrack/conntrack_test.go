@@ -0,0 +1,137 @@
+package conntrack
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+// closer counts how often it is closed.
+type closer struct {
+	closed int
+}
+
+func (c *closer) Close() error {
+	c.closed++
+	return nil
+}
+
+// open registers a connection that is closed when the test is done.
+func open(t *testing.T, info Info) (*Conn, *closer) {
+	t.Helper()
+	cl := &closer{}
+	c := Open(info, cl)
+	t.Cleanup(func() { _ = c.Close() })
+	return c, cl
+}
+
+func live(id string) bool {
+	for _, info := range List() {
+		if info.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestKill(t *testing.T) {
+	a, closeA := open(t, Info{ID: "a", User: "alice"})
+	_, closeB := open(t, Info{ID: "b", User: "alice"})
+	_, closeC := open(t, Info{ID: "c", User: "bob"})
+
+	if !Kill("a") {
+		t.Fatal("Kill() did not find a live connection")
+	}
+	if closeA.closed != 1 || live("a") {
+		t.Errorf("killed connection closed %d times, listed %v", closeA.closed, live("a"))
+	}
+	if Kill("a") {
+		t.Error("Kill() found a connection already killed")
+	}
+	_ = a.Close()
+	if closeA.closed != 1 {
+		t.Errorf("Close() after Kill closed the connection again")
+	}
+
+	if n := KillUser("alice"); n != 1 || closeB.closed != 1 {
+		t.Errorf("KillUser() = %d, closed %d", n, closeB.closed)
+	}
+	if closeC.closed != 0 || !live("c") {
+		t.Error("KillUser() closed a connection of another user")
+	}
+	if n := KillUser("nobody"); n != 0 {
+		t.Errorf("KillUser() = %d for an unknown user", n)
+	}
+}
+
+func TestList(t *testing.T) {
+	first, _ := open(t, Info{ID: "first", Host: "192.0.2.1"})
+	_, _ = open(t, Info{ID: "second", Host: "a.test"})
+
+	var got []Info
+	for _, info := range List() {
+		if info.ID == "first" || info.ID == "second" {
+			got = append(got, info)
+		}
+	}
+	if len(got) != 2 || got[0].ID != "first" {
+		t.Fatalf("List() = %+v, want first then second", got)
+	}
+	if got[0].IP != "192.0.2.1" || got[1].IP != "" {
+		t.Errorf("IP = %q and %q, want the host only when it is an address", got[0].IP, got[1].IP)
+	}
+
+	first.AddUp(3)
+	first.AddDown(5)
+	if info := first.Info(); info.Up != 3 || info.Down != 5 {
+		t.Errorf("Info() counts %d up and %d down", info.Up, info.Down)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	c, _ := open(t, Info{})
+	if c.ID() == "" {
+		t.Fatal("Open() did not generate an ID")
+	}
+
+	var rw struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}
+	var out bytes.Buffer
+	rw.Reader, rw.Writer, rw.Closer = bytes.NewReader([]byte("request")), &out, &closer{}
+	wrapped := c.Wrap(rw)
+
+	if _, err := io.ReadAll(wrapped); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrapped.Write([]byte("response!")); err != nil {
+		t.Fatal(err)
+	}
+	if info := c.Info(); info.Up != 7 || info.Down != 9 {
+		t.Errorf("Info() counts %d up and %d down, want 7 and 9", info.Up, info.Down)
+	}
+}
+
+func TestSharedID(t *testing.T) {
+	// A node serving both ends of a connection tracks it twice.
+	client, closeClient := open(t, Info{ID: "42", Inbound: "socks"})
+	_, closeServer := open(t, Info{ID: "42"})
+
+	if client.ID() != "42" {
+		t.Errorf("ID() = %s, want the given ID", client.ID())
+	}
+	n := 0
+	for _, info := range List() {
+		if info.ID == "42" {
+			n++
+		}
+	}
+	if n != 2 {
+		t.Errorf("List() holds %d entries of the connection, want 2", n)
+	}
+	if !Kill("42") || closeClient.closed != 1 || closeServer.closed != 1 {
+		t.Error("Kill() did not close both ends")
+	}
+}
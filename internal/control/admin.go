@@ -0,0 +1,79 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"myproxy/internal"
+	"myproxy/internal/admin"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/di"
+	"myproxy/pkg/models"
+	"reflect"
+)
+
+type adminServer struct {
+	Ctx      context.Context
+	AdminCfg *models.Admin
+	Server   *admin.Server
+}
+
+func (a *adminServer) Run() error {
+	if a.AdminCfg == nil || a.AdminCfg.Listen == "" {
+		return nil
+	}
+
+	instance, ok := internal.FromContext(a.Ctx)
+	if !ok {
+		return errors.New("admin API needs a running instance")
+	}
+
+	server := admin.New(a.AdminCfg, instance)
+	if err := server.Start(); err != nil {
+		return err
+	}
+	a.Server = server
+	return nil
+}
+
+func (a *adminServer) Close() error {
+	if a.Server == nil {
+		return nil
+	}
+	err := a.Server.Close()
+	a.Server = nil
+	return err
+}
+
+// Reload restarts the API when its address or token changed. When the new
+// API cannot start, the previous one is started again.
+func (a *adminServer) Reload(v any) error {
+	cfg, _ := v.(*models.Admin)
+	if reflect.DeepEqual(cfg, a.AdminCfg) {
+		return nil
+	}
+
+	if err := a.Close(); err != nil {
+		return err
+	}
+	old := a.AdminCfg
+	a.AdminCfg = cfg
+	if err := a.Run(); err != nil {
+		// Go back to the previous listener, which was just released.
+		a.AdminCfg = old
+		if rerr := a.Run(); rerr != nil {
+			mlog.Error("restore previous listener: " + rerr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+func adminServerCreator(ctx context.Context, v any) (any, error) {
+	cfg := v.(*models.Admin)
+	return &adminServer{Ctx: ctx, AdminCfg: cfg}, nil
+}
+
+func init() {
+	ac := reflect.TypeOf(&models.Admin{})
+	di.ServerContext[ac] = adminServerCreator
+}
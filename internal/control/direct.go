@@ -0,0 +1,47 @@
+package control
+
+import (
+	"context"
+	"myproxy/pkg/di"
+	"myproxy/pkg/models"
+	net2 "myproxy/pkg/util/net"
+	"reflect"
+)
+
+type directServer struct {
+	Ctx       context.Context
+	DirectCfg *models.Direct
+}
+
+func (d *directServer) Run() error {
+	return net2.SetDirect(d.DirectCfg)
+}
+
+func (d *directServer) Close() error {
+	return net2.SetDirect(nil)
+}
+
+// Reload applies to the connections dialed from now on.
+func (d *directServer) Reload(v any) error {
+	cfg, _ := v.(*models.Direct)
+	if err := net2.SetDirect(cfg); err != nil {
+		return err
+	}
+	d.DirectCfg = cfg
+	return nil
+}
+
+func (d *directServer) Check(v any) error {
+	cfg, _ := v.(*models.Direct)
+	return net2.CheckDirect(cfg)
+}
+
+func directServerCreator(ctx context.Context, v any) (any, error) {
+	cfg := v.(*models.Direct)
+	return &directServer{Ctx: ctx, DirectCfg: cfg}, nil
+}
+
+func init() {
+	dc := reflect.TypeOf(&models.Direct{})
+	di.ServerContext[dc] = directServerCreator
+}
@@ -0,0 +1,47 @@
+package control
+
+import (
+	"context"
+	"myproxy/internal/dns"
+	"myproxy/pkg/di"
+	"myproxy/pkg/models"
+	"reflect"
+)
+
+type dnsServer struct {
+	Ctx    context.Context
+	DNSCfg *models.DNS
+}
+
+func (d *dnsServer) Run() error {
+	return dns.Run(d.DNSCfg)
+}
+
+func (d *dnsServer) Close() error {
+	return dns.Close()
+}
+
+// Reload swaps in the new servers and rules. Cached answers are dropped.
+func (d *dnsServer) Reload(v any) error {
+	cfg, _ := v.(*models.DNS)
+	if err := dns.Run(cfg); err != nil {
+		return err
+	}
+	d.DNSCfg = cfg
+	return nil
+}
+
+func (d *dnsServer) Check(v any) error {
+	cfg, _ := v.(*models.DNS)
+	return dns.Check(cfg)
+}
+
+func dnsServerCreator(ctx context.Context, v any) (any, error) {
+	cfg := v.(*models.DNS)
+	return &dnsServer{Ctx: ctx, DNSCfg: cfg}, nil
+}
+
+func init() {
+	dc := reflect.TypeOf(&models.DNS{})
+	di.ServerContext[dc] = dnsServerCreator
+}
@@ -8,6 +8,7 @@ import (
 	"go.uber.org/zap"
 	"golang.org/x/net/quic"
 	"myproxy/internal"
+	"myproxy/internal/auth"
 	"myproxy/internal/mlog"
 	"myproxy/internal/proxy"
 	"myproxy/pkg/di"
@@ -15,6 +16,7 @@ import (
 	"myproxy/pkg/protocol"
 	"myproxy/pkg/util/net"
 	"myproxy/pkg/util/packet"
+	"myproxy/pkg/util/tls"
 	"reflect"
 	"sync"
 )
@@ -30,7 +32,25 @@ func (e *endpointServer) Run() error {
 	if err != nil {
 		return err
 	}
+
+	var t *models.Tls
+	if protocol.Transfer != nil {
+		t = protocol.Transfer.TLS
+	}
+	if err = auth.Init(e.ServerCfg.Auth, t); err != nil {
+		_ = endpoint.Close(e.Ctx)
+		return err
+	}
+	if pin, err := tls.ServerPin(t); err != nil {
+		_ = endpoint.Close(e.Ctx)
+		return err
+	} else if pin != "" {
+		mlog.Warn("endpoint certificate pin " + pin)
+	}
 	e.Endpoint = endpoint
+	if !auth.Enabled() {
+		mlog.Warn("endpoint accepts unauthenticated clients, configure endpoint.auth to restrict access")
+	}
 
 	mlog.Warn(fmt.Sprintf("endpoint listen on %s", e.ServerCfg.NetAddr.String()))
 
@@ -39,7 +59,43 @@ func (e *endpointServer) Run() error {
 	return nil
 }
 
+// Reload applies changed credentials to new registrations and streams. The
+// listen address cannot change without a restart.
+func (e *endpointServer) Reload(v any) error {
+	cfg, _ := v.(*models.Endpoint)
+	if cfg == nil || !reflect.DeepEqual(cfg.NetAddr, e.ServerCfg.NetAddr) || cfg.RandPort != e.ServerCfg.RandPort {
+		mlog.Warn("endpoint listen address changes take effect after a restart")
+		return nil
+	}
+
+	var t *models.Tls
+	if protocol.Transfer != nil {
+		t = protocol.Transfer.TLS
+	}
+	if err := auth.Init(cfg.Auth, t); err != nil {
+		return err
+	}
+	e.ServerCfg = cfg
+	return nil
+}
+
+func (e *endpointServer) Check(v any) error {
+	cfg, _ := v.(*models.Endpoint)
+	if cfg == nil {
+		return nil
+	}
+
+	var t *models.Tls
+	if protocol.Transfer != nil {
+		t = protocol.Transfer.TLS
+	}
+	return auth.Check(cfg.Auth, t)
+}
+
 func (e *endpointServer) Close() error {
+	if e.Endpoint == nil {
+		return nil
+	}
 	err := e.Endpoint.Close(e.Ctx)
 	if err != nil {
 		return err
@@ -62,6 +118,7 @@ func listen(ctx context.Context, endpoint *quic.Endpoint) {
 
 func handConn(ctx context.Context, conn *quic.Conn) {
 	defer func(conn *quic.Conn) {
+		release(conn)
 		err := conn.Close()
 		if err != nil {
 			return
@@ -78,11 +135,11 @@ func handConn(ctx context.Context, conn *quic.Conn) {
 			return
 		}
 
-		go handStream(ctx, stream)
+		go handStream(ctx, conn, stream)
 	}
 }
 
-func handStream(ctx context.Context, stream *quic.Stream) {
+func handStream(ctx context.Context, conn *quic.Conn, stream *quic.Stream) {
 	defer func(stream *quic.Stream) {
 		err := stream.Close()
 		if err != nil {
@@ -101,6 +158,28 @@ func handStream(ctx context.Context, stream *quic.Stream) {
 		return
 	}
 
+	user, err := auth.Verify(message.Proof)
+	if err != nil {
+		mlog.Warn("registration rejected", zap.String("tag", message.Tag), zap.Error(err))
+		return
+	}
+	mlog.Debug("registration accepted", zap.String("tag", message.Tag), zap.String("user", user))
+
+	if err = claim(message.Tag, user, conn); err != nil {
+		mlog.Warn("registration rejected", zap.String("tag", message.Tag), zap.Error(err))
+		return
+	}
+
+	// A client asking for the port its previous registration holds gets it
+	// back, so that endpoint has to be released first.
+	if message.NodePort != 0 {
+		if old, ok := dataEndpoints.Load(message.Tag); ok && old.(*dataEndpoint).endpoint.LocalAddr().Port() == message.NodePort {
+			if dataEndpoints.CompareAndDelete(message.Tag, old) {
+				old.(*dataEndpoint).endpoint.Close(ctx)
+			}
+		}
+	}
+
 	endpoint, err := getEndpoint(message)
 	if err != nil {
 		mlog.Error("", zap.Error(err))
@@ -110,20 +189,32 @@ func handStream(ctx context.Context, stream *quic.Stream) {
 	m := encodePacket(message, endpoint.LocalAddr().Port())
 	if m == nil {
 		mlog.Error("encode packet failed")
+		endpoint.Close(ctx)
 		return
 	}
 
 	_, err = stream.Write(m)
 	if err != nil {
 		mlog.Error("", zap.Error(err))
+		endpoint.Close(ctx)
 		return
 	}
 	stream.Flush()
 
-	if old, loaded := dataEndpoints.LoadAndDelete(message.Tag); loaded {
-		old.(*quic.Endpoint).Close(ctx)
+	registerMu.Lock()
+	if err = claim(message.Tag, user, conn); err != nil {
+		registerMu.Unlock()
+		mlog.Warn("registration rejected", zap.String("tag", message.Tag), zap.Error(err))
+		endpoint.Close(ctx)
+		return
+	}
+	old, loaded := dataEndpoints.Load(message.Tag)
+	dataEndpoints.Store(message.Tag, &dataEndpoint{user: user, conn: conn, endpoint: endpoint})
+	registerMu.Unlock()
+
+	if loaded {
+		old.(*dataEndpoint).endpoint.Close(ctx)
 	}
-	dataEndpoints.Store(message.Tag, endpoint)
 	go proxy.ListenQUIC(ctx, endpoint)
 }
 
@@ -185,7 +276,73 @@ func init() {
 	di.ServerContext[sc] = endpointServerCreator
 }
 
+// dataEndpoint is the data endpoint registered for a tag, the user that
+// registered it and the control connection it was registered on. conn is nil
+// once that connection closed.
+type dataEndpoint struct {
+	user     string
+	conn     *quic.Conn
+	endpoint *quic.Endpoint
+}
+
+// maxRegistrations bounds the tags one user holds. Clients authenticated by
+// the pre-shared key share the empty user and so share the limit.
+const maxRegistrations = 64
+
+var (
+	errTagTaken    = errors.New("tag held by another connection")
+	errTooManyTags = fmt.Errorf("user holds %d tags already", maxRegistrations)
+)
+
+// claim reports whether conn may register tag for user. A tag belongs to the
+// connection that registered it while that connection is open; after it
+// closes, only the same user can take the tag over. Clients share the user
+// when they authenticate by pre-shared key, so the user alone does not keep
+// one client from taking over the data endpoint of another.
+func claim(tag, user string, conn *quic.Conn) error {
+	held := 0
+	var err error
+	dataEndpoints.Range(func(k, v any) bool {
+		d := v.(*dataEndpoint)
+		if k.(string) == tag {
+			if d.conn != conn && (d.conn != nil || d.user != user) {
+				err = errTagTaken
+				return false
+			}
+			return true
+		}
+		if d.user == user {
+			held++
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if held >= maxRegistrations {
+		return errTooManyTags
+	}
+	return nil
+}
+
+// release marks the tags registered on conn as free to take over by their
+// user. Their data endpoints stay open for the streams still using them.
+func release(conn *quic.Conn) {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+
+	dataEndpoints.Range(func(k, v any) bool {
+		if d := v.(*dataEndpoint); d.conn == conn {
+			dataEndpoints.Store(k, &dataEndpoint{user: d.user, endpoint: d.endpoint})
+		}
+		return true
+	})
+}
+
 var (
-	errConnClosed   = "connection closed"
-	dataEndpoints   sync.Map
+	errConnClosed = "connection closed"
+	// dataEndpoints holds a *dataEndpoint per tag. registerMu serializes
+	// replacing one, so that the owner check and the store are atomic.
+	dataEndpoints sync.Map
+	registerMu    sync.Mutex
 )
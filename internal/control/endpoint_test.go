@@ -0,0 +1,48 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/quic"
+	"testing"
+)
+
+func TestClaim(t *testing.T) {
+	a, b := &quic.Conn{}, &quic.Conn{}
+	dataEndpoints.Store("t", &dataEndpoint{user: "", conn: a})
+	defer dataEndpoints.Delete("t")
+
+	if err := claim("t", "", a); err != nil {
+		t.Errorf("claim on the registering connection: %v", err)
+	}
+	if err := claim("t", "", b); !errors.Is(err, errTagTaken) {
+		t.Errorf("claim of a live tag on another connection = %v, want %v", err, errTagTaken)
+	}
+
+	release(a)
+	if err := claim("t", "", b); err != nil {
+		t.Errorf("claim of a released tag by the same user: %v", err)
+	}
+	if err := claim("t", "bob", b); !errors.Is(err, errTagTaken) {
+		t.Errorf("claim of a released tag by another user = %v, want %v", err, errTagTaken)
+	}
+}
+
+func TestClaimLimit(t *testing.T) {
+	conn := &quic.Conn{}
+	for i := 0; i < maxRegistrations; i++ {
+		tag := fmt.Sprintf("limit%d", i)
+		dataEndpoints.Store(tag, &dataEndpoint{user: "alice", conn: conn})
+		defer dataEndpoints.Delete(tag)
+	}
+
+	if err := claim("limit0", "alice", conn); err != nil {
+		t.Errorf("re-registering a held tag: %v", err)
+	}
+	if err := claim("new", "alice", conn); !errors.Is(err, errTooManyTags) {
+		t.Errorf("claim past the limit = %v, want %v", err, errTooManyTags)
+	}
+	if err := claim("new", "bob", conn); err != nil {
+		t.Errorf("claim by another user: %v", err)
+	}
+}
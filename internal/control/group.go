@@ -0,0 +1,46 @@
+package control
+
+import (
+	"context"
+	"myproxy/internal/router"
+	"myproxy/pkg/di"
+	"myproxy/pkg/models"
+	"reflect"
+)
+
+type groupServer struct {
+	Ctx    context.Context
+	Groups []*models.OutboundGroup
+}
+
+func (g *groupServer) Run() error {
+	return router.RunGroups(g.Groups)
+}
+
+func (g *groupServer) Close() error {
+	return nil
+}
+
+func (g *groupServer) Reload(v any) error {
+	groups, _ := v.([]*models.OutboundGroup)
+	if err := router.RunGroups(groups); err != nil {
+		return err
+	}
+	g.Groups = groups
+	return nil
+}
+
+func (g *groupServer) Check(v any) error {
+	groups, _ := v.([]*models.OutboundGroup)
+	return router.CheckGroups(groups)
+}
+
+func groupServerCreator(ctx context.Context, v any) (any, error) {
+	groups := v.([]*models.OutboundGroup)
+	return &groupServer{Ctx: ctx, Groups: groups}, nil
+}
+
+func init() {
+	gc := reflect.TypeOf([]*models.OutboundGroup{})
+	di.ServerContext[gc] = groupServerCreator
+}
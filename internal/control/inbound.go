@@ -2,28 +2,144 @@ package control
 
 import (
 	"context"
+	"fmt"
+	"myproxy/internal/mlog"
 	"myproxy/internal/proxy"
 	"myproxy/pkg/di"
 	"myproxy/pkg/models"
 	"reflect"
+	"sync"
 )
 
 type inboundServer struct {
 	Ctx      context.Context
 	Inbounds []*models.Inbound
+
+	mu      sync.Mutex
+	running map[string]*runningInbound
+}
+
+// runningInbound is one listening inbound. Cancelling it closes its
+// listeners; connections already accepted run under the instance context and
+// are left to finish.
+type runningInbound struct {
+	inb    *models.Inbound
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
+// Run starts every inbound, or none when one of them cannot listen.
 func (i *inboundServer) Run() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	for _, inbound := range i.Inbounds {
-		go proxy.Process(i.Ctx, inbound)
+		if err := i.start(inbound); err != nil {
+			i.stopAll()
+			return err
+		}
 	}
 	return nil
 }
 
 func (i *inboundServer) Close() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.stopAll()
 	return nil
 }
 
+func (i *inboundServer) stopAll() {
+	for tag, r := range i.running {
+		r.stop()
+		delete(i.running, tag)
+	}
+}
+
+// Reload stops the inbounds that were removed or changed and starts the new
+// and changed ones. Unchanged inbounds keep listening. When an inbound cannot
+// listen, the inbounds started so far are stopped and the stopped ones are
+// started again.
+func (i *inboundServer) Reload(v any) error {
+	inbounds, _ := v.([]*models.Inbound)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	next := make(map[string]*models.Inbound, len(inbounds))
+	for _, inb := range inbounds {
+		next[inb.Tag] = inb
+	}
+
+	var stopped []*models.Inbound
+	for tag, r := range i.running {
+		if inb, ok := next[tag]; ok && reflect.DeepEqual(inb, r.inb) {
+			continue
+		}
+		r.stop()
+		delete(i.running, tag)
+		stopped = append(stopped, r.inb)
+		mlog.Info("inbound " + tag + " stopped")
+	}
+
+	var started []string
+	for _, inb := range inbounds {
+		if _, ok := i.running[inb.Tag]; ok {
+			continue
+		}
+		if err := i.start(inb); err != nil {
+			for _, tag := range started {
+				i.running[tag].stop()
+				delete(i.running, tag)
+			}
+			for _, old := range stopped {
+				if rerr := i.start(old); rerr != nil {
+					mlog.Error("restore " + rerr.Error())
+				}
+			}
+			return err
+		}
+		started = append(started, inb.Tag)
+		mlog.Info(fmt.Sprintf("inbound %s started on %s", inb.Tag, inb.AddrPort()))
+	}
+
+	i.Inbounds = inbounds
+	return nil
+}
+
+// start starts inb and waits until its listeners are bound.
+func (i *inboundServer) start(inb *models.Inbound) error {
+	if i.running == nil {
+		i.running = make(map[string]*runningInbound)
+	}
+
+	listen, cancel := context.WithCancel(i.Ctx)
+	r := &runningInbound{inb: inb, cancel: cancel, done: make(chan struct{})}
+
+	bound := make(chan error, 1)
+	go func() {
+		defer close(r.done)
+		proxy.Process(i.Ctx, listen, inb, func(err error) {
+			bound <- err
+		})
+	}()
+	if err := <-bound; err != nil {
+		r.stop()
+		return fmt.Errorf("inbound %s: %w", inb.Tag, err)
+	}
+
+	i.running[inb.Tag] = r
+	return nil
+}
+
+// stop closes the listeners and waits until they are released, so a changed
+// inbound can bind the same port again.
+func (r *runningInbound) stop() {
+	r.cancel()
+	<-r.done
+}
+
 func inboundServerCreator(ctx context.Context, v any) (any, error) {
 	inbounds := v.([]*models.Inbound)
 	return &inboundServer{Ctx: ctx, Inbounds: inbounds}, nil
@@ -0,0 +1,88 @@
+package control
+
+import (
+	"context"
+	"errors"
+	"myproxy/internal/metrics"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/di"
+	"myproxy/pkg/models"
+	"net"
+	"net/http"
+	"reflect"
+	"time"
+)
+
+type metricsServer struct {
+	Ctx        context.Context
+	MetricsCfg *models.Metrics
+	Server     *http.Server
+}
+
+func (m *metricsServer) Run() error {
+	if m.MetricsCfg == nil || m.MetricsCfg.Listen == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", m.MetricsCfg.Listen)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	m.Server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	mlog.Warn("metrics listening on " + l.Addr().String())
+
+	go func(srv *http.Server) {
+		err := srv.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			mlog.Error("metrics: " + err.Error())
+		}
+	}(m.Server)
+	return nil
+}
+
+func (m *metricsServer) Close() error {
+	if m.Server == nil {
+		return nil
+	}
+	err := m.Server.Close()
+	m.Server = nil
+	return err
+}
+
+// Reload restarts the listener when its address changed. When the new
+// address cannot be bound, the previous one is bound again.
+func (m *metricsServer) Reload(v any) error {
+	cfg, _ := v.(*models.Metrics)
+	if reflect.DeepEqual(cfg, m.MetricsCfg) {
+		return nil
+	}
+
+	if err := m.Close(); err != nil {
+		return err
+	}
+	old := m.MetricsCfg
+	m.MetricsCfg = cfg
+	if err := m.Run(); err != nil {
+		// Go back to the previous listener, which was just released.
+		m.MetricsCfg = old
+		if rerr := m.Run(); rerr != nil {
+			mlog.Error("restore previous listener: " + rerr.Error())
+		}
+		return err
+	}
+	return nil
+}
+
+func metricsServerCreator(ctx context.Context, v any) (any, error) {
+	cfg := v.(*models.Metrics)
+	return &metricsServer{Ctx: ctx, MetricsCfg: cfg}, nil
+}
+
+func init() {
+	mc := reflect.TypeOf(&models.Metrics{})
+	di.ServerContext[mc] = metricsServerCreator
+}
@@ -3,81 +3,317 @@ package control
 import (
 	"context"
 	"encoding/json"
-	"errors"
+	"fmt"
+	"go.uber.org/zap"
 	"golang.org/x/net/quic"
+	"math/rand/v2"
 	"myproxy/internal"
+	"myproxy/internal/auth"
+	"myproxy/internal/health"
+	"myproxy/internal/metrics"
+	"myproxy/internal/mlog"
 	"myproxy/pkg/di"
 	"myproxy/pkg/models"
 	"myproxy/pkg/protocol"
 	"myproxy/pkg/util/net"
 	"myproxy/pkg/util/packet"
+	"myproxy/pkg/util/tls"
 	"reflect"
 	"sync"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
 )
 
 type outboundServer struct {
 	Ctx       context.Context
+	Cancel    context.CancelFunc
 	Outbounds []*models.Outbound
+
+	mu       sync.Mutex
+	sessions map[string]*session
 }
 
+// Run starts a registration session per outbound and waits for the first
+// attempt of each. Outbounds that could not register yet keep retrying in the
+// background instead of failing the start.
 func (o *outboundServer) Run() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.start(o.Outbounds)
+}
+
+func (o *outboundServer) Close() error {
+	o.Cancel()
+	return nil
+}
+
+// Reload stops the sessions of removed and changed outbounds and starts
+// sessions for the new and changed ones. Unchanged outbounds keep their
+// registration and pooled connection, so their streams are not interrupted.
+func (o *outboundServer) Reload(v any) error {
+	outbounds, _ := v.([]*models.Outbound)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	next := make(map[string]*models.Outbound, len(outbounds))
+	for _, oub := range outbounds {
+		next[oub.Tag] = oub
+	}
+
+	inUse := make(map[string]bool, len(outbounds))
+	for _, oub := range outbounds {
+		inUse[registerAddr(oub).String()] = true
+	}
+
+	for tag, s := range o.sessions {
+		if oub, ok := next[tag]; ok && reflect.DeepEqual(oub, s.oub) {
+			continue
+		}
+		s.stop()
+		delete(o.sessions, tag)
+		// Outbounds sharing the address keep its pins, and start replaces
+		// the pins of changed ones.
+		if addr := registerAddr(s.oub); !inUse[addr.String()] {
+			protocol.SetPins(addr, nil)
+		}
+		mlog.Info("outbound " + tag + " stopped")
+	}
+
+	var added []*models.Outbound
+	for _, oub := range outbounds {
+		if _, ok := o.sessions[oub.Tag]; !ok {
+			added = append(added, oub)
+		}
+	}
+
+	o.Outbounds = outbounds
+	return o.start(added)
+}
+
+func (o *outboundServer) Check(v any) error {
+	outbounds, _ := v.([]*models.Outbound)
+	for _, outbound := range outbounds {
+		if _, err := tls.ParsePins(outbound.Pins); err != nil {
+			return fmt.Errorf("outbound %s: %w", outbound.Tag, err)
+		}
+	}
+	return nil
+}
+
+func (o *outboundServer) start(outbounds []*models.Outbound) error {
+	pins := make([][][]byte, len(outbounds))
+	for i, outbound := range outbounds {
+		p, err := tls.ParsePins(outbound.Pins)
+		if err != nil {
+			return fmt.Errorf("outbound %s: %w", outbound.Tag, err)
+		}
+		pins[i] = p
+	}
+	for i, outbound := range outbounds {
+		protocol.SetPins(registerAddr(outbound), pins[i])
+	}
+
+	if o.sessions == nil {
+		o.sessions = make(map[string]*session)
+	}
+
 	var wg sync.WaitGroup
-	var mu sync.Mutex
-	var errs []error
-	for _, outbound := range o.Outbounds {
+	for i, outbound := range outbounds {
+		ctx, cancel := context.WithCancel(o.Ctx)
+		s := &session{oub: outbound, pins: pins[i], kick: make(chan struct{}, 1), cancel: cancel}
+		o.sessions[outbound.Tag] = s
+
 		wg.Add(1)
-		go initial(o.Ctx, &wg, &mu, &errs, outbound)
+		s.done.Add(2)
+		go func() {
+			defer s.done.Done()
+			s.run(ctx, wg.Done)
+		}()
+
+		p := health.NewProber(outbound, s.reconnect)
+		go func() {
+			defer s.done.Done()
+			p.Run(ctx)
+		}()
 	}
 	wg.Wait()
-	err := errors.Join(errs...)
-	if err != nil {
-		return err
-	}
 
 	return nil
 }
 
-func (o *outboundServer) Close() error {
-	return nil
+// session keeps one outbound registered with the endpoint. It re-registers
+// with backoff whenever the control connection closes or the data endpoint
+// is reported down by the health prober.
+type session struct {
+	oub    *models.Outbound
+	pins   [][]byte
+	kick   chan struct{}
+	cancel context.CancelFunc
+	done   sync.WaitGroup
 }
 
-func initial(ctx context.Context, wg *sync.WaitGroup, mu *sync.Mutex, errs *[]error, oub *models.Outbound) {
-	defer wg.Done()
+// stop ends the registration and health checks of the outbound and drops
+// its node and the node's pins, so rules targeting it fail until it is
+// added again.
+func (s *session) stop() {
+	s.cancel()
+	s.done.Wait()
 
-	endpoint, err := protocol.GetEndpoint(&models.NetAddr{Port: net.GetFreePort()})
-	if err != nil {
-		mu.Lock()
-		*errs = append(*errs, err)
-		mu.Unlock()
-		return
+	if info, ok := internal.DelOsi(s.oub.Tag); ok {
+		protocol.RemoveConn(info.NodeAddr())
+		protocol.SetPins(info.NodeAddr(), nil)
+	}
+}
+
+func (s *session) reconnect() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
 	}
-	defer func(endpoint *quic.Endpoint, ctx context.Context) {
-		err := endpoint.Close(ctx)
+}
+
+func (s *session) run(ctx context.Context, started func()) {
+	var retry backoff
+	for {
+		conn, nodePort, err := s.register(ctx)
+		if started != nil {
+			started()
+			started = nil
+		}
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			wait := retry.next()
+			mlog.Error(fmt.Sprintf("register outbound %s, retry in %s", s.oub.Tag, wait.Round(time.Millisecond)), zap.Error(err))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(wait):
+			}
+			continue
+		}
+		retry.reset()
+
+		s.swap(nodePort)
+
+		// Drop down reports about the node that was just replaced.
+		select {
+		case <-s.kick:
+		default:
+		}
+
+		lost := make(chan struct{})
+		go func() {
+			_ = conn.Wait(ctx)
+			close(lost)
+		}()
+
+		select {
+		case <-ctx.Done():
+		case <-lost:
+			mlog.Warn("control connection of outbound " + s.oub.Tag + " lost")
+		case <-s.kick:
+			mlog.Warn("data endpoint of outbound " + s.oub.Tag + " lost")
+		}
+		conn.close(ctx)
+
+		if ctx.Err() != nil {
 			return
 		}
-	}(endpoint, ctx)
+	}
+}
 
-	dial, err := protocol.GetEndPointDial(ctx, endpoint, &models.NetAddr{Address: oub.Address, Port: oub.Port})
-	if err != nil {
-		mu.Lock()
-		*errs = append(*errs, err)
-		mu.Unlock()
+// backoff spaces out registration attempts. Each wait is drawn from
+// [d/2, 3d/2), then d doubles up to maxBackoff.
+type backoff struct {
+	d time.Duration
+}
+
+func (b *backoff) next() time.Duration {
+	if b.d == 0 {
+		b.d = minBackoff
+	}
+	wait := b.d/2 + rand.N(b.d)
+	b.d = min(b.d*2, maxBackoff)
+	return wait
+}
+
+func (b *backoff) reset() {
+	b.d = minBackoff
+}
+
+// swap installs the newly negotiated node port and drops the pooled
+// connection to the previous node, so new streams dial the new one. The node
+// is pinned like the endpoint it registered with.
+func (s *session) swap(nodePort uint16) {
+	protocol.SetPins(&models.NetAddr{Address: s.oub.Address, Port: nodePort}, s.pins)
+	old, ok := internal.SwapOsi(s.oub.Tag, internal.OutSeverInfo{
+		Tag:      s.oub.Tag,
+		Address:  s.oub.Address,
+		NodePort: nodePort,
+		User:     s.oub.User,
+		Token:    s.oub.Token,
+	})
+	if !ok {
+		mlog.Info(fmt.Sprintf("outbound %s registered on node port %d", s.oub.Tag, nodePort))
 		return
 	}
-	defer func(dial *quic.Conn) {
-		err := dial.Close()
-		if err != nil {
-			return
-		}
-	}(dial)
 
+	protocol.RemoveConn(old.NodeAddr())
+	if old.NodePort != nodePort {
+		protocol.SetPins(old.NodeAddr(), nil)
+	}
+	mlog.Warn(fmt.Sprintf("outbound %s re-registered on node port %d", s.oub.Tag, nodePort))
+}
+
+type controlConn struct {
+	endpoint *quic.Endpoint
+	*quic.Conn
+}
+
+func (c *controlConn) close(ctx context.Context) {
+	_ = c.Conn.Close()
+	_ = c.endpoint.Close(ctx)
+}
+
+// register sends the outbound tag and requested node port to the endpoint
+// and returns the still open control connection and the node port the
+// endpoint opened for this outbound.
+func (s *session) register(ctx context.Context) (*controlConn, uint16, error) {
+	start := time.Now()
+	endpoint, err := protocol.GetEndpoint(&models.NetAddr{Port: net.GetFreePort()})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dial, err := protocol.GetEndPointDial(ctx, endpoint, registerAddr(s.oub))
+	if err != nil {
+		_ = endpoint.Close(ctx)
+		return nil, 0, err
+	}
+	conn := &controlConn{endpoint: endpoint, Conn: dial}
+
+	nodePort, err := s.handshake(ctx, dial)
+	if err != nil {
+		conn.close(ctx)
+		return nil, 0, err
+	}
+	metrics.Registration.Observe(time.Since(start).Seconds())
+
+	return conn, nodePort, nil
+}
+
+func (s *session) handshake(ctx context.Context, dial *quic.Conn) (uint16, error) {
 	stream, err := dial.NewStream(ctx)
 	if err != nil {
-		mu.Lock()
-		*errs = append(*errs, err)
-		mu.Unlock()
-		return
+		return 0, err
 	}
 	defer func(stream *quic.Stream) {
 		err := stream.Close()
@@ -87,54 +323,45 @@ func initial(ctx context.Context, wg *sync.WaitGroup, mu *sync.Mutex, errs *[]er
 	}(stream)
 
 	msg := internal.Message{
-		Tag:      oub.Tag,
-		NodePort: oub.NodePort,
+		Tag:      s.oub.Tag,
+		NodePort: s.oub.NodePort,
+		Proof:    auth.Sign(s.oub.User, s.oub.Token),
 	}
 
 	m, err := json.Marshal(&msg)
 	if err != nil {
-		mu.Lock()
-		*errs = append(*errs, err)
-		mu.Unlock()
-		return
+		return 0, err
 	}
 
 	_, err = stream.Write(packet.EnPacket(m))
 	if err != nil {
-		mu.Lock()
-		*errs = append(*errs, err)
-		mu.Unlock()
-		return
+		return 0, err
 	}
 	stream.Flush()
 
 	dePacket, err := packet.DePacket(stream)
 	if err != nil {
-		mu.Lock()
-		*errs = append(*errs, err)
-		mu.Unlock()
-		return
+		return 0, err
 	}
 
 	var newMsg internal.Message
 	err = json.Unmarshal(dePacket, &newMsg)
 	if err != nil {
-		mu.Lock()
-		*errs = append(*errs, err)
-		mu.Unlock()
-		return
+		return 0, err
 	}
 
-	internal.SetOsi(oub.Tag, internal.OutSeverInfo{
-		Tag:      oub.Tag,
-		Address:  oub.Address,
-		NodePort: newMsg.NodePort,
-	})
+	return newMsg.NodePort, nil
+}
+
+// registerAddr returns the address outbound registers with.
+func registerAddr(outbound *models.Outbound) *models.NetAddr {
+	return &models.NetAddr{Address: outbound.Address, Port: outbound.Port}
 }
 
 func outboundServerCreator(ctx context.Context, v any) (any, error) {
 	outbounds := v.([]*models.Outbound)
-	return &outboundServer{Ctx: ctx, Outbounds: outbounds}, nil
+	ctx, cancel := context.WithCancel(ctx)
+	return &outboundServer{Ctx: ctx, Cancel: cancel, Outbounds: outbounds}, nil
 }
 
 func init() {
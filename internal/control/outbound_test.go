@@ -0,0 +1,30 @@
+package control
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	var b backoff
+	steps := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second,
+		16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	for _, d := range steps {
+		// The wait is random: sample it from copies at the same step.
+		for i := 0; i < 20; i++ {
+			c := b
+			if wait := c.next(); wait < d/2 || wait >= d+d/2 {
+				t.Fatalf("wait = %s, want within [%s, %s)", wait, d/2, d+d/2)
+			}
+		}
+		b.next()
+	}
+	if b.d != maxBackoff {
+		t.Errorf("backoff = %s, want capped at %s", b.d, maxBackoff)
+	}
+
+	b.reset()
+	if wait := b.next(); wait >= minBackoff+minBackoff/2 {
+		t.Errorf("wait after reset = %s, want below %s", wait, minBackoff+minBackoff/2)
+	}
+}
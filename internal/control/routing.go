@@ -14,14 +14,35 @@ type routeServer struct {
 }
 
 func (r *routeServer) Run() error {
-	router.Run(r.Routing.Rules)
-	return nil
+	return router.Run(r.Routing)
 }
 
 func (r *routeServer) Close() error {
+	return router.Close()
+}
+
+// Reload swaps in the new rules as a whole. Connections already routed keep
+// their outbound.
+func (r *routeServer) Reload(v any) error {
+	routing, _ := v.(*models.Routing)
+	if routing == nil {
+		routing = &models.Routing{}
+	}
+	if err := router.Run(routing); err != nil {
+		return err
+	}
+	r.Routing = routing
 	return nil
 }
 
+func (r *routeServer) Check(v any) error {
+	routing, _ := v.(*models.Routing)
+	if routing == nil {
+		routing = &models.Routing{}
+	}
+	return router.Check(routing)
+}
+
 func routeServerCreator(ctx context.Context, v any) (any, error) {
 	routing := v.(*models.Routing)
 	return &routeServer{Ctx: ctx, Routing: routing}, nil
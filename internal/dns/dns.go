@@ -0,0 +1,399 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"math"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/models"
+	"myproxy/pkg/util/domain"
+	net2 "myproxy/pkg/util/net"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultTimeout = 5 * time.Second
+	// headerLen is the size of a DNS message header.
+	headerLen = 12
+)
+
+// ErrNoServers is returned by Exchange when no servers are configured.
+var ErrNoServers = errors.New("no dns servers")
+
+var (
+	table   *resolver
+	tableMu sync.RWMutex
+)
+
+type resolver struct {
+	servers []*server
+	rules   []*rule
+	final   *server
+}
+
+type server struct {
+	tag      string
+	upstream upstream
+	timeout  time.Duration
+}
+
+type rule struct {
+	domain *domain.Matcher
+	server *server
+}
+
+// Run installs the servers and rules of c as the resolver of LookupIP in
+// pkg/util/net, replacing the previous ones, sizes its cache and sets up fake
+// addresses. Without servers names are resolved by the system resolver.
+func Run(c *models.DNS) error {
+	r, err := build(c)
+	if err != nil {
+		return err
+	}
+	var fp *fakePool
+	if c != nil && c.FakeIP != nil {
+		if fp, err = newFakePool(c.FakeIP); err != nil {
+			return err
+		}
+	}
+
+	if c != nil {
+		net2.SetCache(c.Cache)
+	} else {
+		net2.SetCache(nil)
+	}
+	setFake(fp)
+
+	tableMu.Lock()
+	old := table
+	table = r
+	tableMu.Unlock()
+
+	if r == nil {
+		net2.SetResolver(nil)
+	} else {
+		names := make([]string, 0, len(r.servers))
+		for _, s := range r.servers {
+			names = append(names, s.tag)
+		}
+		mlog.Info("dns servers " + strings.Join(names, ", "))
+		net2.SetResolver(Lookup)
+	}
+
+	if old != nil {
+		old.close()
+	}
+	return nil
+}
+
+// Check compiles the servers and rules of c without installing them.
+func Check(c *models.DNS) error {
+	if _, err := build(c); err != nil {
+		return err
+	}
+	if c != nil && c.FakeIP != nil {
+		if _, err := newFakePool(c.FakeIP); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close drops the configured servers and goes back to the system resolver.
+func Close() error {
+	return Run(nil)
+}
+
+func build(c *models.DNS) (*resolver, error) {
+	if c != nil && c.Cache != nil {
+		cc := c.Cache
+		if cc.Size < 0 || cc.MinTTL < 0 || cc.MaxTTL < 0 || cc.NegativeTTL < 0 {
+			return nil, errors.New("dns.cache: negative limit")
+		}
+		if cc.MinTTL > 0 && cc.MaxTTL > 0 && cc.MinTTL > cc.MaxTTL {
+			return nil, errors.New("dns.cache: minTTL above maxTTL")
+		}
+	}
+	if c == nil || len(c.Servers) == 0 && len(c.Rules) == 0 && c.Final == "" {
+		return nil, nil
+	}
+
+	r := &resolver{}
+	tags := make(map[string]*server, len(c.Servers))
+	for i, sc := range c.Servers {
+		if sc.Tag == "" {
+			return nil, fmt.Errorf("dns.servers[%d]: missing tag", i)
+		}
+		if _, ok := tags[sc.Tag]; ok {
+			return nil, fmt.Errorf("dns.servers[%d]: duplicate tag %s", i, sc.Tag)
+		}
+		u, err := newUpstream(sc)
+		if err != nil {
+			return nil, fmt.Errorf("dns.servers[%d].address: %w", i, err)
+		}
+		s := &server{tag: sc.Tag, upstream: u, timeout: sc.Timeout * time.Second}
+		if s.timeout <= 0 {
+			s.timeout = defaultTimeout
+		}
+		tags[sc.Tag] = s
+		r.servers = append(r.servers, s)
+	}
+
+	for i, rc := range c.Rules {
+		s, ok := tags[rc.Server]
+		if !ok {
+			return nil, fmt.Errorf("dns.rules[%d].server: unknown server %q", i, rc.Server)
+		}
+		m, err := domain.New(rc.Domain)
+		if err != nil {
+			return nil, fmt.Errorf("dns.rules[%d].domain: %w", i, err)
+		}
+		if m.Empty() {
+			return nil, fmt.Errorf("dns.rules[%d].domain: required", i)
+		}
+		r.rules = append(r.rules, &rule{domain: m, server: s})
+	}
+
+	if c.Final != "" {
+		s, ok := tags[c.Final]
+		if !ok {
+			return nil, fmt.Errorf("dns.final: unknown server %q", c.Final)
+		}
+		r.final = s
+	} else if len(r.servers) > 0 {
+		r.final = r.servers[0]
+	}
+	return r, nil
+}
+
+func (r *resolver) pick(host string) *server {
+	for _, rule := range r.rules {
+		if rule.domain.Match(host) {
+			return rule.server
+		}
+	}
+	return r.final
+}
+
+func (r *resolver) close() {
+	for _, s := range r.servers {
+		if err := s.upstream.close(); err != nil {
+			mlog.Error("dns server " + s.tag + ": " + err.Error())
+		}
+	}
+}
+
+// Lookup resolves host with the server its rules select, IPv4 addresses
+// first, and returns the smallest TTL of the records. It is negative when
+// the system resolver answered.
+func Lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, -1, nil
+	}
+
+	tableMu.RLock()
+	r := table
+	tableMu.RUnlock()
+
+	if r == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		return ips, -1, err
+	}
+	return r.pick(host).lookup(ctx, host)
+}
+
+// Exchange forwards the query msg about host to the server the rules select
+// and returns the response, which carries the ID of msg. It fails with
+// ErrNoServers when names are resolved by the system resolver.
+func Exchange(ctx context.Context, host string, msg []byte) ([]byte, error) {
+	if len(msg) < headerLen {
+		return nil, errors.New("short query")
+	}
+
+	tableMu.RLock()
+	r := table
+	tableMu.RUnlock()
+
+	if r == nil {
+		return nil, ErrNoServers
+	}
+	s := r.pick(host)
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	q := bytes.Clone(msg)
+	binary.BigEndian.PutUint16(q, 0)
+	resp, err := s.upstream.exchange(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < headerLen {
+		return nil, errors.New("short response")
+	}
+	copy(resp, msg[:2])
+	return resp, nil
+}
+
+// lookup queries the A and AAAA records of host at once. It fails only when
+// both queries do.
+func (s *server) lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	types := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	ips := make([][]net.IP, len(types))
+	ttls := make([]time.Duration, len(types))
+	errs := make([]error, len(types))
+
+	var wg sync.WaitGroup
+	for i, t := range types {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ips[i], ttls[i], errs[i] = s.query(ctx, host, t)
+		}()
+	}
+	wg.Wait()
+
+	var all []net.IP
+	ttl := time.Duration(-1)
+	for i := range types {
+		if len(ips[i]) == 0 {
+			continue
+		}
+		all = append(all, ips[i]...)
+		if ttl < 0 || ttls[i] < ttl {
+			ttl = ttls[i]
+		}
+	}
+	if len(all) > 0 {
+		return all, ttl, nil
+	}
+
+	for _, err := range errs {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) {
+			return nil, 0, err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: s.tag}
+		}
+	}
+	return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: s.tag, IsNotFound: true}
+}
+
+func (s *server) query(ctx context.Context, host string, t dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	msg, err := newQuery(host, t)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := s.upstream.exchange(ctx, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseAnswer(resp, host, s.tag)
+}
+
+// newQuery builds a recursive query with ID 0, as DNS over QUIC and HTTPS
+// require. Upstreams that need a random ID set it themselves.
+func newQuery(host string, t dnsmessage.Type) ([]byte, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{RecursionDesired: true})
+	b.EnableCompression()
+	if err = b.StartQuestions(); err != nil {
+		return nil, err
+	}
+	if err = b.Question(dnsmessage.Question{Name: name, Type: t, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, err
+	}
+
+	// Advertise a payload size that avoids IP fragmentation.
+	var opt dnsmessage.ResourceHeader
+	if err = opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, err
+	}
+	if err = b.StartAdditionals(); err != nil {
+		return nil, err
+	}
+	if err = b.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, err
+	}
+	return b.Finish()
+}
+
+// parseAnswer returns the A and AAAA records of resp and the smallest TTL of
+// the records in the answer. A name that does not exist fails with a not
+// found DNSError, like the system resolver does.
+func parseAnswer(resp []byte, host, tag string) ([]net.IP, time.Duration, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(resp)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !h.Response {
+		return nil, 0, errors.New("not a response")
+	}
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: host, Server: tag, IsNotFound: true}
+	default:
+		return nil, 0, fmt.Errorf("server answered %s", h.RCode)
+	}
+
+	if err = p.SkipAllQuestions(); err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	var ttl uint32 = math.MaxUint32
+	for {
+		ah, err := p.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// CNAME records count too: the chain expires with its first link.
+		if ah.Class == dnsmessage.ClassINET {
+			ttl = min(ttl, ah.TTL)
+		}
+
+		switch {
+		case ah.Class != dnsmessage.ClassINET:
+			err = p.SkipAnswer()
+		case ah.Type == dnsmessage.TypeA:
+			var a dnsmessage.AResource
+			if a, err = p.AResource(); err == nil {
+				ips = append(ips, net.IP(a.A[:]))
+			}
+		case ah.Type == dnsmessage.TypeAAAA:
+			var aaaa dnsmessage.AAAAResource
+			if aaaa, err = p.AAAAResource(); err == nil {
+				ips = append(ips, net.IP(aaaa.AAAA[:]))
+			}
+		default:
+			err = p.SkipAnswer()
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
@@ -0,0 +1,218 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"golang.org/x/net/dns/dnsmessage"
+	"myproxy/pkg/models"
+	"net"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestNewUpstream(t *testing.T) {
+	tests := []struct {
+		address string
+		want    upstream
+		wantErr bool
+	}{
+		{"192.0.2.1", &udpUpstream{addr: "192.0.2.1:53", tcp: &streamUpstream{addr: "192.0.2.1:53"}}, false},
+		{"udp://192.0.2.1:5353", &udpUpstream{addr: "192.0.2.1:5353", tcp: &streamUpstream{addr: "192.0.2.1:5353"}}, false},
+		{"tcp://[2001:db8::1]", &streamUpstream{addr: "[2001:db8::1]:53"}, false},
+		{"tls://dns.example", &streamUpstream{addr: "dns.example:853", tls: tlsConfig(&models.DNSServer{}, "dns.example")}, false},
+		{"ftp://192.0.2.1", nil, true},
+		{"tcp://:53", nil, true},
+		{"https:///dns-query", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			got, err := newUpstream(&models.DNSServer{Address: tt.address})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newUpstream() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newUpstream() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	u, err := newUpstream(&models.DNSServer{Address: "quic://192.0.2.1", ServerName: "dns.example"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.(*quicUpstream)
+	if q.addr != "192.0.2.1:853" || q.tls.ServerName != "dns.example" || !slices.Equal(q.tls.NextProtos, []string{"doq"}) {
+		t.Errorf("newUpstream() = %+v", q)
+	}
+}
+
+func TestPick(t *testing.T) {
+	servers := []*models.DNSServer{{Tag: "local", Address: "192.0.2.1"}, {Tag: "remote", Address: "192.0.2.2"}}
+	rules := []*models.DNSRule{
+		{Domain: []string{"domain:corp.example"}, Server: "local"},
+		{Domain: []string{"full:remote.corp.example"}, Server: "remote"},
+	}
+	tests := []struct {
+		name  string
+		final string
+		host  string
+		want  string
+	}{
+		{"rule", "remote", "host.corp.example", "local"},
+		{"first rule wins", "remote", "remote.corp.example", "local"},
+		{"final", "remote", "example.org", "remote"},
+		{"first server by default", "", "example.org", "local"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := build(&models.DNS{Servers: servers, Rules: rules, Final: tt.final})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.pick(tt.host).tag; got != tt.want {
+				t.Errorf("pick(%s) = %s, want %s", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuild(t *testing.T) {
+	server := &models.DNSServer{Tag: "a", Address: "192.0.2.1"}
+	tests := []struct {
+		name    string
+		c       *models.DNS
+		wantNil bool
+		wantErr bool
+	}{
+		{"none", nil, true, false},
+		{"cache only", &models.DNS{Cache: &models.DNSCache{Size: 10}}, true, false},
+		{"server", &models.DNS{Servers: []*models.DNSServer{server}}, false, false},
+		{"missing tag", &models.DNS{Servers: []*models.DNSServer{{Address: "192.0.2.1"}}}, false, true},
+		{"duplicate tag", &models.DNS{Servers: []*models.DNSServer{server, server}}, false, true},
+		{"bad address", &models.DNS{Servers: []*models.DNSServer{{Tag: "a", Address: "ftp://x"}}}, false, true},
+		{"unknown rule server", &models.DNS{Servers: []*models.DNSServer{server}, Rules: []*models.DNSRule{{Domain: []string{"example.com"}, Server: "b"}}}, false, true},
+		{"empty rule", &models.DNS{Servers: []*models.DNSServer{server}, Rules: []*models.DNSRule{{Server: "a"}}}, false, true},
+		{"unknown final", &models.DNS{Servers: []*models.DNSServer{server}, Final: "b"}, false, true},
+		{"negative cache", &models.DNS{Cache: &models.DNSCache{Size: -1}}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := build(tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("build() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && (r == nil) != tt.wantNil {
+				t.Errorf("build() = %v, want nil %v", r, tt.wantNil)
+			}
+		})
+	}
+}
+
+// fakeUpstream answers A and AAAA queries with addrs and a TTL of 60s, and
+// fails the types in fail.
+type fakeUpstream struct {
+	addrs []net.IP
+	fail  []dnsmessage.Type
+}
+
+func (f *fakeUpstream) exchange(_ context.Context, msg []byte) ([]byte, error) {
+	var p dnsmessage.Parser
+	h, err := p.Start(msg)
+	if err != nil {
+		return nil, err
+	}
+	if h.ID != 0 {
+		return nil, errors.New("query ID not cleared")
+	}
+	q, err := p.Question()
+	if err != nil {
+		return nil, err
+	}
+	if slices.Contains(f.fail, q.Type) {
+		return nil, errors.New("unreachable")
+	}
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{Response: true})
+	_ = b.StartQuestions()
+	_ = b.Question(q)
+	_ = b.StartAnswers()
+	rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 60}
+	for _, ip := range f.addrs {
+		if ip4 := ip.To4(); ip4 != nil && q.Type == dnsmessage.TypeA {
+			_ = b.AResource(rh, dnsmessage.AResource{A: [4]byte(ip4)})
+		} else if ip4 == nil && q.Type == dnsmessage.TypeAAAA {
+			_ = b.AAAAResource(rh, dnsmessage.AAAAResource{AAAA: [16]byte(ip)})
+		}
+	}
+	return b.Finish()
+}
+
+func (f *fakeUpstream) close() error { return nil }
+
+func TestLookup(t *testing.T) {
+	addrs := []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}
+	tests := []struct {
+		name    string
+		up      *fakeUpstream
+		want    []net.IP
+		wantErr bool
+	}{
+		{"both", &fakeUpstream{addrs: addrs}, addrs, false},
+		{"one family fails", &fakeUpstream{addrs: addrs, fail: []dnsmessage.Type{dnsmessage.TypeAAAA}}, addrs[:1], false},
+		{"both fail", &fakeUpstream{addrs: addrs, fail: []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}}, nil, true},
+		{"no address", &fakeUpstream{}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &server{tag: "fake", upstream: tt.up, timeout: time.Second}
+			got, ttl, err := s.lookup(context.Background(), "example.com")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("lookup() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				var dnsErr *net.DNSError
+				if !errors.As(err, &dnsErr) {
+					t.Errorf("lookup() = %v, want a DNSError", err)
+				}
+				return
+			}
+			if !slices.EqualFunc(got, tt.want, net.IP.Equal) || ttl != time.Minute {
+				t.Errorf("lookup() = %v, %s, want %v, 1m0s", got, ttl, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchange(t *testing.T) {
+	t.Cleanup(func() { table = nil })
+
+	msg, err := newQuery("example.com", dnsmessage.TypeA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.BigEndian.PutUint16(msg, 0x1234)
+
+	table = nil
+	if _, err = Exchange(context.Background(), "example.com", msg); !errors.Is(err, ErrNoServers) {
+		t.Errorf("Exchange() = %v without servers, want %v", err, ErrNoServers)
+	}
+
+	s := &server{tag: "fake", upstream: &fakeUpstream{addrs: []net.IP{net.ParseIP("192.0.2.1")}}, timeout: time.Second}
+	table = &resolver{servers: []*server{s}, final: s}
+	resp, err := Exchange(context.Background(), "example.com", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := binary.BigEndian.Uint16(resp); id != 0x1234 {
+		t.Errorf("response ID = %#x, want the query's", id)
+	}
+	if binary.BigEndian.Uint16(msg) != 0x1234 {
+		t.Error("Exchange() modified the query")
+	}
+	if _, err = Exchange(context.Background(), "example.com", msg[:4]); err == nil {
+		t.Error("Exchange() accepted a short query")
+	}
+}
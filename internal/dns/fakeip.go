@@ -0,0 +1,152 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"myproxy/pkg/models"
+	"myproxy/pkg/util/domain"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+const defaultFakeRange = "198.18.0.0/15"
+
+var (
+	fake   *fakePool
+	fakeMu sync.RWMutex
+)
+
+// fakePool hands out the addresses of prefix to the names domain matches.
+type fakePool struct {
+	prefix netip.Prefix
+	domain *domain.Matcher
+	*fakeTable
+}
+
+// fakeTable maps names to addresses of a range, one each, and back.
+// Addresses are handed out in turn, so once the range is used up the oldest
+// mapping is the one replaced.
+type fakeTable struct {
+	mu     sync.Mutex
+	base   uint32
+	size   uint32
+	next   uint32
+	byName map[string]netip.Addr
+	byAddr map[netip.Addr]string
+}
+
+func newFakePool(c *models.FakeIP) (*fakePool, error) {
+	r := c.Range
+	if r == "" {
+		r = defaultFakeRange
+	}
+	prefix, err := netip.ParsePrefix(r)
+	if err != nil {
+		return nil, fmt.Errorf("dns.fakeIP.range: %w", err)
+	}
+	if !prefix.Addr().Is4() {
+		return nil, errors.New("dns.fakeIP.range: not an IPv4 range")
+	}
+	if prefix.Bits() < 8 {
+		return nil, errors.New("dns.fakeIP.range: larger than a /8")
+	}
+	if prefix.Bits() > 30 {
+		return nil, errors.New("dns.fakeIP.range: fewer than 2 addresses")
+	}
+	m, err := domain.New(c.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("dns.fakeIP.domain: %w", err)
+	}
+
+	prefix = prefix.Masked()
+	a := prefix.Addr().As4()
+	t := &fakeTable{
+		base: binary.BigEndian.Uint32(a[:]),
+		// The first and last addresses of the range are not handed out.
+		size:   1<<(32-prefix.Bits()) - 2,
+		byName: make(map[string]netip.Addr),
+		byAddr: make(map[netip.Addr]string),
+	}
+	return &fakePool{prefix: prefix, domain: m, fakeTable: t}, nil
+}
+
+// setFake installs p, or disables fake addresses when p is nil. A pool over
+// the same range keeps the mappings, which clients may still be using.
+func setFake(p *fakePool) {
+	fakeMu.Lock()
+	defer fakeMu.Unlock()
+
+	if p != nil && fake != nil && fake.prefix == p.prefix {
+		p.fakeTable = fake.fakeTable
+	}
+	fake = p
+}
+
+func currentFake() *fakePool {
+	fakeMu.RLock()
+	defer fakeMu.RUnlock()
+	return fake
+}
+
+// FakeEnabled reports whether host is answered with a fake address.
+func FakeEnabled(host string) bool {
+	return currentFake().covers(host)
+}
+
+// FakeIP returns the fake address of host, handing out a new one if it has
+// none. It returns nil when fake addresses are disabled for host.
+func FakeIP(host string) net.IP {
+	p := currentFake()
+	if !p.covers(host) {
+		return nil
+	}
+	return p.get(domain.Normalize(host))
+}
+
+// FakeDomain returns the name ip was handed out to, if it is a fake address.
+func FakeDomain(ip net.IP) (string, bool) {
+	p := currentFake()
+	if p == nil {
+		return "", false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", false
+	}
+	addr = addr.Unmap()
+	if !p.prefix.Contains(addr) {
+		return "", false
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	host, ok := p.byAddr[addr]
+	return host, ok
+}
+
+func (p *fakePool) covers(host string) bool {
+	return p != nil && (p.domain.Empty() || p.domain.Match(host))
+}
+
+func (t *fakeTable) get(host string) net.IP {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if addr, ok := t.byName[host]; ok {
+		return addr.AsSlice()
+	}
+
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], t.base+1+t.next)
+	addr := netip.AddrFrom4(b)
+	t.next = (t.next + 1) % t.size
+
+	if old, ok := t.byAddr[addr]; ok {
+		delete(t.byName, old)
+	}
+	t.byName[host] = addr
+	t.byAddr[addr] = host
+	return addr.AsSlice()
+}
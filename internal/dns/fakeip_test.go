@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"myproxy/pkg/models"
+	"net"
+	"testing"
+)
+
+// keepFake restores the installed pool, mappings included, once the test
+// is done.
+func keepFake(t *testing.T) {
+	prev := currentFake()
+	t.Cleanup(func() {
+		fakeMu.Lock()
+		fake = prev
+		fakeMu.Unlock()
+	})
+}
+
+// useFake installs a pool built from c for the duration of the test.
+func useFake(t *testing.T, c *models.FakeIP) {
+	t.Helper()
+	p, err := newFakePool(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keepFake(t)
+	setFake(p)
+}
+
+func TestNewFakePool(t *testing.T) {
+	tests := []struct {
+		name       string
+		c          *models.FakeIP
+		wantPrefix string
+		wantSize   uint32
+		wantErr    bool
+	}{
+		{"default", &models.FakeIP{}, "198.18.0.0/15", 1<<17 - 2, false},
+		{"masked", &models.FakeIP{Range: "10.0.0.5/30"}, "10.0.0.4/30", 2, false},
+		{"largest", &models.FakeIP{Range: "10.0.0.0/8"}, "10.0.0.0/8", 1<<24 - 2, false},
+		{"ipv6", &models.FakeIP{Range: "fc00::/64"}, "", 0, true},
+		{"too large", &models.FakeIP{Range: "10.0.0.0/7"}, "", 0, true},
+		{"too small", &models.FakeIP{Range: "10.0.0.0/31"}, "", 0, true},
+		{"not a range", &models.FakeIP{Range: "10.0.0.1"}, "", 0, true},
+		{"bad domain", &models.FakeIP{Domain: []string{"regexp:("}}, "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newFakePool(tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newFakePool() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if p.prefix.String() != tt.wantPrefix || p.size != tt.wantSize {
+				t.Errorf("newFakePool() = %s with %d addresses, want %s with %d", p.prefix, p.size, tt.wantPrefix, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestFakeTableRotation(t *testing.T) {
+	p, err := newFakePool(&models.FakeIP{Range: "10.0.0.0/30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"a.test", "10.0.0.1"},
+		{"b.test", "10.0.0.2"},
+		{"a.test", "10.0.0.1"},
+		// The range is used up: the oldest mapping is replaced.
+		{"c.test", "10.0.0.1"},
+		{"b.test", "10.0.0.2"},
+		{"a.test", "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		if got := p.get(tt.host); got.String() != tt.want {
+			t.Errorf("get(%s) = %s, want %s", tt.host, got, tt.want)
+		}
+	}
+	if _, ok := p.byName["b.test"]; ok {
+		t.Error("b.test kept the address handed out again")
+	}
+}
+
+func TestFakeIP(t *testing.T) {
+	useFake(t, &models.FakeIP{Range: "198.18.0.0/24", Domain: []string{"fake.test"}})
+
+	ip := FakeIP("WWW.Fake.Test.")
+	if ip == nil {
+		t.Fatal("FakeIP() = nil for a covered name")
+	}
+	if again := FakeIP("www.fake.test"); !again.Equal(ip) {
+		t.Errorf("FakeIP() = %s, then %s", ip, again)
+	}
+	if got := FakeIP("real.test"); got != nil {
+		t.Errorf("FakeIP() = %s for a name not covered", got)
+	}
+	if !FakeEnabled("fake.test") || FakeEnabled("real.test") {
+		t.Error("FakeEnabled() does not follow the domain list")
+	}
+
+	tests := []struct {
+		ip     net.IP
+		want   string
+		wantOK bool
+	}{
+		{ip, "www.fake.test", true},
+		{ip.To16(), "www.fake.test", true},
+		{net.ParseIP("198.18.0.200"), "", false},
+		{net.ParseIP("192.0.2.1"), "", false},
+		{net.ParseIP("2001:db8::1"), "", false},
+		{nil, "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := FakeDomain(tt.ip); got != tt.want || ok != tt.wantOK {
+			t.Errorf("FakeDomain(%s) = %q, %v, want %q, %v", tt.ip, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestFakeDisabled(t *testing.T) {
+	keepFake(t)
+	setFake(nil)
+
+	if FakeEnabled("a.test") || FakeIP("a.test") != nil {
+		t.Error("fake addresses handed out while disabled")
+	}
+	if _, ok := FakeDomain(net.ParseIP("198.18.0.1")); ok {
+		t.Error("FakeDomain() found a name while disabled")
+	}
+}
+
+func TestSetFakeKeepsTable(t *testing.T) {
+	useFake(t, &models.FakeIP{Range: "198.18.0.0/24"})
+	ip := FakeIP("a.test")
+
+	same, err := newFakePool(&models.FakeIP{Range: "198.18.0.0/24", Domain: []string{"a.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFake(same)
+	if host, ok := FakeDomain(ip); !ok || host != "a.test" {
+		t.Errorf("FakeDomain() = %q, %v after reloading the same range", host, ok)
+	}
+
+	other, err := newFakePool(&models.FakeIP{Range: "198.18.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFake(other)
+	if got := FakeIP("a.test"); got.Equal(ip) {
+		t.Errorf("FakeIP() = %s from the old range", got)
+	}
+}
@@ -0,0 +1,403 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/net/quic"
+	"io"
+	"math"
+	"math/rand/v2"
+	"myproxy/pkg/models"
+	"myproxy/pkg/protocol"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	schemeUDP   = "udp"
+	schemeTCP   = "tcp"
+	schemeTLS   = "tls"
+	schemeQUIC  = "quic"
+	schemeHTTPS = "https"
+
+	// maxIdleConns bounds the idle connections kept per TCP or TLS server.
+	maxIdleConns = 4
+	// flagTruncated is the TC bit in the third byte of a DNS header.
+	flagTruncated = 0x02
+	mimeMessage   = "application/dns-message"
+)
+
+var errMsgTooLong = errors.New("dns message longer than 65535 bytes")
+
+// upstream sends a DNS query to a server and returns its response.
+type upstream interface {
+	exchange(ctx context.Context, msg []byte) ([]byte, error)
+	close() error
+}
+
+func newUpstream(c *models.DNSServer) (upstream, error) {
+	scheme, addr, ok := strings.Cut(c.Address, "://")
+	if !ok {
+		scheme, addr = schemeUDP, c.Address
+	}
+
+	if scheme == schemeHTTPS {
+		u, err := url.Parse(c.Address)
+		if err != nil {
+			return nil, err
+		}
+		if u.Host == "" {
+			return nil, errors.New("missing host")
+		}
+		return newHTTPSUpstream(u.String(), tlsConfig(c, u.Hostname())), nil
+	}
+
+	port := "53"
+	switch scheme {
+	case schemeUDP, schemeTCP:
+	case schemeTLS, schemeQUIC:
+		port = "853"
+	default:
+		return nil, fmt.Errorf("unknown scheme %q", scheme)
+	}
+
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	} else {
+		port = p
+	}
+	if host == "" {
+		return nil, errors.New("missing host")
+	}
+	addr = net.JoinHostPort(host, port)
+
+	switch scheme {
+	case schemeTCP:
+		return &streamUpstream{addr: addr}, nil
+	case schemeTLS:
+		return &streamUpstream{addr: addr, tls: tlsConfig(c, host)}, nil
+	case schemeQUIC:
+		t := tlsConfig(c, host)
+		t.MinVersion = tls.VersionTLS13
+		t.NextProtos = []string{"doq"}
+		return &quicUpstream{addr: addr, tls: t}, nil
+	default:
+		return &udpUpstream{addr: addr, tcp: &streamUpstream{addr: addr}}, nil
+	}
+}
+
+func tlsConfig(c *models.DNSServer, host string) *tls.Config {
+	name := c.ServerName
+	if name == "" {
+		name = host
+	}
+	return &tls.Config{ServerName: name, MinVersion: tls.VersionTLS12}
+}
+
+// udpUpstream sends each query from its own socket and retries it over TCP
+// when the answer is truncated.
+type udpUpstream struct {
+	addr string
+	tcp  *streamUpstream
+}
+
+func (u *udpUpstream) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, schemeUDP, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	q := bytes.Clone(msg)
+	id := uint16(rand.Uint32())
+	binary.BigEndian.PutUint16(q, id)
+	if _, err = conn.Write(q); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Drop stray datagrams, such as late answers to a previous query.
+		if n < headerLen || binary.BigEndian.Uint16(buf) != id {
+			continue
+		}
+		if buf[2]&flagTruncated != 0 {
+			return u.tcp.exchange(ctx, msg)
+		}
+		return buf[:n], nil
+	}
+}
+
+func (u *udpUpstream) close() error {
+	return u.tcp.close()
+}
+
+// streamUpstream sends queries over TCP, or TLS when tls is set, with the
+// two byte length prefix of RFC 1035. Connections are reused one query at a
+// time.
+type streamUpstream struct {
+	addr string
+	tls  *tls.Config
+
+	mu   sync.Mutex
+	idle []net.Conn
+}
+
+func (u *streamUpstream) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	if conn := u.get(); conn != nil {
+		resp, err := roundTrip(ctx, conn, msg)
+		if err == nil {
+			u.put(conn)
+			return resp, nil
+		}
+		_ = conn.Close()
+		// The server may have closed the idle connection, retry on a new
+		// one unless the query is out of time.
+		if ctx.Err() != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := u.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := roundTrip(ctx, conn, msg)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	u.put(conn)
+	return resp, nil
+}
+
+func (u *streamUpstream) dial(ctx context.Context) (net.Conn, error) {
+	d := &net.Dialer{}
+	if u.tls == nil {
+		return d.DialContext(ctx, schemeTCP, u.addr)
+	}
+	td := tls.Dialer{NetDialer: d, Config: u.tls}
+	return td.DialContext(ctx, schemeTCP, u.addr)
+}
+
+func (u *streamUpstream) get() net.Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idle) == 0 {
+		return nil
+	}
+	conn := u.idle[len(u.idle)-1]
+	u.idle = u.idle[:len(u.idle)-1]
+	return conn
+}
+
+func (u *streamUpstream) put(conn net.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.idle) >= maxIdleConns {
+		_ = conn.Close()
+		return
+	}
+	u.idle = append(u.idle, conn)
+}
+
+func (u *streamUpstream) close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, conn := range u.idle {
+		_ = conn.Close()
+	}
+	u.idle = nil
+	return nil
+}
+
+func roundTrip(ctx context.Context, conn net.Conn, msg []byte) ([]byte, error) {
+	deadline, _ := ctx.Deadline()
+	_ = conn.SetDeadline(deadline)
+	if err := WriteMsg(conn, msg); err != nil {
+		return nil, err
+	}
+	return ReadMsg(conn)
+}
+
+// WriteMsg writes msg with the two byte length prefix DNS uses over TCP,
+// DNS over TLS and DNS over QUIC.
+func WriteMsg(w io.Writer, msg []byte) error {
+	if len(msg) > math.MaxUint16 {
+		return errMsgTooLong
+	}
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
+
+// ReadMsg reads a message written by WriteMsg.
+func ReadMsg(r io.Reader) ([]byte, error) {
+	var l [2]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(l[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// httpsUpstream posts queries to a DNS over HTTPS server as in RFC 8484.
+type httpsUpstream struct {
+	url       string
+	transport *http.Transport
+	client    *http.Client
+}
+
+func newHTTPSUpstream(u string, t *tls.Config) *httpsUpstream {
+	transport := &http.Transport{
+		TLSClientConfig:     t,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConnsPerHost: maxIdleConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &httpsUpstream{url: u, transport: transport, client: &http.Client{Transport: transport}}
+}
+
+func (u *httpsUpstream) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.url, bytes.NewReader(msg))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", mimeMessage)
+	req.Header.Set("Accept", mimeMessage)
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 65535))
+}
+
+func (u *httpsUpstream) close() error {
+	u.transport.CloseIdleConnections()
+	return nil
+}
+
+// quicUpstream sends each query on its own stream of a shared DNS over QUIC
+// connection, as in RFC 9250. The connection is dialed on first use and
+// again after it fails.
+type quicUpstream struct {
+	addr string
+	tls  *tls.Config
+
+	mu       sync.Mutex
+	endpoint *quic.Endpoint
+	conn     *quic.Conn
+}
+
+func (u *quicUpstream) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	conn, reused, err := u.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := quicRoundTrip(ctx, conn, msg)
+	if err != nil && reused && ctx.Err() == nil {
+		// The server may have closed the idle connection.
+		u.drop(conn)
+		if conn, _, err = u.get(ctx); err != nil {
+			return nil, err
+		}
+		resp, err = quicRoundTrip(ctx, conn, msg)
+	}
+	if err != nil {
+		u.drop(conn)
+	}
+	return resp, err
+}
+
+func (u *quicUpstream) get(ctx context.Context) (*quic.Conn, bool, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != nil {
+		return u.conn, true, nil
+	}
+	endpoint, conn, err := protocol.DialQUIC(ctx, u.addr, u.tls)
+	if err != nil {
+		return nil, false, err
+	}
+	u.endpoint, u.conn = endpoint, conn
+	return conn, false, nil
+}
+
+// drop closes conn unless it was already replaced.
+func (u *quicUpstream) drop(conn *quic.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != conn {
+		return
+	}
+	closeQUIC(u.endpoint, u.conn)
+	u.endpoint, u.conn = nil, nil
+}
+
+func (u *quicUpstream) close() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.conn != nil {
+		closeQUIC(u.endpoint, u.conn)
+		u.endpoint, u.conn = nil, nil
+	}
+	return nil
+}
+
+func closeQUIC(endpoint *quic.Endpoint, conn *quic.Conn) {
+	conn.Abort(nil)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = endpoint.Close(ctx)
+	}()
+}
+
+func quicRoundTrip(ctx context.Context, conn *quic.Conn, msg []byte) ([]byte, error) {
+	stream, err := conn.NewStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stream.CloseRead()
+	stream.SetReadContext(ctx)
+	stream.SetWriteContext(ctx)
+
+	if err = WriteMsg(stream, msg); err != nil {
+		return nil, err
+	}
+	// The end of the stream tells the server the query is complete.
+	stream.CloseWrite()
+	return ReadMsg(stream)
+}
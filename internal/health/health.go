@@ -0,0 +1,213 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"myproxy/internal"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/models"
+	"myproxy/pkg/shared"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval = 10 * time.Second
+	defaultTimeout  = 5 * time.Second
+	defaultRise     = 2
+	defaultFall     = 3
+	window          = 10
+)
+
+// Status is the health of one outbound as seen by its prober.
+type Status struct {
+	Tag         string        `json:"tag"`
+	Up          bool          `json:"up"`
+	RTT         time.Duration `json:"rtt"`
+	SuccessRate float64       `json:"successRate"`
+	LastCheck   time.Time     `json:"lastCheck"`
+	LastError   string        `json:"lastError,omitempty"`
+}
+
+var (
+	statuses   = make(map[string]Status)
+	statusesMu sync.RWMutex
+)
+
+// Get returns the health of the outbound tag. ok is false for outbounds that
+// are not probed.
+func Get(tag string) (Status, bool) {
+	statusesMu.RLock()
+	defer statusesMu.RUnlock()
+	s, ok := statuses[tag]
+	return s, ok
+}
+
+func Range(f func(s Status) bool) {
+	statusesMu.RLock()
+	defer statusesMu.RUnlock()
+	for _, s := range statuses {
+		if !f(s) {
+			return
+		}
+	}
+}
+
+func set(s Status) {
+	statusesMu.Lock()
+	statuses[s.Tag] = s
+	statusesMu.Unlock()
+}
+
+func Remove(tag string) {
+	statusesMu.Lock()
+	delete(statuses, tag)
+	statusesMu.Unlock()
+}
+
+// Prober periodically opens a ping stream to an outbound's node and marks the
+// outbound down after Fall consecutive failures and up again after Rise
+// consecutive successes.
+type Prober struct {
+	Tag      string
+	Interval time.Duration
+	Timeout  time.Duration
+	Rise     int
+	Fall     int
+	// OnDown is called when the outbound goes down and again after every
+	// further Fall failures while it stays down.
+	OnDown func()
+
+	results   [window]bool
+	count     int
+	successes int
+	failures  int
+	status    Status
+}
+
+func NewProber(oub *models.Outbound, onDown func()) *Prober {
+	p := &Prober{
+		Tag:      oub.Tag,
+		Interval: defaultInterval,
+		Timeout:  defaultTimeout,
+		Rise:     defaultRise,
+		Fall:     defaultFall,
+		OnDown:   onDown,
+		status:   Status{Tag: oub.Tag, Up: true},
+	}
+
+	if h := oub.Health; h != nil {
+		if h.Interval > 0 {
+			p.Interval = h.Interval * time.Second
+		}
+		if h.Timeout > 0 {
+			p.Timeout = h.Timeout * time.Second
+		}
+		if h.Rise > 0 {
+			p.Rise = h.Rise
+		}
+		if h.Fall > 0 {
+			p.Fall = h.Fall
+		}
+	}
+	return p
+}
+
+func (p *Prober) Run(ctx context.Context) {
+	set(p.status)
+	defer Remove(p.Tag)
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			rtt, err := p.probe(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			p.record(rtt, err)
+		}
+	}
+}
+
+func (p *Prober) probe(ctx context.Context) (time.Duration, error) {
+	info, ok := internal.GetOsi(p.Tag)
+	if !ok {
+		return 0, errors.New("outbound not registered")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	stream, err := internal.OpenStream(ctx, info, &models.InitialPacket{Protocol: shared.PING})
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+	stream.Stream.SetReadContext(ctx)
+
+	pong := make([]byte, len(shared.PONG))
+	if _, err = io.ReadFull(stream, pong); err != nil {
+		return 0, err
+	}
+	if string(pong) != shared.PONG {
+		return 0, errors.New("unexpected ping reply")
+	}
+	return time.Since(start), nil
+}
+
+func (p *Prober) record(rtt time.Duration, err error) {
+	p.results[p.count%window] = err == nil
+	p.count++
+
+	ok := 0
+	n := min(p.count, window)
+	for _, r := range p.results[:n] {
+		if r {
+			ok++
+		}
+	}
+
+	p.status.LastCheck = time.Now()
+	p.status.SuccessRate = float64(ok) / float64(n)
+
+	if err == nil {
+		p.successes++
+		p.failures = 0
+		p.status.RTT = rtt
+		p.status.LastError = ""
+		if !p.status.Up && p.successes >= p.Rise {
+			p.status.Up = true
+			mlog.Warn(fmt.Sprintf("outbound %s is up, rtt %s", p.Tag, rtt))
+		}
+		set(p.status)
+		return
+	}
+
+	p.failures++
+	p.successes = 0
+	p.status.LastError = err.Error()
+	mlog.Debug("health check of outbound "+p.Tag+" failed", zap.Error(err))
+
+	down := false
+	if p.status.Up && p.failures >= p.Fall {
+		p.status.Up = false
+		down = true
+		mlog.Warn(fmt.Sprintf("outbound %s is down after %d failed checks", p.Tag, p.failures), zap.Error(err))
+	} else if !p.status.Up && p.failures%p.Fall == 0 {
+		down = true
+	}
+	set(p.status)
+
+	if down && p.OnDown != nil {
+		p.OnDown()
+	}
+}
@@ -0,0 +1,101 @@
+package health
+
+import (
+	"errors"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/models"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if err := mlog.Init(&models.Log{Output: mlog.OutputStderr, ConsoleLevel: "fatal"}); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestNewProber(t *testing.T) {
+	p := NewProber(&models.Outbound{Tag: "a"}, nil)
+	if p.Interval != defaultInterval || p.Timeout != defaultTimeout || p.Rise != defaultRise || p.Fall != defaultFall {
+		t.Errorf("defaults = %+v", p)
+	}
+
+	p = NewProber(&models.Outbound{Tag: "a", Health: &models.HealthCheck{Interval: 30, Timeout: 2, Rise: 1, Fall: 5}}, nil)
+	if p.Interval != 30*time.Second || p.Timeout != 2*time.Second || p.Rise != 1 || p.Fall != 5 {
+		t.Errorf("configured = %+v", p)
+	}
+}
+
+func TestProberThresholds(t *testing.T) {
+	errProbe := errors.New("timeout")
+	tests := []struct {
+		name    string
+		rise    int
+		fall    int
+		results string
+		wantUp  string
+		// wantDown is the number of OnDown calls after each result.
+		wantDown string
+	}{
+		{"stays up", 2, 3, "++-+--+", "uuuuuuu", "0000000"},
+		{"goes down", 2, 3, "---", "uud", "001"},
+		{"comes back", 2, 3, "---+-++", "uuddddu", "0011111"},
+		{"called while down", 2, 2, "------", "uddddd", "011223"},
+		{"rise of one", 1, 1, "-+-+", "dudu", "1122"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			down := 0
+			p := NewProber(&models.Outbound{Tag: "t-" + tt.name, Health: &models.HealthCheck{Rise: tt.rise, Fall: tt.fall}},
+				func() { down++ })
+			t.Cleanup(func() { Remove(p.Tag) })
+
+			for i, r := range tt.results {
+				var err error
+				if r == '-' {
+					err = errProbe
+				}
+				p.record(time.Millisecond, err)
+
+				s, ok := Get(p.Tag)
+				if !ok {
+					t.Fatal("status not published")
+				}
+				if up := tt.wantUp[i] == 'u'; s.Up != up {
+					t.Errorf("after %s: up = %v, want %v", tt.results[:i+1], s.Up, up)
+				}
+				if want := int(tt.wantDown[i] - '0'); down != want {
+					t.Errorf("after %s: OnDown called %d times, want %d", tt.results[:i+1], down, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProberStatus(t *testing.T) {
+	p := NewProber(&models.Outbound{Tag: "status"}, nil)
+	t.Cleanup(func() { Remove(p.Tag) })
+
+	for i := 0; i < window+2; i++ {
+		p.record(5*time.Millisecond, nil)
+	}
+	for i := 0; i < 3; i++ {
+		p.record(0, errors.New("refused"))
+	}
+
+	s, _ := Get(p.Tag)
+	// The success rate covers the last window results only.
+	if s.SuccessRate != 0.7 {
+		t.Errorf("SuccessRate = %v, want 0.7", s.SuccessRate)
+	}
+	if s.RTT != 5*time.Millisecond || s.LastError != "refused" || s.LastCheck.IsZero() {
+		t.Errorf("status = %+v", s)
+	}
+
+	p.record(time.Millisecond, nil)
+	if s, _ = Get(p.Tag); s.LastError != "" || s.RTT != time.Millisecond {
+		t.Errorf("status after a success = %+v", s)
+	}
+}
@@ -0,0 +1,330 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	Connections = NewCounterVec("myproxy_connections_total",
+		"Connections opened, by inbound, outbound and matching rule.", "inbound", "outbound", "rule")
+	Bytes = NewCounterVec("myproxy_bytes_total",
+		"Bytes relayed, up from clients and down to them.", "direction", "inbound", "outbound", "rule")
+	Errors = NewCounterVec("myproxy_errors_total",
+		"Connections that could not reach their outbound.", "inbound", "outbound", "rule")
+
+	PoolConns = NewGauge("myproxy_quic_pool_connections",
+		"QUIC connections held by the stream pool.")
+	PoolReconnects = NewCounter("myproxy_quic_pool_reconnects_total",
+		"Pooled QUIC connections redialed after a stream could not be opened.")
+
+	UDPSessions = NewGaugeVec("myproxy_udp_sessions",
+		"Active UDP sessions, on the socks inbound or the endpoint side.", "side")
+
+	DNSCacheHits = NewCounter("myproxy_dns_cache_hits_total",
+		"Host lookups answered from the DNS cache.")
+	DNSCacheMisses = NewCounter("myproxy_dns_cache_misses_total",
+		"Host lookups sent to the resolver.")
+	DNSCachePrefetches = NewCounter("myproxy_dns_cache_prefetches_total",
+		"Hot DNS cache entries refreshed before they expired.")
+	DNSCacheEntries = NewGauge("myproxy_dns_cache_entries",
+		"Names held by the DNS cache.")
+
+	Registration = NewHistogram("myproxy_registration_seconds",
+		"Latency of outbound registration handshakes with the endpoint.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registry   []metric
+	registryMu sync.Mutex
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+}
+
+// Handler serves every metric in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		registryMu.Lock()
+		metrics := registry
+		registryMu.Unlock()
+
+		bw := bufio.NewWriter(w)
+		for _, m := range metrics {
+			m.write(bw)
+		}
+		_ = bw.Flush()
+	})
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(w io.Writer) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+}
+
+// series formats name with the label pairs, extra pairs appended last.
+func (d *desc) series(name string, values []string, extra ...string) string {
+	if len(values) == 0 && len(extra) == 0 {
+		return name
+	}
+
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	pairs := append(append([]string{}, interleave(d.labels, values)...), extra...)
+	for i := 0; i < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(escape(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func interleave(names, values []string) []string {
+	pairs := make([]string, 0, 2*len(names))
+	for i, n := range names {
+		pairs = append(pairs, n, values[i])
+	}
+	return pairs
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(v string) string {
+	return escaper.Replace(v)
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.v.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	c.v.Add(n)
+}
+
+func (c *Counter) Value() uint64 {
+	return c.v.Load()
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+func (g *Gauge) Inc() {
+	g.v.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.v.Add(-1)
+}
+
+func (g *Gauge) Set(v int64) {
+	g.v.Store(v)
+}
+
+func (g *Gauge) Value() int64 {
+	return g.v.Load()
+}
+
+type single[T any] struct {
+	desc
+	v     *T
+	value func(v *T) string
+}
+
+func (s *single[T]) write(w io.Writer) {
+	s.header(w)
+	_, _ = fmt.Fprintf(w, "%s %s\n", s.name, s.value(s.v))
+}
+
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	register(&single[Counter]{
+		desc:  desc{name: name, help: help, kind: "counter"},
+		v:     c,
+		value: func(c *Counter) string { return strconv.FormatUint(c.Value(), 10) },
+	})
+	return c
+}
+
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	register(&single[Gauge]{
+		desc:  desc{name: name, help: help, kind: "gauge"},
+		v:     g,
+		value: func(g *Gauge) string { return strconv.FormatInt(g.Value(), 10) },
+	})
+	return g
+}
+
+// vec holds one child per combination of label values.
+type vec[T any] struct {
+	desc
+	mu       sync.RWMutex
+	children map[string]*T
+	values   map[string][]string
+	value    func(v *T) string
+}
+
+func (v *vec[T]) with(values []string) *T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.name, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mu.RLock()
+	c, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if c, ok = v.children[key]; !ok {
+		c = new(T)
+		v.children[key] = c
+		v.values[key] = append([]string{}, values...)
+	}
+	return c
+}
+
+func (v *vec[T]) write(w io.Writer) {
+	v.header(w)
+
+	v.mu.RLock()
+	keys := make([]string, 0, len(v.children))
+	for k := range v.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, _ = fmt.Fprintf(w, "%s %s\n", v.series(v.name, v.values[k]), v.value(v.children[k]))
+	}
+	v.mu.RUnlock()
+}
+
+func newVec[T any](name, help, kind string, labels []string, value func(v *T) string) *vec[T] {
+	v := &vec[T]{
+		desc:     desc{name: name, help: help, kind: kind, labels: labels},
+		children: make(map[string]*T),
+		values:   make(map[string][]string),
+		value:    value,
+	}
+	register(v)
+	return v
+}
+
+// CounterVec is a family of counters partitioned by label values.
+type CounterVec struct {
+	v *vec[Counter]
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	return &CounterVec{v: newVec(name, help, "counter", labels,
+		func(c *Counter) string { return strconv.FormatUint(c.Value(), 10) })}
+}
+
+// With returns the counter of values, given in the order of the labels.
+func (c *CounterVec) With(values ...string) *Counter {
+	return c.v.with(values)
+}
+
+// GaugeVec is a family of gauges partitioned by label values.
+type GaugeVec struct {
+	v *vec[Gauge]
+}
+
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	return &GaugeVec{v: newVec(name, help, "gauge", labels,
+		func(g *Gauge) string { return strconv.FormatInt(g.Value(), 10) })}
+}
+
+// With returns the gauge of values, given in the order of the labels.
+func (g *GaugeVec) With(values ...string) *Gauge {
+	return g.v.with(values)
+}
+
+// Histogram counts observations into cumulative buckets.
+type Histogram struct {
+	desc
+	bounds []float64
+	counts []atomic.Uint64
+	count  atomic.Uint64
+	sum    atomic.Uint64
+}
+
+// NewHistogram creates a histogram with the given upper bounds, in
+// increasing order.
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{
+		desc:   desc{name: name, help: help, kind: "histogram"},
+		bounds: bounds,
+		counts: make([]atomic.Uint64, len(bounds)),
+	}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		h.counts[i].Add(1)
+	}
+	h.count.Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.header(w)
+
+	var cumulative uint64
+	for i, b := range h.bounds {
+		cumulative += h.counts[i].Load()
+		le := strconv.FormatFloat(b, 'g', -1, 64)
+		_, _ = fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", nil, "le", le), cumulative)
+	}
+	count := h.count.Load()
+	_, _ = fmt.Fprintf(w, "%s %d\n", h.series(h.name+"_bucket", nil, "le", "+Inf"), count)
+	_, _ = fmt.Fprintf(w, "%s_sum %s\n", h.name, strconv.FormatFloat(math.Float64frombits(h.sum.Load()), 'g', -1, 64))
+	_, _ = fmt.Fprintf(w, "%s_count %d\n", h.name, count)
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// scrape returns what Handler serves.
+func scrape(t *testing.T) string {
+	t.Helper()
+	w := httptest.NewRecorder()
+	Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	return w.Body.String()
+}
+
+func TestHandler(t *testing.T) {
+	requests := NewCounterVec("test_requests_total", "Requests.", "inbound", "outbound")
+	requests.With("socks", "proxy").Inc()
+	requests.With("socks", "proxy").Add(2)
+	requests.With(`a"b`, "x\\y\nz").Inc()
+	sessions := NewGauge("test_sessions", "Sessions.")
+	sessions.Inc()
+	sessions.Inc()
+	sessions.Dec()
+	latency := NewHistogram("test_latency_seconds", "Latency.", []float64{.01, .1, 1})
+	for _, v := range []float64{.003, .02, .1, 7, 20} {
+		latency.Observe(v)
+	}
+
+	got := scrape(t)
+	for _, want := range []string{
+		"# HELP test_requests_total Requests.\n# TYPE test_requests_total counter\n",
+		`test_requests_total{inbound="socks",outbound="proxy"} 3` + "\n",
+		`test_requests_total{inbound="a\"b",outbound="x\\y\nz"} 1` + "\n",
+		"# TYPE test_sessions gauge\ntest_sessions 1\n",
+		"# TYPE test_latency_seconds histogram\n" +
+			`test_latency_seconds_bucket{le="0.01"} 1` + "\n" +
+			`test_latency_seconds_bucket{le="0.1"} 3` + "\n" +
+			`test_latency_seconds_bucket{le="1"} 3` + "\n" +
+			`test_latency_seconds_bucket{le="+Inf"} 5` + "\n" +
+			"test_latency_seconds_sum 27.123\n" +
+			"test_latency_seconds_count 5\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("metrics do not contain\n%s\ngot:\n%s", want, got)
+		}
+	}
+}
+
+func TestVecLabels(t *testing.T) {
+	v := NewGaugeVec("test_labels", "Labels.", "side")
+	if v.With("client") != v.With("client") {
+		t.Error("With() returned another gauge for the same labels")
+	}
+	if v.With("client") == v.With("server") {
+		t.Error("With() shared a gauge between labels")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("With() accepted the wrong number of labels")
+		}
+	}()
+	v.With("client", "extra")
+}
@@ -0,0 +1,77 @@
+package mlog
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"myproxy/pkg/models"
+	"os"
+	"sync/atomic"
+)
+
+const (
+	AccessFormatJSON = "json"
+	AccessFormatText = "text"
+
+	accessStdout = "stdout"
+)
+
+var (
+	access     atomic.Pointer[zap.Logger]
+	accessFile *os.File
+)
+
+// ValidAccessFormat reports whether f names an access log format.
+func ValidAccessFormat(f string) bool {
+	return f == "" || f == AccessFormatJSON || f == AccessFormatText
+}
+
+// initAccess opens the access log. It is called by Init with lock held.
+func initAccess(c *models.AccessLog) error {
+	if c == nil || c.Path == "" {
+		access.Store(nil)
+		return nil
+	}
+	if !ValidAccessFormat(c.Format) {
+		return fmt.Errorf("unknown access log format %q", c.Format)
+	}
+
+	out := os.Stdout
+	if c.Path != accessStdout {
+		file, err := os.OpenFile(c.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		accessFile = file
+		out = file
+	}
+
+	encoderConfig := zap.NewProductionEncoderConfig()
+	encoderConfig.TimeKey = "time"
+	encoderConfig.LevelKey = ""
+	encoderConfig.CallerKey = ""
+	encoderConfig.StacktraceKey = ""
+	encoderConfig.EncodeTime = zapcore.RFC3339NanoTimeEncoder
+	encoderConfig.EncodeDuration = zapcore.MillisDurationEncoder
+
+	encoder := zapcore.NewJSONEncoder(encoderConfig)
+	if c.Format == AccessFormatText {
+		encoder = zapcore.NewConsoleEncoder(encoderConfig)
+	}
+
+	access.Store(zap.New(zapcore.NewCore(encoder, zapcore.AddSync(out), zap.DebugLevel)))
+	return nil
+}
+
+// AccessEnabled reports whether an access log is configured.
+func AccessEnabled() bool {
+	return access.Load() != nil
+}
+
+// Access writes one access log record. It does nothing when no access log is
+// configured.
+func Access(msg string, fields ...zap.Field) {
+	if l := access.Load(); l != nil {
+		l.Info(msg, fields...)
+	}
+}
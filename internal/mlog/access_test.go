@@ -0,0 +1,85 @@
+package mlog
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"myproxy/pkg/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccess(t *testing.T) {
+	tests := []struct {
+		format string
+		check  func(t *testing.T, line string)
+	}{
+		{"", func(t *testing.T, line string) {
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("record %q is not JSON: %v", line, err)
+			}
+			if record["msg"] != "connection" || record["id"] != "42" || record["duration"] != 1500.0 {
+				t.Errorf("record = %v", record)
+			}
+			if _, err := time.Parse(time.RFC3339Nano, record["time"].(string)); err != nil {
+				t.Errorf("time = %v", record["time"])
+			}
+			if _, ok := record["level"]; ok {
+				t.Error("record carries a level")
+			}
+		}},
+		{AccessFormatText, func(t *testing.T, line string) {
+			if !strings.Contains(line, "connection") || !strings.Contains(line, `{"id": "42", "duration": 1500}`) {
+				t.Errorf("record = %q", line)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "access.log")
+			err := Init(quiet(&models.Log{Output: OutputStderr, Access: &models.AccessLog{Path: path, Format: tt.format}}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = Close() })
+
+			if !AccessEnabled() {
+				t.Fatal("AccessEnabled() = false")
+			}
+			Access("connection", zap.String("id", "42"), zap.Duration("duration", 1500*time.Millisecond))
+			if err = Close(); err != nil {
+				t.Fatal(err)
+			}
+			if AccessEnabled() {
+				t.Error("AccessEnabled() after Close")
+			}
+			// Dropped once the access log is closed.
+			Access("connection", zap.String("id", "43"))
+
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("access log = %q, want one record", b)
+			}
+			tt.check(t, lines[0])
+		})
+	}
+}
+
+func TestAccessDisabled(t *testing.T) {
+	if err := Init(quiet(&models.Log{Output: OutputStderr})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = Close() })
+
+	if AccessEnabled() {
+		t.Error("AccessEnabled() without an access log")
+	}
+	Access("connection")
+}
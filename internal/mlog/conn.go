@@ -0,0 +1,39 @@
+package mlog
+
+import (
+	"go.uber.org/zap"
+)
+
+// ConnKey is the field carrying the connection ID, the same on the client
+// and on the endpoint for one connection.
+const ConnKey = "conn"
+
+// Logger logs with fields attached to every record.
+type Logger struct {
+	fields []zap.Field
+}
+
+// ForConn returns a logger tagging records with the connection id.
+func ForConn(id string) Logger {
+	return Logger{fields: []zap.Field{zap.String(ConnKey, id)}}
+}
+
+func (l Logger) with(fields []zap.Field) []zap.Field {
+	return append(append(make([]zap.Field, 0, len(l.fields)+len(fields)), l.fields...), fields...)
+}
+
+func (l Logger) Info(msg string, fields ...zap.Field) {
+	logger.Load().Info(msg, l.with(fields)...)
+}
+
+func (l Logger) Error(msg string, fields ...zap.Field) {
+	logger.Load().Error(msg, l.with(fields)...)
+}
+
+func (l Logger) Warn(msg string, fields ...zap.Field) {
+	logger.Load().Warn(msg, l.with(fields)...)
+}
+
+func (l Logger) Debug(msg string, fields ...zap.Field) {
+	logger.Load().Debug(msg, l.with(fields)...)
+}
@@ -0,0 +1,38 @@
+package mlog
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"testing"
+)
+
+func TestForConn(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	prev := logger.Swap(zap.New(core))
+	t.Cleanup(func() { logger.Store(prev) })
+
+	log := ForConn("42")
+	log.Info("opened", zap.String("host", "a.test"))
+	log.Debug("closed")
+	ForConn("43").Warn("failed")
+
+	tests := []struct {
+		msg    string
+		conn   string
+		fields int
+	}{
+		{"opened", "42", 2},
+		{"closed", "42", 1},
+		{"failed", "43", 1},
+	}
+	entries := logs.AllUntimed()
+	if len(entries) != len(tests) {
+		t.Fatalf("%d records, want %d", len(entries), len(tests))
+	}
+	for i, tt := range tests {
+		e := entries[i]
+		if e.Message != tt.msg || e.ContextMap()[ConnKey] != tt.conn || len(e.Context) != tt.fields {
+			t.Errorf("record %d = %s %v, want %s tagged with %s", i, e.Message, e.ContextMap(), tt.msg, tt.conn)
+		}
+	}
+}
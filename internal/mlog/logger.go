@@ -10,14 +10,20 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
-	"time"
+)
+
+const (
+	OutputStderr  = "stderr"
+	OutputJournal = "journald"
+
+	FormatConsole = "console"
+	FormatJSON    = "json"
 )
 
 var (
-	lock     sync.Mutex
-	logger   atomic.Pointer[zap.Logger]
-	preFile  *os.File
-	levels   = map[string]zapcore.Level{
+	lock   sync.Mutex
+	logger atomic.Pointer[zap.Logger]
+	levels = map[string]zapcore.Level{
 		"debug": zap.DebugLevel,
 		"info":  zap.InfoLevel,
 		"warn":  zap.WarnLevel,
@@ -26,88 +32,162 @@ var (
 	}
 	defaultLevel = levels["warn"]
 	workDir, _   = os.Getwd()
+
+	// consoleLevel and fileLevel can be changed while running through
+	// SetLevels.
+	consoleLevel = zap.NewAtomicLevelAt(defaultLevel)
+	fileLevel    = zap.NewAtomicLevelAt(defaultLevel)
+
+	// consoleCore keeps logging after Close, file is the open log file.
+	consoleCore zapcore.Core
+	file        *rotator
 )
 
+// Init builds the logger from c. By default records go to the standard output
+// and to a daily log file rotated by size; Output "stderr" or "journald"
+// writes to the standard error only, the latter with syslog priority
+// prefixes and without timestamps for systemd to add. Calling Init again
+// replaces the previous logger and closes its files.
 func Init(c *models.Log) error {
 	if c == nil {
 		c = &models.Log{}
 	}
-	f := func() {
-		developmentEncoderConfig := zap.NewDevelopmentEncoderConfig()
-		developmentEncoderConfig.StacktraceKey = ""
-		developmentEncoderConfig.EncodeCaller = zapcore.ShortCallerEncoder
-		developmentEncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-		consoleEncoder := zapcore.NewConsoleEncoder(developmentEncoderConfig)
-
-		fileEncoderConfig := zap.NewProductionEncoderConfig()
-		fileEncoderConfig.StacktraceKey = ""
-		fileEncoderConfig.EncodeCaller = nil
-		fileEncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
-		fileEncoderConfig.EncodeDuration = zapcore.StringDurationEncoder
-		fileEncoder := zapcore.NewConsoleEncoder(fileEncoderConfig)
-
-		logPath := fmt.Sprintf("%s/error_%s.log", workDir, time.Now().Format(time.DateOnly))
+	if c.Output != "" && c.Output != OutputStderr && c.Output != OutputJournal {
+		return fmt.Errorf("unknown log output %q", c.Output)
+	}
+	if c.Format != "" && c.Format != FormatConsole && c.Format != FormatJSON {
+		return fmt.Errorf("unknown log format %q", c.Format)
+	}
+
+	fL := defaultLevel
+	cL := defaultLevel
+	if c.FileLevel != "" {
+		fL = levels[c.FileLevel]
+	}
+	if c.ConsoleLevel != "" {
+		cL = levels[c.ConsoleLevel]
+	}
+	fileLevel.SetLevel(fL)
+	consoleLevel.SetLevel(cL)
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := closeFiles(); err != nil {
+		log.Println(err)
+	}
+
+	var cores []zapcore.Core
+	switch c.Output {
+	case OutputStderr:
+		consoleCore = zapcore.NewCore(consoleEncoder(c.Format), zapcore.Lock(os.Stderr), consoleLevel)
+	case OutputJournal:
+		consoleCore = zapcore.NewCore(journalEncoder(), zapcore.Lock(os.Stderr), consoleLevel)
+	default:
+		consoleCore = zapcore.NewCore(consoleEncoder(c.Format), zapcore.AddSync(os.Stdout), consoleLevel)
+
+		dir := workDir
 		if c.LogFilePath != "" {
-			logPath = fmt.Sprintf("%s/error_%s.log", c.LogFilePath, time.Now().Format(time.DateOnly))
+			dir = c.LogFilePath
 		}
-
-		file, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+		r, err := newRotator(dir, c.MaxSize, c.MaxAge, c.MaxBackups, c.Compress)
 		if err != nil {
 			log.Println(err)
-			return
+		} else {
+			file = r
+			cores = append(cores, zapcore.NewCore(fileEncoder(c.Format), r, fileLevel))
 		}
+	}
+	cores = append([]zapcore.Core{consoleCore}, cores...)
 
-		fL := defaultLevel
-		cL := defaultLevel
+	logger.Store(newLogger(zapcore.NewTee(cores...)))
 
-		if c.FileLevel != "" {
-			fL = levels[c.FileLevel]
-		}
-		if c.ConsoleLevel != "" {
-			cL = levels[c.ConsoleLevel]
-		}
+	return initAccess(c.Access)
+}
+
+// Close closes the log files. Later records only go to the console.
+func Close() error {
+	lock.Lock()
+	defer lock.Unlock()
+
+	if consoleCore != nil {
+		logger.Store(newLogger(consoleCore))
+	}
+	return closeFiles()
+}
 
-		fileCore := zapcore.NewCore(
-			fileEncoder,
-			zapcore.AddSync(file),
-			fL,
-		)
-
-		consoleCore := zapcore.NewCore(
-			consoleEncoder,
-			zapcore.AddSync(os.Stdout),
-			cL,
-		)
-
-		lock.Lock()
-		defer lock.Unlock()
-
-		l := zap.New(zapcore.NewTee(consoleCore, fileCore),
-			zap.AddCaller(),
-			zap.AddCallerSkip(1),
-			zap.AddStacktrace(zapcore.ErrorLevel),
-		)
-		logger.Store(l)
-
-		if preFile != nil {
-			_ = preFile.Close()
+func closeFiles() error {
+	var err error
+	if file != nil {
+		_ = file.Sync()
+		err = file.Close()
+		file = nil
+	}
+	if accessFile != nil {
+		if cerr := accessFile.Close(); err == nil {
+			err = cerr
 		}
+		accessFile = nil
+		access.Store(nil)
+	}
+	return err
+}
 
-		preFile = file
+func newLogger(core zapcore.Core) *zap.Logger {
+	return zap.New(core,
+		zap.AddCaller(),
+		zap.AddCallerSkip(1),
+		zap.AddStacktrace(zapcore.ErrorLevel),
+	)
+}
+
+func consoleEncoder(format string) zapcore.Encoder {
+	developmentEncoderConfig := zap.NewDevelopmentEncoderConfig()
+	developmentEncoderConfig.StacktraceKey = ""
+	developmentEncoderConfig.EncodeCaller = zapcore.ShortCallerEncoder
+	developmentEncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	if format == FormatJSON {
+		developmentEncoderConfig.EncodeLevel = zapcore.LowercaseLevelEncoder
+		return zapcore.NewJSONEncoder(developmentEncoderConfig)
 	}
+	return zapcore.NewConsoleEncoder(developmentEncoderConfig)
+}
 
-	f()
+func fileEncoder(format string) zapcore.Encoder {
+	fileEncoderConfig := zap.NewProductionEncoderConfig()
+	fileEncoderConfig.StacktraceKey = ""
+	fileEncoderConfig.EncodeCaller = nil
+	fileEncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	fileEncoderConfig.EncodeDuration = zapcore.StringDurationEncoder
+	if format == FormatJSON {
+		fileEncoderConfig.CallerKey = ""
+		return zapcore.NewJSONEncoder(fileEncoderConfig)
+	}
+	return zapcore.NewConsoleEncoder(fileEncoderConfig)
+}
 
-	go func() {
-		for {
-			now := time.Now()
-			nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
-			time.Sleep(time.Until(nextDay))
+// journalEncoder prefixes records with their syslog priority, as read by
+// systemd from the standard error of a service.
+func journalEncoder() zapcore.Encoder {
+	encoderConfig := zap.NewDevelopmentEncoderConfig()
+	encoderConfig.TimeKey = ""
+	encoderConfig.StacktraceKey = ""
+	encoderConfig.EncodeCaller = zapcore.ShortCallerEncoder
+	encoderConfig.ConsoleSeparator = " "
+	encoderConfig.EncodeLevel = func(l zapcore.Level, enc zapcore.PrimitiveArrayEncoder) {
+		enc.AppendString(journalPriorities[l])
+	}
+	return zapcore.NewConsoleEncoder(encoderConfig)
+}
 
-			f()
-		}
-	}()
-	return nil
+var journalPriorities = map[zapcore.Level]string{
+	zap.DebugLevel:  "<7>",
+	zap.InfoLevel:   "<6>",
+	zap.WarnLevel:   "<4>",
+	zap.ErrorLevel:  "<3>",
+	zap.DPanicLevel: "<2>",
+	zap.PanicLevel:  "<2>",
+	zap.FatalLevel:  "<2>",
 }
 
 func Info(msg string, fields ...zap.Field) {
@@ -165,3 +245,32 @@ var (
 	noPeerResp     = "peer did not respond to CONNECTION_CLOSE"
 	finalSizeErr   = "end of stream occurs before prior data"
 )
+
+// ValidLevel reports whether l names a log level.
+func ValidLevel(l string) bool {
+	_, ok := levels[l]
+	return ok
+}
+
+// SetLevels changes the console and file log levels. An empty level is left
+// unchanged.
+func SetLevels(console, file string) error {
+	for _, l := range []string{console, file} {
+		if l != "" && !ValidLevel(l) {
+			return fmt.Errorf("unknown log level %q", l)
+		}
+	}
+
+	if console != "" {
+		consoleLevel.SetLevel(levels[console])
+	}
+	if file != "" {
+		fileLevel.SetLevel(levels[file])
+	}
+	return nil
+}
+
+// Levels returns the current console and file log levels.
+func Levels() (console, file string) {
+	return consoleLevel.Level().String(), fileLevel.Level().String()
+}
@@ -0,0 +1,82 @@
+package mlog
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"myproxy/pkg/models"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// quiet returns a config keeping the console silent.
+func quiet(c *models.Log) *models.Log {
+	c.ConsoleLevel = "fatal"
+	return c
+}
+
+func TestInitErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *models.Log
+	}{
+		{"output", &models.Log{Output: "syslog"}},
+		{"format", &models.Log{Format: "xml"}},
+		{"access format", &models.Log{Output: OutputStderr, Access: &models.AccessLog{Path: "stdout", Format: "csv"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { _ = Close() })
+			if err := Init(tt.c); err == nil {
+				t.Error("Init succeeded")
+			}
+		})
+	}
+}
+
+func TestInitFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(quiet(&models.Log{LogFilePath: dir, FileLevel: "info", Format: FormatJSON})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = Close() })
+
+	Debug("below the file level")
+	Info("hello", zap.String("k", "v"))
+	if err := Close(); err != nil {
+		t.Fatal(err)
+	}
+	// Records after Close only go to the console.
+	Info("after close")
+
+	b, err := os.ReadFile(filepath.Join(dir, filePrefix+time.Now().Format(time.DateOnly)+fileSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("log file = %q, want one record", b)
+	}
+	var record map[string]any
+	if err = json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatalf("record %q is not JSON: %v", lines[0], err)
+	}
+	if record["msg"] != "hello" || record["k"] != "v" || record["level"] != "info" {
+		t.Errorf("record = %v", record)
+	}
+}
+
+func TestInitStderr(t *testing.T) {
+	dir := t.TempDir()
+	if err := Init(quiet(&models.Log{Output: OutputStderr, LogFilePath: dir})); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = Close() })
+
+	Error("to the console only")
+	if got := files(t, dir); len(got) != 0 {
+		t.Errorf("files = %q, want no log file", got)
+	}
+}
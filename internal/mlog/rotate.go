@@ -0,0 +1,233 @@
+package mlog
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	filePrefix = "error_"
+	fileSuffix = ".log"
+	gzSuffix   = ".gz"
+)
+
+// rotator writes to error_YYYY-MM-DD.log in dir. It starts a new file every
+// day and whenever the current one would grow beyond maxSize; the previous
+// file is kept as a backup, compressed when asked, and pruned by count and
+// age.
+type rotator struct {
+	dir        string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+
+	mu   sync.Mutex
+	file *os.File
+	day  string
+	size int64
+
+	// cleanMu serializes compressing and pruning backups, wg tracks them
+	// so Close can wait.
+	cleanMu sync.Mutex
+	wg      sync.WaitGroup
+}
+
+// newRotator opens the log file of today. maxSize is in megabytes, maxAge in
+// days; zero disables the limit.
+func newRotator(dir string, maxSize, maxAge, maxBackups int, compress bool) (*rotator, error) {
+	r := &rotator{
+		dir:        dir,
+		maxSize:    int64(maxSize) << 20,
+		maxAge:     time.Duration(maxAge) * 24 * time.Hour,
+		maxBackups: maxBackups,
+		compress:   compress,
+	}
+	if err := r.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotator) name(day string) string {
+	return filepath.Join(r.dir, filePrefix+day+fileSuffix)
+}
+
+func (r *rotator) open(now time.Time) error {
+	day := now.Format(time.DateOnly)
+	file, err := os.OpenFile(r.name(day), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+
+	r.file = file
+	r.day = day
+	r.size = fi.Size()
+	return nil
+}
+
+func (r *rotator) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	now := time.Now()
+	if now.Format(time.DateOnly) != r.day {
+		if err := r.rotate(now, r.name(r.day)); err != nil {
+			return 0, err
+		}
+	} else if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		backup := filepath.Join(r.dir, fmt.Sprintf("%s%s.%s%s", filePrefix, r.day, now.Format("150405.000"), fileSuffix))
+		if err := os.Rename(r.name(r.day), backup); err != nil {
+			return 0, err
+		}
+		if err := r.rotate(now, backup); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate closes the current file, opens the one of now and hands backup to
+// the cleanup.
+func (r *rotator) rotate(now time.Time, backup string) error {
+	_ = r.file.Close()
+	r.file = nil
+	if err := r.open(now); err != nil {
+		return err
+	}
+
+	active := r.name(r.day)
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.cleanup(backup, active)
+	}()
+	return nil
+}
+
+func (r *rotator) cleanup(backup, active string) {
+	r.cleanMu.Lock()
+	defer r.cleanMu.Unlock()
+
+	if r.compress && backup != active {
+		// The backup may already be pruned by an earlier cleanup.
+		if err := compress(backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintln(os.Stderr, "mlog: compress "+backup+": "+err.Error())
+		}
+	}
+	if r.maxBackups > 0 || r.maxAge > 0 {
+		r.prune(active)
+	}
+}
+
+// prune removes the backups beyond the newest maxBackups and those older than
+// maxAge.
+func (r *rotator) prune(active string) {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		path    string
+		modTime time.Time
+	}
+	var backups []backup
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasPrefix(name, filePrefix) ||
+			!strings.HasSuffix(name, fileSuffix) && !strings.HasSuffix(name, fileSuffix+gzSuffix) {
+			continue
+		}
+		path := filepath.Join(r.dir, name)
+		if path == active {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, backup{path: path, modTime: fi.ModTime()})
+	}
+
+	// Names sort by the time they were rotated: a day's size rotations
+	// carry a time of day that sorts before the day's last file.
+	sort.Slice(backups, func(i, j int) bool {
+		return strings.TrimSuffix(backups[i].path, gzSuffix) > strings.TrimSuffix(backups[j].path, gzSuffix)
+	})
+	for i, b := range backups {
+		if r.maxBackups > 0 && i >= r.maxBackups || r.maxAge > 0 && time.Since(b.modTime) > r.maxAge {
+			_ = os.Remove(b.path)
+		}
+	}
+}
+
+func compress(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+gzSuffix, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(path + gzSuffix)
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (r *rotator) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	return r.file.Sync()
+}
+
+// Close closes the current file and waits for pending cleanups.
+func (r *rotator) Close() error {
+	r.mu.Lock()
+	var err error
+	if r.file != nil {
+		err = r.file.Close()
+		r.file = nil
+	}
+	r.mu.Unlock()
+
+	r.wg.Wait()
+	return err
+}
@@ -0,0 +1,186 @@
+package mlog
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// files returns the names in dir, sorted.
+func files(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+func write(t *testing.T, r *rotator, s string) {
+	t.Helper()
+	if _, err := r.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotatorSize(t *testing.T) {
+	dir := t.TempDir()
+	r, err := newRotator(dir, 1, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.maxSize = 10
+	today := r.name(r.day)
+
+	write(t, r, "0123456789")
+	if got := files(t, dir); len(got) != 1 {
+		t.Fatalf("files = %q after filling the first file", got)
+	}
+	// A record is never split, even when it is larger than maxSize.
+	// Backups are named by the millisecond they were rotated.
+	time.Sleep(2 * time.Millisecond)
+	write(t, r, "abcdefghijkl")
+	time.Sleep(2 * time.Millisecond)
+	write(t, r, "x")
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := files(t, dir)
+	if len(got) != 3 {
+		t.Fatalf("files = %q, want the active file and 2 backups", got)
+	}
+	var contents []string
+	for _, name := range got {
+		b, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(b))
+	}
+	// Backups of the day sort before the day's active file.
+	if want := []string{"0123456789", "abcdefghijkl", "x"}; strings.Join(contents, ",") != strings.Join(want, ",") {
+		t.Errorf("contents = %q, want %q", contents, want)
+	}
+	if filepath.Join(dir, got[2]) != today {
+		t.Errorf("active file = %s, want %s", got[2], today)
+	}
+}
+
+func TestRotatorDaily(t *testing.T) {
+	dir := t.TempDir()
+	r, err := newRotator(dir, 0, 0, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Pretend the file was opened yesterday.
+	_ = r.file.Close()
+	yesterday := time.Now().AddDate(0, 0, -1)
+	if err = r.open(yesterday); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.file.WriteString("old\n"); err != nil {
+		t.Fatal(err)
+	}
+	write(t, r, "new\n")
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		filePrefix + yesterday.Format(time.DateOnly) + fileSuffix + gzSuffix,
+		filePrefix + time.Now().Format(time.DateOnly) + fileSuffix,
+	}
+	if got := files(t, dir); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("files = %q, want %q", got, want)
+	}
+
+	f, err := os.Open(filepath.Join(dir, want[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(zr); err != nil || string(b) != "old\n" {
+		t.Errorf("compressed backup = %q, %v", b, err)
+	}
+}
+
+func TestRotatorPrune(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxBackups int
+		maxAge     int
+		want       int
+	}{
+		{"by count", 2, 0, 2},
+		{"by age", 0, 1, 3},
+		{"unlimited", 0, 0, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			// A backup rotated long ago, only pruned by age.
+			old := filepath.Join(dir, filePrefix+"2000-01-01"+fileSuffix)
+			if err := os.WriteFile(old, []byte("old"), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			stale := time.Now().AddDate(0, 0, -3)
+			if err := os.Chtimes(old, stale, stale); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := newRotator(dir, 1, tt.maxAge, tt.maxBackups, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.maxSize = 1
+			for _, s := range []string{"a", "b", "c", "d"} {
+				write(t, r, s)
+				// Backups are named by the millisecond they were rotated.
+				time.Sleep(2 * time.Millisecond)
+			}
+			if err = r.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The active file is never pruned.
+			if got := files(t, dir); len(got) != tt.want+1 {
+				t.Errorf("files = %q, want %d backups", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotatorClose(t *testing.T) {
+	r, err := newRotator(t.TempDir(), 0, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Write([]byte("x")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Write() after Close = %v, want %v", err, os.ErrClosed)
+	}
+	if err = r.Sync(); err != nil {
+		t.Errorf("Sync() after Close = %v", err)
+	}
+	if err = r.Close(); err != nil {
+		t.Errorf("second Close() = %v", err)
+	}
+}
@@ -7,12 +7,15 @@ import (
 	"myproxy/pkg/di"
 	"myproxy/pkg/interfaces"
 	"myproxy/pkg/models"
+	"reflect"
+	"slices"
 	"sync"
 )
 
 func New(iConfig *models.Config) (*Instance, error) {
 	ctx, cancel := context.WithCancel(context.Background())
-	instance := &Instance{Ctx: ctx, Cancel: cancel, Config: iConfig}
+	instance := &Instance{Cancel: cancel, Config: iConfig}
+	instance.Ctx = context.WithValue(ctx, instanceKey{}, instance)
 
 	err := instance.init()
 	if err != nil {
@@ -29,27 +32,172 @@ type Instance struct {
 	Config  *models.Config
 	Futures []interfaces.Future
 	Running bool
+
+	// sections maps each config section type to the future serving it.
+	sections map[reflect.Type]interfaces.Future
 }
 
 func (i *Instance) init() error {
 	configs := resolveConfig(i.Config)
 
 	for _, config := range configs {
-		o, err := di.GetServerInstance(i.Ctx, config)
-		if err != nil {
+		if err := i.addSection(config); err != nil {
 			return err
 		}
+	}
+
+	return nil
+}
+
+func (i *Instance) addSection(config any) error {
+	o, err := di.GetServerInstance(i.Ctx, config)
+	if err != nil {
+		return err
+	}
+
+	if future, ok := o.(interfaces.Future); ok {
+		if i.sections == nil {
+			i.sections = make(map[reflect.Type]interfaces.Future)
+		}
+		i.sections[reflect.TypeOf(config)] = future
+		if err = i.AddFuture(future); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reload applies c to the running instance. Sections that can be changed in
+// place are handed their new config, sections new to c are started, and
+// sections missing from c are reloaded with a nil config. Settings read only
+// at start, such as log and transfer, need a restart. A config that a section
+// rejects or whose listeners cannot bind is not applied at all.
+func (i *Instance) Reload(c *models.Config) error {
+	i.Lock.Lock()
+	defer i.Lock.Unlock()
+
+	return i.reload(c)
+}
+
+// Current returns the running config. It must not be modified.
+func (i *Instance) Current() *models.Config {
+	i.Lock.Lock()
+	defer i.Lock.Unlock()
+	return i.Config
+}
+
+// Update applies f to a copy of the running config and reloads the result.
+// The running config is kept when f fails.
+func (i *Instance) Update(f func(c *models.Config) error) error {
+	i.Lock.Lock()
+	defer i.Lock.Unlock()
+
+	c := cloneConfig(i.Config)
+	if err := f(c); err != nil {
+		return err
+	}
+	return i.reload(c)
+}
+
+func (i *Instance) reload(c *models.Config) error {
+	if !reflect.DeepEqual(c.Log, i.Config.Log) || !reflect.DeepEqual(c.Transfer, i.Config.Transfer) {
+		mlog.Warn("log and transfer changes take effect after a restart")
+	}
+
+	configs := resolveConfig(c)
+	seen := make(map[reflect.Type]bool, len(configs))
+	for _, config := range configs {
+		seen[reflect.TypeOf(config)] = true
+	}
+	for t := range i.sections {
+		if !seen[t] {
+			configs = append(configs, reflect.Zero(t).Interface())
+		}
+	}
 
-		if future, ok := o.(interfaces.Future); ok {
-			if err = i.AddFuture(future); err != nil {
+	// Every section is built or checked before any is applied, so a section
+	// that would be rejected leaves the running config untouched.
+	added := make(map[reflect.Type]interfaces.Future)
+	for _, config := range configs {
+		t := reflect.TypeOf(config)
+		future, ok := i.sections[t]
+		if !ok {
+			o, err := di.GetServerInstance(i.Ctx, config)
+			if err != nil {
+				return err
+			}
+			if f, ok := o.(interfaces.Future); ok {
+				added[t] = f
+			}
+			continue
+		}
+		if ch, ok := future.(interfaces.Checker); ok {
+			if err := ch.Check(config); err != nil {
 				return err
 			}
 		}
 	}
 
+	// Applying can still fail, when a listener cannot bind. The sections
+	// applied until then are reverted to the running config.
+	previous := make(map[reflect.Type]any)
+	for _, config := range resolveConfig(i.Config) {
+		previous[reflect.TypeOf(config)] = config
+	}
+	var undo []func() error
+	for _, config := range configs {
+		t := reflect.TypeOf(config)
+		if f, ok := added[t]; ok {
+			if !i.Running {
+				continue
+			}
+			if err := f.Run(); err != nil {
+				revert(undo)
+				return err
+			}
+			undo = append(undo, f.Close)
+			continue
+		}
+
+		r, ok := i.sections[t].(interfaces.Reloadable)
+		if !ok {
+			continue
+		}
+		if err := r.Reload(config); err != nil {
+			revert(undo)
+			return err
+		}
+		old, ok := previous[t]
+		if !ok {
+			old = reflect.Zero(t).Interface()
+		}
+		undo = append(undo, func() error { return r.Reload(old) })
+	}
+
+	for _, config := range configs {
+		t := reflect.TypeOf(config)
+		if f, ok := added[t]; ok {
+			if i.sections == nil {
+				i.sections = make(map[reflect.Type]interfaces.Future)
+			}
+			i.sections[t] = f
+			i.Futures = append(i.Futures, f)
+		}
+	}
+	i.Config = c
+	mlog.Warn("config reloaded")
 	return nil
 }
 
+// revert undoes the applied sections of a failed reload, last first.
+func revert(undo []func() error) {
+	for j := len(undo) - 1; j >= 0; j-- {
+		if err := undo[j](); err != nil {
+			mlog.Error("revert reload: " + err.Error())
+		}
+	}
+}
+
 func (i *Instance) AddFuture(o interfaces.Future) error {
 	i.Futures = append(i.Futures, o)
 	if i.Running {
@@ -102,6 +250,10 @@ func (i *Instance) Close() error {
 			errMsg += " " + err.Error()
 		}
 	}
+	// Log files are closed last, after the futures logged their shutdown.
+	if err := mlog.Close(); err != nil {
+		errMsg += " " + err.Error()
+	}
 
 	if errMsg != "" {
 		return errors.New(errMsg)
@@ -110,22 +262,61 @@ func (i *Instance) Close() error {
 	return nil
 }
 
+type instanceKey struct{}
+
+// FromContext returns the instance whose futures were created with ctx.
+func FromContext(ctx context.Context) (*Instance, bool) {
+	i, ok := ctx.Value(instanceKey{}).(*Instance)
+	return i, ok
+}
+
+// cloneConfig copies c deep enough that sections can be added to or removed
+// from the copy without touching c.
+func cloneConfig(c *models.Config) *models.Config {
+	n := *c
+	n.Inbounds = slices.Clone(c.Inbounds)
+	n.Outbounds = slices.Clone(c.Outbounds)
+	n.OutboundGroups = slices.Clone(c.OutboundGroups)
+	if c.Routing != nil {
+		r := *c.Routing
+		r.Rules = slices.Clone(c.Routing.Rules)
+		n.Routing = &r
+	}
+	return &n
+}
+
 func resolveConfig(cfg *models.Config) []any {
 	cfgs := make([]any, 0)
 
 	if cfg != nil {
+		// Names are resolved from the first connection on.
+		if cfg.DNS != nil {
+			cfgs = append(cfgs, cfg.DNS)
+		}
+		if cfg.Direct != nil {
+			cfgs = append(cfgs, cfg.Direct)
+		}
 		if cfg.Endpoint != nil {
 			cfgs = append(cfgs, cfg.Endpoint)
 		}
 		if cfg.Outbounds != nil {
 			cfgs = append(cfgs, cfg.Outbounds)
 		}
+		if cfg.OutboundGroups != nil {
+			cfgs = append(cfgs, cfg.OutboundGroups)
+		}
 		if cfg.Inbounds != nil {
 			cfgs = append(cfgs, cfg.Inbounds)
 		}
 		if cfg.Routing != nil {
 			cfgs = append(cfgs, cfg.Routing)
 		}
+		if cfg.Admin != nil {
+			cfgs = append(cfgs, cfg.Admin)
+		}
+		if cfg.Metrics != nil {
+			cfgs = append(cfgs, cfg.Metrics)
+		}
 	}
 
 	return cfgs
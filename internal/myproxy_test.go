@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/di"
+	"myproxy/pkg/models"
+	"os"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+var errBad = errors.New("bad section")
+
+// section is a config section that fails to check or apply any config
+// holding an entry tagged "unchecked" or "bad".
+type section struct {
+	cur any
+}
+
+func tags(v any) []string {
+	var tags []string
+	switch v := v.(type) {
+	case []*models.Inbound:
+		for _, inb := range v {
+			tags = append(tags, inb.Tag)
+		}
+	case []*models.Outbound:
+		for _, oub := range v {
+			tags = append(tags, oub.Tag)
+		}
+	case *models.Routing:
+		if v != nil {
+			tags = append(tags, v.Final)
+		}
+	}
+	return tags
+}
+
+func (s *section) Run() error {
+	if slices.Contains(tags(s.cur), "bad") {
+		return errBad
+	}
+	return nil
+}
+
+func (s *section) Close() error { return nil }
+
+func (s *section) Reload(v any) error {
+	if slices.Contains(tags(v), "bad") {
+		return errBad
+	}
+	s.cur = v
+	return nil
+}
+
+func (s *section) Check(v any) error {
+	if slices.Contains(tags(v), "unchecked") {
+		return errBad
+	}
+	return nil
+}
+
+// sections holds the sections created since the last newInstance.
+var sections map[reflect.Type]*section
+
+func TestMain(m *testing.M) {
+	if err := mlog.Init(&models.Log{Output: mlog.OutputStderr, ConsoleLevel: "fatal"}); err != nil {
+		panic(err)
+	}
+	for _, v := range []any{[]*models.Inbound{}, []*models.Outbound{}, &models.Routing{}} {
+		di.ServerContext[reflect.TypeOf(v)] = func(_ context.Context, v any) (any, error) {
+			s := &section{cur: v}
+			sections[reflect.TypeOf(v)] = s
+			return s, nil
+		}
+	}
+	os.Exit(m.Run())
+}
+
+func newInstance(t *testing.T, c *models.Config) *Instance {
+	t.Helper()
+	sections = make(map[reflect.Type]*section)
+	i, err := New(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return i
+}
+
+func inbounds(tags ...string) []*models.Inbound {
+	var v []*models.Inbound
+	for _, tag := range tags {
+		v = append(v, &models.Inbound{Tag: tag})
+	}
+	return v
+}
+
+func outbounds(tags ...string) []*models.Outbound {
+	var v []*models.Outbound
+	for _, tag := range tags {
+		v = append(v, &models.Outbound{Tag: tag})
+	}
+	return v
+}
+
+func TestReload(t *testing.T) {
+	running := &models.Config{Inbounds: inbounds("in"), Outbounds: outbounds("out"), Routing: &models.Routing{Final: "out"}}
+	tests := []struct {
+		name    string
+		next    *models.Config
+		wantErr bool
+		// want lists the tags each section holds afterwards, in the order
+		// inbounds, outbounds, routing.
+		want [3][]string
+	}{
+		{"changed", &models.Config{Inbounds: inbounds("in", "in2"), Outbounds: outbounds("out2"), Routing: &models.Routing{Final: "out2"}},
+			false, [3][]string{{"in", "in2"}, {"out2"}, {"out2"}}},
+		{"removed", &models.Config{Inbounds: inbounds("in"), Outbounds: outbounds("out")},
+			false, [3][]string{{"in"}, {"out"}, nil}},
+		{"rejected by check", &models.Config{Inbounds: inbounds("unchecked"), Outbounds: outbounds("out2"), Routing: &models.Routing{Final: "out2"}},
+			true, [3][]string{{"in"}, {"out"}, {"out"}}},
+		// Outbounds are applied before inbounds and reverted when they fail.
+		{"reverted", &models.Config{Inbounds: inbounds("bad"), Outbounds: outbounds("out2"), Routing: &models.Routing{Final: "out2"}},
+			true, [3][]string{{"in"}, {"out"}, {"out"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := newInstance(t, running)
+			err := i.Reload(tt.next)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Reload() error = %v, want error %v", err, tt.wantErr)
+			}
+			for j, v := range []any{[]*models.Inbound{}, []*models.Outbound{}, &models.Routing{}} {
+				if got := tags(sections[reflect.TypeOf(v)].cur); !slices.Equal(got, tt.want[j]) {
+					t.Errorf("%T section = %q, want %q", v, got, tt.want[j])
+				}
+			}
+			want := tt.next
+			if tt.wantErr {
+				want = running
+			}
+			if i.Current() != want {
+				t.Error("Current() is not the config last applied")
+			}
+		})
+	}
+}
+
+func TestReloadAdded(t *testing.T) {
+	i := newInstance(t, &models.Config{Outbounds: outbounds("out")})
+
+	// A new section that fails to start reverts those applied before it.
+	err := i.Reload(&models.Config{Outbounds: outbounds("out2"), Routing: &models.Routing{Final: "bad"}})
+	if !errors.Is(err, errBad) {
+		t.Fatalf("Reload() = %v, want %v", err, errBad)
+	}
+	if got := tags(sections[reflect.TypeOf([]*models.Outbound{})].cur); !slices.Equal(got, []string{"out"}) {
+		t.Errorf("outbounds = %q after a failed reload", got)
+	}
+
+	if err = i.Reload(&models.Config{Outbounds: outbounds("out"), Routing: &models.Routing{Final: "out"}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(i.Futures) != 2 {
+		t.Errorf("instance runs %d futures, want the added section too", len(i.Futures))
+	}
+}
@@ -0,0 +1,199 @@
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/net/dns/dnsmessage"
+	"math"
+	dns2 "myproxy/internal/dns"
+	"myproxy/internal/mlog"
+	"myproxy/internal/router"
+	"myproxy/pkg/models"
+	"myproxy/pkg/shared"
+	net2 "myproxy/pkg/util/net"
+	"net"
+	"strings"
+)
+
+const (
+	// fakeTTL is the TTL of fake addresses, short so that clients do not
+	// keep an address after it was handed out to another name.
+	fakeTTL = 1
+	// minUDPSize is the largest UDP answer a client without EDNS accepts.
+	minUDPSize = 512
+
+	// SVCB and HTTPS records carry address hints that would bypass fake
+	// addresses.
+	typeSVCB  dnsmessage.Type = 64
+	typeHTTPS dnsmessage.Type = 65
+)
+
+// handle answers query. Names are routed like connections: a name routed to
+// the reject outbound is refused and one routed to block gets no answer, in
+// which case handle returns nil. A and AAAA queries are answered from the
+// cache of pkg/util/net, or with fake addresses, other queries are forwarded
+// to the configured servers.
+func handle(ctx context.Context, inb *models.Inbound, network string, src net.IP, query []byte) []byte {
+	var p dnsmessage.Parser
+	h, err := p.Start(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return reply(h, nil, dnsmessage.RCodeFormatError)
+	}
+	if h.OpCode != 0 || q.Class != dnsmessage.ClassINET {
+		return reply(h, &q, dnsmessage.RCodeNotImplemented)
+	}
+	size := udpSize(&p)
+
+	host := strings.TrimSuffix(q.Name.String(), ".")
+	// Names answered with fake addresses are routed by name only, resolving
+	// them here would defeat the fake addresses.
+	fake := dns2.FakeEnabled(host)
+	r := router.Router{
+		InboundTag: inb.Tag,
+		Network:    network,
+		Host:       host,
+		SrcAddr:    src,
+		AsIs:       fake,
+	}
+	outTag := r.Process()
+	qType := strings.TrimPrefix(q.Type.String(), "Type")
+	mlog.Debug(fmt.Sprintf("dns query %s %s from %s by %s", qType, host, src, outTag))
+
+	switch outTag {
+	case shared.OutboundBlock:
+		return nil
+	case shared.OutboundReject:
+		return reply(h, &q, dnsmessage.RCodeRefused)
+	}
+
+	var fakeIP net.IP
+	if q.Type == dnsmessage.TypeA {
+		fakeIP = dns2.FakeIP(host)
+	}
+
+	var resp []byte
+	switch {
+	case fakeIP != nil:
+		resp = reply(h, &q, dnsmessage.RCodeSuccess, fakeIP)
+	case fake && (q.Type == dnsmessage.TypeAAAA || q.Type == typeSVCB || q.Type == typeHTTPS):
+		resp = reply(h, &q, dnsmessage.RCodeSuccess)
+	case q.Type == dnsmessage.TypeA || q.Type == dnsmessage.TypeAAAA:
+		resp = lookup(h, &q, host)
+	default:
+		resp, err = dns2.Exchange(ctx, host, query)
+		if errors.Is(err, dns2.ErrNoServers) {
+			return reply(h, &q, dnsmessage.RCodeNotImplemented)
+		}
+		if err != nil {
+			mlog.Debug("dns query " + host + ": " + err.Error())
+			return reply(h, &q, dnsmessage.RCodeServerFailure)
+		}
+	}
+
+	if network == shared.NetworkUDP && len(resp) > size {
+		h.Truncated = true
+		return reply(h, &q, dnsmessage.RCodeSuccess)
+	}
+	return resp
+}
+
+// lookup answers an A or AAAA query from the addresses of host of that
+// family, with the time they stay cached as TTL.
+func lookup(h dnsmessage.Header, q *dnsmessage.Question, host string) []byte {
+	ips, ttl, err := net2.LookupIPTTL(host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return reply(h, q, dnsmessage.RCodeNameError)
+		}
+		mlog.Debug("dns query " + host + ": " + err.Error())
+		return reply(h, q, dnsmessage.RCodeServerFailure)
+	}
+
+	var answer []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (q.Type == dnsmessage.TypeA) {
+			answer = append(answer, ip)
+		}
+	}
+	secs := uint32(min(max(math.Ceil(ttl.Seconds()), 1), math.MaxInt32))
+	return replyTTL(h, q, dnsmessage.RCodeSuccess, secs, answer...)
+}
+
+func reply(h dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, ips ...net.IP) []byte {
+	return replyTTL(h, q, rcode, fakeTTL, ips...)
+}
+
+// replyTTL builds the response to the query with header h and question q.
+// The addresses are answered as A or AAAA records, as q asks.
+func replyTTL(h dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, ttl uint32, ips ...net.IP) []byte {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:                 h.ID,
+		Response:           true,
+		OpCode:             h.OpCode,
+		Truncated:          h.Truncated,
+		RecursionDesired:   h.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+
+	err := b.StartQuestions()
+	if err == nil && q != nil {
+		err = b.Question(*q)
+	}
+	if err == nil && len(ips) > 0 {
+		err = b.StartAnswers()
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: ttl}
+		for _, ip := range ips {
+			if err != nil {
+				break
+			}
+			if q.Type == dnsmessage.TypeA {
+				var a dnsmessage.AResource
+				copy(a.A[:], ip.To4())
+				err = b.AResource(rh, a)
+			} else {
+				var aaaa dnsmessage.AAAAResource
+				copy(aaaa.AAAA[:], ip.To16())
+				err = b.AAAAResource(rh, aaaa)
+			}
+		}
+	}
+	if err != nil {
+		mlog.Error("dns reply: " + err.Error())
+		return nil
+	}
+
+	resp, err := b.Finish()
+	if err != nil {
+		mlog.Error("dns reply: " + err.Error())
+		return nil
+	}
+	return resp
+}
+
+// udpSize returns the largest UDP response the client accepts, which it
+// advertises in an EDNS OPT record. The parser must be past the question.
+func udpSize(p *dnsmessage.Parser) int {
+	if p.SkipAllQuestions() != nil || p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return minUDPSize
+	}
+	for {
+		rh, err := p.AdditionalHeader()
+		if err != nil {
+			return minUDPSize
+		}
+		if rh.Type == dnsmessage.TypeOPT {
+			return max(int(rh.Class), minUDPSize)
+		}
+		if p.SkipAdditional() != nil {
+			return minUDPSize
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package dns
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"io"
+	dns2 "myproxy/internal/dns"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/models"
+	"myproxy/pkg/shared"
+	net2 "myproxy/pkg/util/net"
+	"net"
+	"time"
+)
+
+// tcpIdleTimeout closes TCP connections that send no query for that long.
+const tcpIdleTimeout = 10 * time.Second
+
+// maxUDPQueries bounds the UDP queries answered at once. Queries arriving
+// while that many are pending are dropped; clients retry them.
+const maxUDPQueries = 256
+
+// Inbound answers DNS queries on the UDP and TCP ports of inb until listen is
+// done. Queries are answered under ctx. ready is called once both are bound,
+// or with the error binding them.
+func Inbound(ctx, listen context.Context, inb *models.Inbound, ready func(error)) {
+	udpAddr, err := net.ResolveUDPAddr("udp", inb.AddrPort())
+	if err != nil {
+		ready(err)
+		return
+	}
+
+	l, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		ready(err)
+		return
+	}
+	mlog.Info("listening UDP on " + l.LocalAddr().String())
+
+	stopUDP := context.AfterFunc(listen, func() {
+		_ = l.Close()
+	})
+	defer stopUDP()
+	go serveUDP(ctx, listen, l, inb)
+
+	tl, err := net.Listen("tcp", inb.AddrPort())
+	if err != nil {
+		_ = l.Close()
+		ready(err)
+		return
+	}
+	mlog.Info("listening TCP on " + tl.Addr().String())
+	ready(nil)
+
+	stop := context.AfterFunc(listen, func() {
+		_ = tl.Close()
+	})
+	defer stop()
+
+	for {
+		conn, err := tl.Accept()
+		if err != nil {
+			if listen.Err() != nil {
+				return
+			}
+			mlog.Error("Failed to accept client connection:", zap.Error(err))
+			return
+		}
+
+		go serveTCP(ctx, conn, inb)
+	}
+}
+
+func serveUDP(ctx, listen context.Context, l *net.UDPConn, inb *models.Inbound) {
+	defer func(l *net.UDPConn) {
+		err := l.Close()
+		if err != nil {
+			return
+		}
+	}(l)
+
+	pending := make(chan struct{}, maxUDPQueries)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := l.ReadFromUDP(buf)
+		if err != nil {
+			if listen.Err() != nil {
+				return
+			}
+			mlog.Error(err.Error())
+			return
+		}
+
+		select {
+		case pending <- struct{}{}:
+		default:
+			mlog.Debug("dns query from " + addr.String() + " dropped, too many pending")
+			continue
+		}
+
+		query := bytes.Clone(buf[:n])
+		go func() {
+			defer func() { <-pending }()
+			resp := handle(ctx, inb, shared.NetworkUDP, addr.IP, query)
+			if resp == nil {
+				return
+			}
+			if _, err := l.WriteToUDP(resp, addr); err != nil {
+				mlog.Debug("dns reply to " + addr.String() + ": " + err.Error())
+			}
+		}()
+	}
+}
+
+// serveTCP answers the length-prefixed queries of conn one at a time.
+func serveTCP(ctx context.Context, conn net.Conn, inb *models.Inbound) {
+	defer func(conn net.Conn) {
+		err := conn.Close()
+		if err != nil {
+			return
+		}
+	}(conn)
+
+	src := net2.AddrIP(conn.RemoteAddr())
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		query, err := dns2.ReadMsg(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				mlog.Debug("dns query from " + conn.RemoteAddr().String() + ": " + err.Error())
+			}
+			return
+		}
+
+		resp := handle(ctx, inb, shared.NetworkTCP, src, query)
+		if resp == nil {
+			return
+		}
+		if err = dns2.WriteMsg(conn, resp); err != nil {
+			mlog.Debug("dns reply to " + conn.RemoteAddr().String() + ": " + err.Error())
+			return
+		}
+	}
+}
@@ -4,14 +4,24 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"go.uber.org/zap"
 	"golang.org/x/net/quic"
+	"myproxy/internal/auth"
 	"myproxy/internal/mlog"
+	"myproxy/internal/proxy/dns"
 	"myproxy/internal/proxy/http"
 	"myproxy/internal/proxy/socks"
 	"myproxy/pkg/models"
 	"myproxy/pkg/shared"
+	"myproxy/pkg/util/id"
+	"myproxy/pkg/util/packet"
+	"time"
 )
 
+// initialTimeout bounds how long a new stream may take to send its initial
+// packet.
+const initialTimeout = 10 * time.Second
+
 func ListenQUIC(ctx context.Context, l *quic.Endpoint) {
 	for {
 		accept, err := l.Accept(ctx)
@@ -42,39 +52,93 @@ func handConn(ctx context.Context, conn *quic.Conn) {
 			return
 		}
 
-		var buf [1500]byte
+		go serveStream(ctx, stream)
+	}
+}
 
-		n, err := stream.Read(buf[:])
-		if err != nil {
-			mlog.Error(err.Error())
-			return
-		}
+// serveStream reads the initial packet of stream and hands the stream to
+// the protocol it names. A stream that does not send a valid initial
+// packet within initialTimeout is closed on its own; the other streams of
+// the connection carry on.
+func serveStream(ctx context.Context, stream *quic.Stream) {
+	readCtx, cancel := context.WithTimeout(ctx, initialTimeout)
+	stream.SetReadContext(readCtx)
+	payload, err := packet.DePacket(stream)
+	cancel()
+	stream.SetReadContext(context.Background())
+	if err != nil {
+		mlog.Error(err.Error())
+		_ = stream.Close()
+		return
+	}
+
+	var i models.InitialPacket
+	err = json.Unmarshal(payload, &i)
+	if err != nil {
+		mlog.Error(err.Error())
+		_ = stream.Close()
+		return
+	}
+
+	// Clients always send a connection ID; one left empty is replaced so
+	// the stream's logs can still be told apart.
+	if i.ConnID == "" {
+		i.ConnID = id.GetSnowflakeID().String()
+	}
+	log := mlog.ForConn(i.ConnID)
+
+	user, err := auth.Verify(i.Proof)
+	if err != nil {
+		log.Warn("stream rejected", zap.Error(err))
+		_ = stream.Close()
+		return
+	}
+	log.Debug("stream accepted", zap.String("protocol", i.Protocol), zap.String("user", user))
 
-		var i models.InitialPacket
-		err = json.Unmarshal(buf[:n], &i)
+	switch i.Protocol {
+	case shared.HTTP:
+		http.Process(auth.WithUser(ctx, user), i.ConnID, i.Content, stream)
+	case shared.SOCKS:
+		socks.Process(auth.WithUser(ctx, user), i.ConnID, i.Request, stream)
+	case shared.PING:
+		pong(stream)
+	default:
+		_ = stream.Close()
+	}
+}
+
+func pong(stream *quic.Stream) {
+	defer func(stream *quic.Stream) {
+		err := stream.Close()
 		if err != nil {
-			mlog.Error(err.Error())
 			return
 		}
+	}(stream)
 
-		switch i.Protocol {
-		case shared.HTTP:
-			go http.Process(ctx, i.Content, stream)
-			break
-		case shared.SOCKS:
-			go socks.Process(ctx, i.Request, stream)
-			break
-		}
+	_, err := stream.Write([]byte(shared.PONG))
+	if err != nil {
+		mlog.Error(err.Error())
+		return
 	}
+	stream.Flush()
 }
 
-func Process(ctx context.Context, inb *models.Inbound) {
+// Process serves inb until listen is done and its listeners are closed.
+// Accepted connections run under ctx, so they outlive the listeners when only
+// listen is cancelled. ready is called once, when the listeners are bound or
+// failed to bind.
+func Process(ctx, listen context.Context, inb *models.Inbound, ready func(error)) {
 	switch inb.Protocol {
 	case shared.SOCKS:
-		go socks.Inbound(ctx, inb)
+		socks.Inbound(ctx, listen, inb, ready)
 		break
 	case shared.HTTP:
-		go http.Inbound(ctx, inb)
+		http.Inbound(ctx, listen, inb, ready)
+		break
+	case shared.DNS:
+		dns.Inbound(ctx, listen, inb, ready)
 		break
+	default:
+		ready(errors.New("unknown protocol " + inb.Protocol))
 	}
 }
@@ -4,102 +4,139 @@ import (
 	"bufio"
 	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
 	"go.uber.org/zap"
 	"golang.org/x/net/quic"
 	"io"
 	"myproxy/internal"
+	"myproxy/internal/auth"
+	"myproxy/internal/conntrack"
 	"myproxy/internal/mlog"
 	"myproxy/internal/router"
 	io2 "myproxy/pkg/io"
 	"myproxy/pkg/models"
-	"myproxy/pkg/protocol"
 	"myproxy/pkg/shared"
 	net2 "myproxy/pkg/util/net"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
-func Process(ctx context.Context, payload []byte, stream *quic.Stream) {
-	mlog.Debug(string(payload))
+// connIDHeader carries the connection ID in the replies the proxy writes
+// itself, so a failed request can be found in the logs of both sides.
+const connIDHeader = "X-Connection-Id"
+
+const statusBadGateway = "502 Bad Gateway"
+
+// writeStatus answers the client with an empty response of status. header
+// holds extra CRLF terminated header lines.
+func writeStatus(client io.Writer, status, connID, header string) error {
+	_, err := client.Write([]byte("HTTP/1.1 " + status + "\r\n" + header + connIDHeader + ": " + connID +
+		"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+	return err
+}
+
+// Process serves an HTTP request tunneled to the endpoint. connID is the ID
+// the client gave the connection.
+func Process(ctx context.Context, connID string, payload []byte, stream *quic.Stream) {
+	log := mlog.ForConn(connID)
+	log.Debug(string(payload))
 	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(payload)))
 	if err != nil {
-		mlog.Error("Failed to parse client request:", zap.Error(err))
+		log.Error("Failed to parse client request:", zap.Error(err))
 		return
 	}
 
-	host, _, err := net.SplitHostPort(req.Host)
+	host, port, err := net.SplitHostPort(req.Host)
 	if err != nil {
-		mlog.Error("Failed to parse target host:", zap.Error(err))
+		log.Error("Failed to parse target host:", zap.Error(err))
 		return
 	}
 
-	ips, err := net2.LookupIP(host)
-	if err != nil {
-		mlog.Error("Failed to resolve target host:", zap.Error(err))
-		return
+	dstPort, _ := strconv.ParseUint(port, 10, 16)
+
+	r := router.Router{
+		Network: shared.NetworkTCP,
+		Host:    host,
+		DstPort: uint16(dstPort),
+		User:    auth.User(ctx),
 	}
-	if len(ips) == 0 {
-		mlog.Error("no IPs resolved for " + host)
+	outTag := r.Process()
+
+	if deny(&io2.Pipe{Stream: stream}, req, outTag, connID) {
 		return
 	}
 
-	r := router.Router{DstAddr: ips[0]}
-	outTag := r.Process()
+	p := io2.Pipe{Stream: stream}
 
-	if outTag == "direct" {
-		mlog.Debug(fmt.Sprintf("request to Method [%s] Host [%s] with URL [%s]", req.Method, host, req.URL))
+	t := conntrack.Open(conntrack.Info{
+		ID:       connID,
+		User:     auth.User(ctx),
+		Network:  shared.NetworkTCP,
+		Host:     host,
+		Outbound: outTag,
+		Rule:     r.Rule,
+	}, &p)
+	defer t.Close()
+	t.AddUp(len(payload))
 
-		p := io2.Pipe{
-			Stream: stream,
-		}
+	if outTag == shared.OutboundDirect {
+		log.Debug(fmt.Sprintf("request to Method [%s] Host [%s] with URL [%s]", req.Method, host, req.URL))
 
-		handleClientRequest(payload, req, &p)
+		ctx = net2.WithAddrs(ctx, host, r.Addrs)
+		handleClientRequest(ctx, payload, req, t.Wrap(&p), t)
 	} else {
 		info, ok := internal.GetOsi(outTag)
 		if !ok {
-			mlog.Error("outbound not found: " + outTag)
-			return
-		}
-		remoteAddr := &models.NetAddr{Address: info.Address, Port: info.NodePort}
-
-		newStream, err := protocol.StreamPool(ctx, remoteAddr)
-		if err != nil {
-			mlog.Error(err.Error())
+			log.Error("outbound not found: " + outTag)
+			t.Fail(conntrack.ErrNoOutbound)
+			_ = writeStatus(&p, statusBadGateway, connID, "")
 			return
 		}
 
-		i := models.InitialPacket{
+		newStream, err := internal.OpenStream(ctx, info, &models.InitialPacket{
 			Protocol: shared.HTTP,
 			Content:  payload,
-		}
-
-		m, err := json.Marshal(i)
+			ConnID:   connID,
+		})
 		if err != nil {
-			mlog.Error(err.Error())
+			t.Fail(err)
+			log.Error(err.Error())
+			_ = writeStatus(&p, statusBadGateway, connID, "")
 			return
 		}
 
-		_, err = newStream.Write(m)
-		if err != nil {
-			mlog.Error(err.Error())
-			return
+		io2.Copy(newStream, t.Wrap(&p))
+	}
+}
+
+// deny closes client when outTag is the block or reject outbound. Reject first
+// answers the client with 403 Forbidden, block drops it silently.
+func deny(client io.ReadWriteCloser, req *http.Request, outTag, connID string) bool {
+	log := mlog.ForConn(connID)
+	switch outTag {
+	case shared.OutboundReject:
+		if err := writeStatus(client, "403 Forbidden", connID, ""); err != nil {
+			log.Error("Failed to write response:", zap.Error(err))
 		}
-		newStream.Flush()
+	case shared.OutboundBlock:
+	default:
+		return false
+	}
 
-		input := io2.Pipe{Stream: stream}
-		output := io2.Pipe{Stream: newStream}
+	log.Debug(fmt.Sprintf("request %s with [%s]", req.URL, outTag))
 
-		io2.Copy(&output, &input)
-	}
+	_ = client.Close()
+	return true
 }
 
-func handleConnectRequest(client io.ReadWriteCloser, targetHost string, targetPort string) {
-	targetConn, err := net.Dial("tcp", targetHost+":"+targetPort)
+func handleConnectRequest(ctx context.Context, client io.ReadWriteCloser, targetHost string, targetPort string, t *conntrack.Conn) {
+	targetConn, err := net2.DialContext(ctx, "tcp", net.JoinHostPort(targetHost, targetPort))
 	if err != nil {
-		mlog.Error("Failed to connect to target:", zap.Error(err))
+		t.Log().Error("Failed to connect to target:", zap.Error(err))
+		t.Fail(err)
+		_ = writeStatus(client, statusBadGateway, t.ID(), "")
 		err := client.Close()
 		if err != nil {
 			return
@@ -112,8 +149,9 @@ func handleConnectRequest(client io.ReadWriteCloser, targetHost string, targetPo
 			return
 		}
 	}(targetConn)
+	t.SetRemote(targetConn.RemoteAddr())
 
-	mlog.Debug(fmt.Sprintf("connection opened to tcp:%s, local endpoint %s, remote endpoint %s",
+	t.Log().Debug(fmt.Sprintf("connection opened to tcp:%s, local endpoint %s, remote endpoint %s",
 		targetHost+":"+targetPort, targetConn.LocalAddr(), targetConn.LocalAddr()))
 	_, err = client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
 	if err != nil {
@@ -123,10 +161,12 @@ func handleConnectRequest(client io.ReadWriteCloser, targetHost string, targetPo
 	io2.Copy(targetConn, client)
 }
 
-func handleHTTPRequest(client io.ReadWriteCloser, targetHost string, targetPort string, requestData []byte) {
-	targetConn, err := net.Dial("tcp", targetHost+":"+targetPort)
+func handleHTTPRequest(ctx context.Context, client io.ReadWriteCloser, targetHost string, targetPort string, requestData []byte, t *conntrack.Conn) {
+	targetConn, err := net2.DialContext(ctx, "tcp", net.JoinHostPort(targetHost, targetPort))
 	if err != nil {
-		mlog.Error("Failed to connect to target:", zap.Error(err))
+		t.Log().Error("Failed to connect to target:", zap.Error(err))
+		t.Fail(err)
+		_ = writeStatus(client, statusBadGateway, t.ID(), "")
 		err := client.Close()
 		if err != nil {
 			return
@@ -139,7 +179,8 @@ func handleHTTPRequest(client io.ReadWriteCloser, targetHost string, targetPort
 			return
 		}
 	}(targetConn)
-	mlog.Debug(fmt.Sprintf("connection opened to tcp:%s, local endpoint %s, remote endpoint %s",
+	t.SetRemote(targetConn.RemoteAddr())
+	t.Log().Debug(fmt.Sprintf("connection opened to tcp:%s, local endpoint %s, remote endpoint %s",
 		targetHost+":"+targetPort, targetConn.LocalAddr(), targetConn.LocalAddr()))
 
 	_, err = targetConn.Write(requestData)
@@ -150,24 +191,24 @@ func handleHTTPRequest(client io.ReadWriteCloser, targetHost string, targetPort
 	io2.Copy(targetConn, client)
 }
 
-func handleClientRequest(buf []byte, req *http.Request, client io.ReadWriteCloser) {
+func handleClientRequest(ctx context.Context, buf []byte, req *http.Request, client io.ReadWriteCloser, t *conntrack.Conn) {
 	if req.Method == "CONNECT" {
 		targetHost, targetPort, err := net.SplitHostPort(req.Host)
 		if err != nil {
-			mlog.Error("Failed to parse target host:", zap.Error(err))
+			t.Log().Error("Failed to parse target host:", zap.Error(err))
 			return
 		}
-		handleConnectRequest(client, targetHost, targetPort)
+		handleConnectRequest(ctx, client, targetHost, targetPort, t)
 	} else {
 		targetHost, targetPort, err := net.SplitHostPort(req.Host)
 		if err != nil {
 			if !strings.Contains(err.Error(), "missing port in address") {
-				mlog.Error(fmt.Sprintf("Failed to parse target host:%T", err), zap.Error(err))
+				t.Log().Error(fmt.Sprintf("Failed to parse target host:%T", err), zap.Error(err))
 				return
 			}
 			targetHost = req.Host
 			targetPort = "80"
 		}
-		handleHTTPRequest(client, targetHost, targetPort, buf)
+		handleHTTPRequest(ctx, client, targetHost, targetPort, buf, t)
 	}
 }
@@ -0,0 +1,75 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/models"
+	"myproxy/pkg/shared"
+	"net/http"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	if err := mlog.Init(&models.Log{Output: mlog.OutputStderr, ConsoleLevel: "fatal"}); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// clientConn records what is written to the client and whether it was
+// closed.
+type clientConn struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *clientConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDeny(t *testing.T) {
+	req, err := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		outTag     string
+		want       bool
+		wantStatus int
+	}{
+		{shared.OutboundReject, true, http.StatusForbidden},
+		{shared.OutboundBlock, true, 0},
+		{shared.OutboundDirect, false, 0},
+		{"proxy", false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.outTag, func(t *testing.T) {
+			conn := &clientConn{}
+			if got := deny(conn, req, tt.outTag, "1"); got != tt.want {
+				t.Fatalf("deny() = %v, want %v", got, tt.want)
+			}
+			if conn.closed != tt.want {
+				t.Errorf("closed = %v, want %v", conn.closed, tt.want)
+			}
+			if tt.wantStatus == 0 {
+				if conn.Len() != 0 {
+					t.Errorf("deny() answered %q", conn.String())
+				}
+				return
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(&conn.Buffer), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if id := resp.Header.Get(connIDHeader); id != "1" {
+				t.Errorf("%s = %q, want the connection ID", connIDHeader, id)
+			}
+		})
+	}
+}
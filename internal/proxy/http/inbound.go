@@ -7,19 +7,25 @@ import (
 	"fmt"
 	"go.uber.org/zap"
 	"myproxy/internal"
+	"myproxy/internal/conntrack"
 	"myproxy/internal/mlog"
 	"myproxy/internal/router"
 	"myproxy/pkg/models"
-	"myproxy/pkg/protocol"
+	"myproxy/pkg/shared"
+	"myproxy/pkg/util/id"
 	net2 "myproxy/pkg/util/net"
 	"net"
 	"net/http"
+	"strconv"
 )
 
-func Inbound(ctx context.Context, inb *models.Inbound) {
+// Inbound serves HTTP proxy requests on the port of inb until listen is done.
+// Accepted connections run under ctx. ready is called once the port is bound,
+// or with the error binding it.
+func Inbound(ctx, listen context.Context, inb *models.Inbound, ready func(error)) {
 	l, err := net.Listen("tcp", inb.AddrPort())
 	if err != nil {
-		mlog.Error(err.Error())
+		ready(err)
 		return
 	}
 	defer func(l net.Listener) {
@@ -30,87 +36,106 @@ func Inbound(ctx context.Context, inb *models.Inbound) {
 	}(l)
 
 	mlog.Info("listening TCP on " + l.Addr().String())
+	ready(nil)
+
+	stop := context.AfterFunc(listen, func() {
+		_ = l.Close()
+	})
+	defer stop()
 
 	for {
 		accept, err := l.Accept()
 		if err != nil {
+			if listen.Err() != nil {
+				return
+			}
 			mlog.Error(err.Error())
 			return
 		}
 
-		mlog.Debug("accepted TCP connection " + accept.RemoteAddr().String())
-
 		go dispatchHttp(ctx, accept, inb)
 	}
 }
 
 func dispatchHttp(ctx context.Context, client net.Conn, inb *models.Inbound) {
+	connID := id.GetSnowflakeID().String()
+	log := mlog.ForConn(connID)
+	log.Debug("accepted TCP connection " + client.RemoteAddr().String())
+
 	var buf [65536]byte
 	n, err := client.Read(buf[:])
 	if err != nil {
-		mlog.Error("Failed to read client request:", zap.Error(err))
+		log.Error("Failed to read client request:", zap.Error(err))
 		return
 	}
 
 	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
 	if err != nil {
-		mlog.Error("Failed to parse client request:", zap.Error(err))
+		log.Error("Failed to parse client request:", zap.Error(err))
 		return
 	}
 
-	host, _, err := net.SplitHostPort(req.Host)
+	host, port, err := net.SplitHostPort(req.Host)
 	if err != nil {
-		mlog.Error("Failed to parse target host:", zap.Error(err))
+		log.Error("Failed to parse target host:", zap.Error(err))
 		return
 	}
 
-	mlog.Debug(fmt.Sprintf("request to Method [%s] Host [%s] with URL [%s]", req.Method, host, req.URL))
+	log.Debug(fmt.Sprintf("request to Method [%s] Host [%s] with URL [%s]", req.Method, host, req.URL))
 
+	user, pass, ok := req.BasicAuth()
 	if inb.Setting != nil && inb.Setting.User != "" && inb.Setting.Pass != "" {
-		u, p, ok := req.BasicAuth()
-		if !ok || u != inb.Setting.User || p != inb.Setting.Pass {
-			_, _ = client.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic\r\n\r\n"))
+		if !ok || user != inb.Setting.User || pass != inb.Setting.Pass {
+			_ = writeStatus(client, "407 Proxy Authentication Required", connID, "Proxy-Authenticate: Basic\r\n")
 			_ = client.Close()
 			return
 		}
 	}
 
-	ips, err := net2.LookupIP(host)
-	if err != nil {
-		mlog.Error(err.Error())
-		return
-	}
-	if len(ips) == 0 {
-		mlog.Error("no IPs resolved for " + host)
-		return
-	}
+	dstPort, _ := strconv.ParseUint(port, 10, 16)
 
 	r := router.Router{
 		InboundTag: inb.Tag,
-		DstAddr:    ips[0],
+		Network:    shared.NetworkTCP,
+		Host:       host,
+		DstPort:    uint16(dstPort),
+		SrcAddr:    net2.AddrIP(client.RemoteAddr()),
 	}
 
 	outTag := r.Process()
 
-	if outTag == "direct" {
-		mlog.Debug(fmt.Sprintf("request %s with [direct]", req.URL))
-		handleClientRequest(buf[:n], req, client)
+	if deny(client, req, outTag, connID) {
 		return
 	}
 
-	info, ok := internal.GetOsi(outTag)
-	if !ok {
-		mlog.Error("outbound not found: " + outTag)
+	t := conntrack.Open(conntrack.Info{
+		ID:       connID,
+		Inbound:  inb.Tag,
+		User:     user,
+		Network:  shared.NetworkTCP,
+		Src:      client.RemoteAddr().String(),
+		Host:     host,
+		Outbound: outTag,
+		Rule:     r.Rule,
+	}, client)
+	defer t.Close()
+	t.AddUp(n)
+
+	if outTag == shared.OutboundDirect {
+		log.Debug(fmt.Sprintf("request %s with [direct]", req.URL))
+		ctx = net2.WithAddrs(ctx, host, r.Addrs)
+		handleClientRequest(ctx, buf[:n], req, t.Wrap(client), t)
 		return
 	}
-	remoteAddr := &models.NetAddr{Address: info.Address, Port: info.NodePort}
 
-	stream, err := protocol.StreamPool(ctx, remoteAddr)
-	if err != nil {
-		mlog.Error(err.Error())
+	info, ok := internal.GetOsi(outTag)
+	if !ok {
+		log.Error("outbound not found: " + outTag)
+		t.Fail(conntrack.ErrNoOutbound)
+		_ = writeStatus(client, statusBadGateway, connID, "")
 		return
 	}
 
-	mlog.Debug(fmt.Sprintf("request %s with [%s]", req.URL, remoteAddr.String()))
-	outboundHttp(ctx, buf[:n], client, stream)
+	log.Debug(fmt.Sprintf("request %s with [%s]", req.URL, info.NodeAddr().String()))
+	outboundHttp(ctx, buf[:n], t.Wrap(client), info, t)
 }
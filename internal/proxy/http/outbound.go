@@ -2,37 +2,26 @@ package http
 
 import (
 	"context"
-	"encoding/json"
-	"golang.org/x/net/quic"
-	"myproxy/internal/mlog"
-	"myproxy/pkg/io"
+	"io"
+	"myproxy/internal"
+	"myproxy/internal/conntrack"
+	io2 "myproxy/pkg/io"
 	"myproxy/pkg/models"
 	"myproxy/pkg/shared"
-	"net"
 )
 
-func outboundHttp(ctx context.Context, buf []byte, client net.Conn, stream *quic.Stream) {
-	i := models.InitialPacket{
+func outboundHttp(ctx context.Context, buf []byte, client io.ReadWriteCloser, info internal.OutSeverInfo, t *conntrack.Conn) {
+	stream, err := internal.OpenStream(ctx, info, &models.InitialPacket{
 		Protocol: shared.HTTP,
 		Content:  buf,
-	}
-
-	m, err := json.Marshal(i)
-	if err != nil {
-		mlog.Error(err.Error())
-		return
-	}
-
-	_, err = stream.Write(m)
+		ConnID:   t.ID(),
+	})
 	if err != nil {
-		mlog.Error(err.Error())
+		t.Fail(err)
+		t.Log().Error(err.Error())
+		_ = writeStatus(client, statusBadGateway, t.ID(), "")
 		return
 	}
-	stream.Flush()
-
-	p := io.Pipe{
-		Stream: stream,
-	}
 
-	io.Copy(&p, client)
+	io2.Copy(stream, client)
 }
@@ -5,17 +5,20 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/sagernet/sing/common/metadata"
 	"github.com/sagernet/sing/protocol/socks/socks5"
 	"go.uber.org/zap"
 	"io"
 	"myproxy/internal"
+	"myproxy/internal/conntrack"
+	"myproxy/internal/dns"
+	"myproxy/internal/metrics"
 	"myproxy/internal/mlog"
 	"myproxy/internal/router"
 	io2 "myproxy/pkg/io"
 	"myproxy/pkg/models"
-	"myproxy/pkg/protocol"
 	"myproxy/pkg/shared"
 	"myproxy/pkg/util/id"
 	net2 "myproxy/pkg/util/net"
@@ -23,14 +26,25 @@ import (
 	"net/netip"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-func Inbound(ctx context.Context, inb *models.Inbound) {
+// Inbound serves SOCKS on the TCP and UDP ports of inb until listen is done.
+// Accepted connections and UDP sessions run under ctx; the sessions are
+// adopted by the next inbound bound to the same UDP address, so a reload does
+// not end them. ready is called once both are bound, or with the error
+// binding them.
+func Inbound(ctx, listen context.Context, inb *models.Inbound, ready func(error)) {
 	udpAddr, err := net.ResolveUDPAddr("udp", inb.AddrPort())
+	if err != nil {
+		ready(err)
+		return
+	}
 
 	l, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
-		mlog.Error(err.Error())
+		ready(err)
 		return
 	}
 	defer func(l *net.UDPConn) {
@@ -42,18 +56,28 @@ func Inbound(ctx context.Context, inb *models.Inbound) {
 
 	mlog.Info("listening UDP on " + udpAddr.String())
 
-	go listenUDP(ctx, l, inb)
+	adopt(l)
+	go listenUDP(ctx, listen, l, inb)
 
 	tl, err := net.Listen("tcp", inb.AddrPort())
 	if err != nil {
-		mlog.Error("Failed to start TCP listener: " + err.Error())
+		ready(err)
 		return
 	}
 	mlog.Info("listening TCP on " + tl.Addr().String())
+	ready(nil)
+
+	stop := context.AfterFunc(listen, func() {
+		_ = tl.Close()
+	})
+	defer stop()
 
 	for {
 		client, err := tl.Accept()
 		if err != nil {
+			if listen.Err() != nil {
+				return
+			}
 			mlog.Error("Failed to accept client connection:", zap.Error(err))
 			return
 		}
@@ -62,12 +86,12 @@ func Inbound(ctx context.Context, inb *models.Inbound) {
 	}
 }
 
-func listenUDP(ctx context.Context, l *net.UDPConn, inb *models.Inbound) {
+func listenUDP(ctx, listen context.Context, l *net.UDPConn, inb *models.Inbound) {
 	defer func(l *net.UDPConn) {
-		err := l.Close()
-		if err != nil {
-			return
-		}
+		_ = l.Close()
+		time.AfterFunc(orphanTimeout, func() {
+			closeOrphans(l)
+		})
 	}(l)
 
 	buff := make([]byte, 1500)
@@ -75,17 +99,21 @@ func listenUDP(ctx context.Context, l *net.UDPConn, inb *models.Inbound) {
 	for {
 		n, addr, err := l.ReadFromUDP(buff)
 		if err != nil {
+			if listen.Err() != nil {
+				return
+			}
 			mlog.Error(err.Error())
 			return
 		}
 		mlog.Debug("client connection from " + addr.String())
 
-		data := buff[:n]
+		// Datagrams are queued to their session, so each gets its own copy.
+		data := bytes.Clone(buff[:n])
+		key := addr.Network() + addr.String()
 
-		value, ok := hm.Load(addr.Network() + addr.String())
+		value, ok := hm.Load(key)
 		if ok {
-			work := value.(*Work)
-			work.Input <- data
+			value.(*Work).send(data)
 			continue
 		}
 
@@ -93,112 +121,169 @@ func listenUDP(ctx context.Context, l *net.UDPConn, inb *models.Inbound) {
 			if len(data) < 10 {
 				continue
 			}
-			addrOffset := 4
-			portOffset := 8
-
-			ip := net.IP(data[addrOffset : addrOffset+net.IPv4len])
-
-			portBytes := data[portOffset : portOffset+2]
-			port := int(portBytes[0])<<8 + int(portBytes[1])
-
-			dstAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip.String(), port))
-			if err != nil {
-				mlog.Error(err.Error())
-				continue
-			}
 
 			work := &Work{
 				ID:      id.GetSnowflakeID().String(),
 				SrcAddr: addr,
-				DstAddr: dstAddr,
 				Input:   make(chan []byte, 1024),
 				Output:  make(chan []byte, 1024),
-				SrcConn: l,
-				Key:     addr.Network() + addr.String(),
+				Key:     key,
+				done:    make(chan struct{}),
+				unfaked: make(map[[4]byte]net.IP),
 			}
+			work.src.Store(l)
 
-			r := router.Router{
-				InboundTag: inb.Tag,
-				DstAddr:    ip,
-			}
+			// Opening the session may resolve a fake destination and dial the
+			// outbound, so it is left to its own goroutine. Datagrams of the
+			// same client queue up in the meantime.
+			hm.Store(key, work)
+			go work.open(ctx, inb, data)
+		}
+	}
+}
 
-			outTag := r.Process()
+// orphanTimeout is how long the sessions of a closed UDP listener wait for a
+// new listener on the same address before they are closed.
+const orphanTimeout = 5 * time.Second
+
+// adopt moves the sessions of a closed listener bound to the same address as
+// l over to l, so their replies are sent from l.
+func adopt(l *net.UDPConn) {
+	local := l.LocalAddr().String()
+	hm.Range(func(_, value any) bool {
+		w := value.(*Work)
+		if w.src.Load().LocalAddr().String() == local {
+			w.src.Store(l)
+		}
+		return true
+	})
+}
 
-			if outTag == "direct" {
-				data = data[10:]
-				mlog.Debug("request udp to " + dstAddr.String())
+// closeOrphans closes the sessions still replying through l, which was closed
+// and not replaced.
+func closeOrphans(l *net.UDPConn) {
+	hm.Range(func(_, value any) bool {
+		w := value.(*Work)
+		if w.src.Load() == l {
+			conntrack.Kill(w.ID)
+		}
+		return true
+	})
+}
 
-				udp, err := net.DialUDP("udp", nil, dstAddr)
-				if err != nil {
-					mlog.Error(err.Error())
-					continue
-				}
+// open routes the session by its first datagram, data, connects it and then
+// relays datagrams until the session ends. A session that cannot be opened is
+// dropped, so the next datagram of the client tries again.
+func (w *Work) open(ctx context.Context, inb *models.Inbound, data []byte) {
+	log := mlog.ForConn(w.ID)
+	host := w.unfake(data)
 
-				work.DstConn = udp
-			}
+	addrOffset := 4
+	portOffset := 8
 
-			if work.DstConn == nil {
-				info, ok := internal.GetOsi(outTag)
-				if !ok {
-					mlog.Error("outbound not found: " + outTag)
-					continue
-				}
-				remoteAddr := &models.NetAddr{Address: info.Address, Port: info.NodePort}
+	ip := net.IP(data[addrOffset : addrOffset+net.IPv4len])
 
-				stream, err := protocol.StreamPool(ctx, remoteAddr)
-				if err != nil {
-					mlog.Error(err.Error())
-					continue
-				}
+	portBytes := data[portOffset : portOffset+2]
+	port := int(portBytes[0])<<8 + int(portBytes[1])
 
-				mlog.Debug("request udp to " + dstAddr.String() + " by " + remoteAddr.String())
+	dstAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip.String(), port))
+	if err != nil {
+		log.Error(err.Error())
+		hm.Delete(w.Key)
+		return
+	}
+	w.DstAddr = dstAddr
+
+	r := router.Router{
+		InboundTag: inb.Tag,
+		Network:    shared.NetworkUDP,
+		Host:       host,
+		DstAddr:    ip,
+		DstPort:    uint16(port),
+		SrcAddr:    w.SrcAddr.IP,
+	}
+	if host == "" {
+		host = ip.String()
+	}
 
-				i := models.InitialPacket{
-					Protocol: shared.SOCKS,
-					Request: &models.Request{
-						Network: shared.NetworkUDP,
-						ID:      work.ID,
-					},
-				}
+	outTag := r.Process()
 
-				payload, err := json.Marshal(i)
-				if err != nil {
-					mlog.Error(err.Error())
-					continue
-				}
+	if outTag == shared.OutboundBlock || outTag == shared.OutboundReject {
+		log.Debug("drop udp to " + dstAddr.String() + " by " + outTag)
+		hm.Delete(w.Key)
+		return
+	}
 
-				_, err = stream.Write(payload)
-				if err != nil {
-					mlog.Error(err.Error())
-					continue
-				}
-				stream.Flush()
+	if outTag == shared.OutboundDirect {
+		data = data[10:]
+		log.Debug("request udp to " + dstAddr.String())
 
-				p := io2.Pipe{
-					Stream: stream,
-				}
+		udp, err := net.DialUDP("udp", nil, dstAddr)
+		if err != nil {
+			log.Error(err.Error())
+			hm.Delete(w.Key)
+			return
+		}
 
-				work.DstConn = &p
-			}
+		w.DstConn = udp
+	}
 
-			mlog.Debug(fmt.Sprintf("write to %s with %d bytes", dstAddr.String(), n))
+	if w.DstConn == nil {
+		info, ok := internal.GetOsi(outTag)
+		if !ok {
+			log.Error("outbound not found: " + outTag)
+			hm.Delete(w.Key)
+			return
+		}
 
-			hm.Store(addr.Network()+addr.String(), work)
+		log.Debug("request udp to " + dstAddr.String() + " by " + info.NodeAddr().String())
 
-			go work.Write()
-			go work.Read()
-			work.Input <- data
+		stream, err := internal.OpenStream(ctx, info, &models.InitialPacket{
+			Protocol: shared.SOCKS,
+			Request: &models.Request{
+				Network: shared.NetworkUDP,
+				ID:      w.ID,
+			},
+			ConnID: w.ID,
+		})
+		if err != nil {
+			log.Error(err.Error())
+			hm.Delete(w.Key)
+			return
 		}
+
+		w.DstConn = stream
 	}
+
+	log.Debug(fmt.Sprintf("write to %s with %d bytes", dstAddr.String(), len(data)))
+
+	w.Track = conntrack.Open(conntrack.Info{
+		ID:       w.ID,
+		Inbound:  inb.Tag,
+		Network:  shared.NetworkUDP,
+		Src:      w.SrcAddr.String(),
+		Host:     host,
+		Outbound: outTag,
+		Rule:     r.Rule,
+	}, w.DstConn)
+
+	metrics.UDPSessions.With(udpSideInbound).Inc()
+
+	go w.Read()
+	w.Write(data)
 }
 
 func handSocks(ctx context.Context, conn net.Conn, localAddr *net.UDPAddr, inb *models.Inbound) {
+	connID := id.GetSnowflakeID().String()
+	log := mlog.ForConn(connID)
+
 	authRequest, err := socks5.ReadAuthRequest(conn)
 	if err != nil {
 		return
 	}
 
 	var supportAuth bool
+	var user string
 	for _, m := range authRequest.Methods {
 		if m == 0x02 {
 			supportAuth = true
@@ -216,6 +301,8 @@ func handSocks(ctx context.Context, conn net.Conn, localAddr *net.UDPAddr, inb *
 			return
 		}
 
+		user = request.Username
+
 		if inb.Setting != nil && inb.Setting.User != "" && inb.Setting.Pass != "" {
 			if request.Username != inb.Setting.User || request.Password != inb.Setting.Pass {
 				err := socks5.WriteUsernamePasswordAuthResponse(conn, socks5.UsernamePasswordAuthResponse{
@@ -251,43 +338,54 @@ func handSocks(ctx context.Context, conn net.Conn, localAddr *net.UDPAddr, inb *
 	}
 
 	if request.Command == 1 {
-		ips, err := net2.LookupIP(request.Destination.AddrString())
-		if err != nil {
-			mlog.Error(err.Error())
-			return
-		}
-		if len(ips) == 0 {
-			mlog.Error("no IPs resolved for " + request.Destination.AddrString())
-			return
-		}
-
+		request.Destination = unfake(request.Destination)
 		r := router.Router{
 			InboundTag: inb.Tag,
-			DstAddr:    ips[0],
+			Network:    shared.NetworkTCP,
+			Host:       request.Destination.AddrString(),
+			DstPort:    request.Destination.Port,
+			SrcAddr:    net2.AddrIP(conn.RemoteAddr()),
 		}
 
 		outTag := r.Process()
 
-		if outTag == "direct" {
-			directTcp(request, conn)
+		if deny(conn, request, outTag, connID) {
+			return
+		}
+
+		t := conntrack.Open(conntrack.Info{
+			ID:       connID,
+			Inbound:  inb.Tag,
+			User:     user,
+			Network:  shared.NetworkTCP,
+			Src:      conn.RemoteAddr().String(),
+			Host:     request.Destination.AddrString(),
+			Outbound: outTag,
+			Rule:     r.Rule,
+		}, conn)
+		defer t.Close()
+
+		if outTag == shared.OutboundDirect {
+			ctx = net2.WithAddrs(ctx, r.Host, r.Addrs)
+			directTcp(ctx, request, t.Wrap(conn), t)
 			return
 		}
 
 		info, ok := internal.GetOsi(outTag)
 		if !ok {
-			mlog.Error("outbound not found: " + outTag)
+			log.Error("outbound not found: " + outTag)
+			t.Fail(conntrack.ErrNoOutbound)
 			return
 		}
-		remoteAddr := &models.NetAddr{Address: info.Address, Port: info.NodePort}
 
-		outTcp(ctx, request, conn, remoteAddr)
+		outTcp(ctx, request, t.Wrap(conn), info, t)
 	} else if request.Command == 3 {
 		err = socks5.WriteResponse(conn, socks5.Response{ReplyCode: socks5.ReplyCodeSuccess, Bind: metadata.Socksaddr{
 			Addr: netip.AddrFrom4(localAddr.AddrPort().Addr().As4()),
 			Port: uint16(localAddr.Port),
 		}})
 		if err != nil {
-			mlog.Error("Failed to write SOCKS5 UDP ASSOCIATE response:", zap.Error(err))
+			log.Error("Failed to write SOCKS5 UDP ASSOCIATE response:", zap.Error(err))
 			return
 		}
 		err := conn.Close()
@@ -297,47 +395,107 @@ func handSocks(ctx context.Context, conn net.Conn, localAddr *net.UDPAddr, inb *
 	}
 }
 
-func outTcp(ctx context.Context, req socks5.Request, conn io.ReadWriteCloser, remoteAddr *models.NetAddr) {
-	mlog.Debug("request tcp to " + req.Destination.String() + " by " + remoteAddr.String())
+// unfake replaces a fake destination address handed out by a dns inbound
+// with the name it stands for, so the connection is routed and dialed by
+// name.
+func unfake(dst metadata.Socksaddr) metadata.Socksaddr {
+	if !dst.IsIP() {
+		return dst
+	}
+	host, ok := dns.FakeDomain(dst.Addr.AsSlice())
+	if !ok {
+		return dst
+	}
+	return metadata.Socksaddr{Fqdn: host, Port: dst.Port}
+}
+
+// unfake replaces a fake destination address in the header of a UDP request
+// with an IPv4 address of the name it stands for, and returns the name.
+// Datagrams carry no name past the inbound, so it is resolved here, once per
+// session and address.
+func (w *Work) unfake(data []byte) string {
+	// The fourth byte of the header is the address type, 1 for IPv4.
+	if len(data) < 10 || data[3] != 1 {
+		return ""
+	}
+	host, ok := dns.FakeDomain(data[4:8])
+	if !ok {
+		return ""
+	}
+
+	fake := [4]byte(data[4:8])
+	ip, ok := w.unfaked[fake]
+	if !ok {
+		ip = lookupIPv4(host)
+		w.unfaked[fake] = ip
+	}
+	if ip != nil {
+		copy(data[4:8], ip)
+	}
+	return host
+}
 
-	stream, err := protocol.StreamPool(ctx, remoteAddr)
+func lookupIPv4(host string) net.IP {
+	ips, err := net2.LookupIP(host)
 	if err != nil {
 		mlog.Error(err.Error())
-		return
+		return nil
+	}
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
 	}
+	mlog.Error("no IPv4 address resolved for " + host)
+	return nil
+}
 
-	i := models.InitialPacket{
+func outTcp(ctx context.Context, req socks5.Request, conn io.ReadWriteCloser, info internal.OutSeverInfo, t *conntrack.Conn) {
+	t.Log().Debug("request tcp to " + req.Destination.String() + " by " + info.NodeAddr().String())
+
+	stream, err := internal.OpenStream(ctx, info, &models.InitialPacket{
 		Protocol: shared.SOCKS,
 		Request: &models.Request{
 			Network: shared.NetworkTCP,
 			Dst:     req.Destination,
 		},
-	}
-
-	payload, err := json.Marshal(i)
+		ConnID: t.ID(),
+	})
 	if err != nil {
-		mlog.Error(err.Error())
+		t.Fail(err)
+		t.Log().Error(err.Error())
 		return
 	}
 
-	_, err = stream.Write(payload)
-	if err != nil {
-		mlog.Error(err.Error())
-		return
-	}
-	stream.Flush()
+	io2.Copy(stream, conn)
+}
 
-	p := io2.Pipe{
-		Stream: stream,
+// deny closes conn when outTag is the block or reject outbound. Reject first
+// answers the client with ReplyCodeNotAllowed, block drops it silently.
+func deny(conn io.ReadWriteCloser, req socks5.Request, outTag, connID string) bool {
+	log := mlog.ForConn(connID)
+	switch outTag {
+	case shared.OutboundReject:
+		err := socks5.WriteResponse(conn, socks5.Response{ReplyCode: socks5.ReplyCodeNotAllowed})
+		if err != nil {
+			log.Error("Failed to write SOCKS5 request response:", zap.Error(err))
+		}
+	case shared.OutboundBlock:
+	default:
+		return false
 	}
 
-	io2.Copy(&p, conn)
+	log.Debug("request tcp to " + req.Destination.String() + " " + outTag)
+
+	_ = conn.Close()
+	return true
 }
 
-func directTcp(req socks5.Request, conn io.ReadWriteCloser) {
-	targetConn, err := net.Dial("tcp", req.Destination.String())
+func directTcp(ctx context.Context, req socks5.Request, conn io.ReadWriteCloser, t *conntrack.Conn) {
+	targetConn, err := net2.DialContext(ctx, "tcp", req.Destination.String())
 	if err != nil {
-		mlog.Error(err.Error())
+		t.Fail(err)
+		t.Log().Error(err.Error())
 		return
 	}
 	defer func(targetConn net.Conn) {
@@ -346,12 +504,13 @@ func directTcp(req socks5.Request, conn io.ReadWriteCloser) {
 			return
 		}
 	}(targetConn)
+	t.SetRemote(targetConn.RemoteAddr())
 
-	mlog.Debug("request tcp to " + req.Destination.String() + " direct")
+	t.Log().Debug("request tcp to " + req.Destination.String() + " direct")
 
 	err = socks5.WriteResponse(conn, socks5.Response{ReplyCode: socks5.ReplyCodeSuccess})
 	if err != nil {
-		mlog.Error("Failed to write SOCKS5 request response:", zap.Error(err))
+		t.Log().Error("Failed to write SOCKS5 request response:", zap.Error(err))
 		return
 	}
 
@@ -364,57 +523,89 @@ type Work struct {
 	DstAddr *net.UDPAddr
 	Input   chan []byte
 	Output  chan []byte
-	SrcConn *net.UDPConn
 	DstConn io.ReadWriteCloser
 	Key     string
+	Track   *conntrack.Conn
+
+	// src is the listener replies are sent from. It is swapped when a new
+	// listener adopts the session.
+	src atomic.Pointer[net.UDPConn]
+
+	// done is closed when Read returns. Input is never closed, so sending
+	// to a session that ended cannot panic.
+	done chan struct{}
+
+	// unfaked holds the addresses fake destinations were resolved to. It is
+	// only used by the goroutine writing to DstConn.
+	unfaked map[[4]byte]net.IP
+}
+
+// send queues data for the session, dropping it when the session is behind
+// or has ended, so the read loop of the inbound never blocks.
+func (w *Work) send(data []byte) {
+	select {
+	case w.Input <- data:
+	default:
+	}
 }
 
-func (w *Work) Write() {
-	defer hm.Delete(w.Key)
+// Write writes first and then the queued datagrams to DstConn.
+func (w *Work) Write(first []byte) {
+	defer func() {
+		hm.Delete(w.Key)
+		metrics.UDPSessions.With(udpSideInbound).Dec()
+	}()
 	defer close(w.Output)
-	defer func(DstConn io.ReadWriteCloser) {
-		err := DstConn.Close()
+	defer func(Track *conntrack.Conn) {
+		err := Track.Close()
 		if err != nil {
 			return
 		}
-	}(w.DstConn)
+	}(w.Track)
+
+	_, err := w.DstConn.Write(first)
+	if err != nil {
+		w.Track.Log().Error(err.Error())
+		return
+	}
+	w.Track.AddUp(len(first))
 
 	for {
 		select {
-		case v, ok := <-w.Input:
-			if !ok {
-				return
-			}
-
+		case <-w.done:
+			return
+		case v := <-w.Input:
+			w.unfake(v)
 			_, err := w.DstConn.Write(v)
 			if err != nil {
-				mlog.Error(err.Error())
+				w.Track.Log().Error(err.Error())
 				return
 			}
+			w.Track.AddUp(len(v))
 		}
 	}
 }
 
 func (w *Work) Read() {
-	defer close(w.Input)
+	defer close(w.done)
 
 	buff := make([]byte, 1500)
 
 	for {
 		n, err := w.DstConn.Read(buff)
 		if err != nil {
-			mlog.Error(err.Error())
+			w.Track.Log().Error(err.Error())
 			return
 		}
 		var p models.Packet
 
 		err = json.Unmarshal(buff[:n], &p)
 		if err != nil {
-			mlog.Error(err.Error())
+			w.Track.Log().Error(err.Error())
 			continue
 		}
 
-		mlog.Debug("back response with " + strconv.Itoa(len(p.Content)) + "bytes")
+		w.Track.Log().Debug("back response with " + strconv.Itoa(len(p.Content)) + "bytes")
 		buffer := bytes.NewBuffer([]byte{0, 0, 0, 1})
 
 		ipBytes := p.Addr.IP.To4()
@@ -425,14 +616,26 @@ func (w *Work) Read() {
 		buffer.Write(portBytes)
 		buffer.Write(p.Content)
 
-		_, err = w.SrcConn.WriteToUDP(buffer.Bytes(), w.SrcAddr)
+		_, err = w.src.Load().WriteToUDP(buffer.Bytes(), w.SrcAddr)
+		if errors.Is(err, net.ErrClosed) {
+			// The listener is being replaced; drop the reply.
+			continue
+		}
 		if err != nil {
-			mlog.Error(err.Error())
+			w.Track.Log().Error(err.Error())
 			return
 		}
+		w.Track.AddDown(len(p.Content))
 	}
 }
 
 var (
 	hm sync.Map
 )
+
+// Sides of the UDP sessions gauge: hm holds the sessions of the socks
+// inbound, dstHm those of streams accepted by the endpoint.
+const (
+	udpSideInbound  = "inbound"
+	udpSideEndpoint = "endpoint"
+)
@@ -0,0 +1,141 @@
+package socks
+
+import (
+	"bytes"
+	"github.com/sagernet/sing/common/metadata"
+	"github.com/sagernet/sing/protocol/socks/socks5"
+	"myproxy/internal/conntrack"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/models"
+	"myproxy/pkg/shared"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	if err := mlog.Init(&models.Log{Output: mlog.OutputStderr, ConsoleLevel: "fatal"}); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// clientConn records what is written to the client and whether it was
+// closed.
+type clientConn struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (c *clientConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestDeny(t *testing.T) {
+	req := socks5.Request{Command: socks5.CommandConnect, Destination: metadata.ParseSocksaddr("192.0.2.1:443")}
+	tests := []struct {
+		outTag    string
+		want      bool
+		wantReply bool
+	}{
+		{shared.OutboundReject, true, true},
+		{shared.OutboundBlock, true, false},
+		{shared.OutboundDirect, false, false},
+		{"proxy", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.outTag, func(t *testing.T) {
+			conn := &clientConn{}
+			if got := deny(conn, req, tt.outTag, "1"); got != tt.want {
+				t.Fatalf("deny() = %v, want %v", got, tt.want)
+			}
+			if conn.closed != tt.want {
+				t.Errorf("closed = %v, want %v", conn.closed, tt.want)
+			}
+			if !tt.wantReply {
+				if conn.Len() != 0 {
+					t.Errorf("deny() answered %x", conn.Bytes())
+				}
+				return
+			}
+			resp, err := socks5.ReadResponse(&conn.Buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.ReplyCode != socks5.ReplyCodeNotAllowed {
+				t.Errorf("reply code = %d, want %d", resp.ReplyCode, socks5.ReplyCodeNotAllowed)
+			}
+		})
+	}
+}
+
+func TestAdopt(t *testing.T) {
+	old, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Work{ID: "1", Key: "adopt"}
+	w.src.Store(old)
+	hm.Store(w.Key, w)
+	defer hm.Delete(w.Key)
+
+	addr := old.LocalAddr().(*net.UDPAddr)
+	_ = old.Close()
+	l, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	adopt(l)
+	if w.src.Load() != l {
+		t.Fatal("session not adopted by the listener on the same address")
+	}
+
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	adopt(other)
+	if w.src.Load() != l {
+		t.Error("session adopted by a listener on another address")
+	}
+}
+
+// discard is a destination that accepts every datagram.
+type discard struct{}
+
+func (discard) Read([]byte) (int, error)    { select {} }
+func (discard) Write(b []byte) (int, error) { return len(b), nil }
+func (discard) Close() error                { return nil }
+
+func TestSendAfterEnd(t *testing.T) {
+	w := &Work{
+		ID:      "2",
+		Key:     "ended",
+		Input:   make(chan []byte, 1),
+		Output:  make(chan []byte, 1),
+		DstConn: discard{},
+		done:    make(chan struct{}),
+	}
+	w.Track = conntrack.Open(conntrack.Info{ID: w.ID}, w.DstConn)
+
+	wrote := make(chan struct{})
+	go func() {
+		w.Write([]byte("first"))
+		close(wrote)
+	}()
+	close(w.done)
+	select {
+	case <-wrote:
+	case <-time.After(time.Second):
+		t.Fatal("Write did not return after the session ended")
+	}
+
+	// Datagrams still arriving for the session are dropped.
+	w.send([]byte("late"))
+	w.send([]byte("late"))
+}
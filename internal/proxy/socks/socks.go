@@ -1,95 +1,125 @@
 package socks
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/sagernet/sing/protocol/socks/socks5"
 	"golang.org/x/net/quic"
 	"myproxy/internal"
+	"myproxy/internal/auth"
+	"myproxy/internal/conntrack"
+	"myproxy/internal/metrics"
 	"myproxy/internal/mlog"
 	"myproxy/internal/router"
 	"myproxy/pkg/io"
 	"myproxy/pkg/models"
-	"myproxy/pkg/protocol"
 	"myproxy/pkg/shared"
 	net2 "myproxy/pkg/util/net"
 	"net"
 	"sync"
 )
 
-func Process(ctx context.Context, r *models.Request, stream *quic.Stream) {
+// Process serves a socks request tunneled to the endpoint. connID is the ID
+// the client gave the connection.
+func Process(ctx context.Context, connID string, r *models.Request, stream *quic.Stream) {
+	log := mlog.ForConn(connID)
 	switch r.Network {
 	case shared.NetworkTCP:
 		request := socks5.Request{
 			Destination: r.Dst,
 		}
 
-		ips, err := net2.LookupIP(r.Dst.AddrString())
-		if err != nil {
-			mlog.Error(err.Error())
-			return
+		route := router.Router{
+			Network: shared.NetworkTCP,
+			Host:    r.Dst.AddrString(),
+			DstPort: r.Dst.Port,
+			User:    auth.User(ctx),
 		}
-		if len(ips) == 0 {
-			mlog.Error("no IPs resolved for " + r.Dst.AddrString())
-			return
-		}
-
-		route := router.Router{DstAddr: ips[0]}
 		outTag := route.Process()
 
-		if outTag == "direct" {
-			p := io.Pipe{
-				Stream: stream,
-			}
+		if deny(&io.Pipe{Stream: stream}, request, outTag, connID) {
+			return
+		}
 
-			directTcp(request, &p)
+		p := io.Pipe{Stream: stream}
+
+		t := conntrack.Open(conntrack.Info{
+			ID:       connID,
+			User:     auth.User(ctx),
+			Network:  shared.NetworkTCP,
+			Host:     r.Dst.AddrString(),
+			Outbound: outTag,
+			Rule:     route.Rule,
+		}, &p)
+		defer t.Close()
+
+		if outTag == shared.OutboundDirect {
+			ctx = net2.WithAddrs(ctx, route.Host, route.Addrs)
+			directTcp(ctx, request, t.Wrap(&p), t)
 		} else {
 			info, ok := internal.GetOsi(outTag)
 			if !ok {
-				mlog.Error("outbound not found: " + outTag)
+				log.Error("outbound not found: " + outTag)
+				t.Fail(conntrack.ErrNoOutbound)
 				return
 			}
-			remoteAddr := &models.NetAddr{Address: info.Address, Port: info.NodePort}
-
-			p := io.Pipe{Stream: stream}
 
-			outTcp(ctx, request, &p, remoteAddr)
+			outTcp(ctx, request, t.Wrap(&p), info, t)
 		}
 		break
 	case shared.NetworkUDP:
-		route := router.Router{}
-		outTag := route.Process()
-
-		if outTag == "direct" {
-			l, err := net.ListenUDP(r.Network, &net.UDPAddr{Port: int(net2.GetFreePort())})
-			if err != nil {
-				mlog.Error(err.Error())
-				return
-			}
+		// The session has no destination of its own: each destination is
+		// routed as its datagrams arrive.
+		t := conntrack.Open(conntrack.Info{
+			ID:      connID,
+			User:    auth.User(ctx),
+			Network: shared.NetworkUDP,
+		}, stream)
+		defer t.Close()
 
-			_, err = stream.Write([]byte("OK"))
-			if err != nil {
-				mlog.Error(err.Error())
-				return
-			}
-			stream.Flush()
+		l, err := net.ListenUDP(r.Network, &net.UDPAddr{Port: int(net2.GetFreePort())})
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+		defer func(l *net.UDPConn) {
+			_ = l.Close()
+		}(l)
 
-			handleStreamDirect(stream, l, r.ID)
-		} else {
-			handleStreamOut(ctx, stream, outTag, r.ID)
+		_, err = stream.Write([]byte("OK"))
+		if err != nil {
+			log.Error(err.Error())
+			return
 		}
+		stream.Flush()
+
+		handleStream(ctx, stream, l, r.ID, auth.User(ctx), t)
 		break
 	}
 }
 
-func handleStreamDirect(stream *quic.Stream, l *net.UDPConn, id string) {
+// handleStream relays the datagrams of a UDP stream. Each destination is
+// routed the first time it is seen: datagrams to destinations routed direct
+// are sent from l, those routed to another outbound are forwarded through a
+// stream to it, and those routed to block or reject are dropped.
+func handleStream(ctx context.Context, stream *quic.Stream, l *net.UDPConn, id, user string, t *conntrack.Conn) {
 	buff := make([]byte, 1500)
+	routes := make(map[string]string)
+	outs := make(map[string]*io.Pipe)
+	defer func() {
+		for _, out := range outs {
+			if out != nil {
+				_ = out.Close()
+			}
+		}
+	}()
 
 	for {
 		n, err := stream.Read(buff)
 		if err != nil {
-			mlog.Error(err.Error())
+			t.Log().Error(err.Error())
 			return
 		}
 
@@ -109,84 +139,131 @@ func handleStreamDirect(stream *quic.Stream, l *net.UDPConn, id string) {
 
 			dstAddr, err := net.ResolveUDPAddr("udp", fmt.Sprintf("%s:%d", ip.String(), port))
 			if err != nil {
-				mlog.Error(err.Error())
+				t.Log().Error(err.Error())
+				continue
+			}
+
+			outTag, seen := routes[dstAddr.String()]
+			if !seen {
+				outTag = routeUDP(dstAddr, user)
+				routes[dstAddr.String()] = outTag
+				t.Log().Debug("route udp to " + dstAddr.String() + " by " + outTag)
+			}
+
+			switch outTag {
+			case shared.OutboundBlock, shared.OutboundReject:
+				continue
+			case shared.OutboundDirect:
+			default:
+				out, opened := outs[outTag]
+				if !opened {
+					out = forwardUDP(ctx, stream, outTag, id, t)
+					outs[outTag] = out
+				}
+				// Datagrams to an outbound that cannot be reached are dropped.
+				if out == nil {
+					continue
+				}
+				if _, err = out.Write(data); err != nil {
+					t.Log().Error(err.Error())
+					_ = out.Close()
+					outs[outTag] = nil
+					continue
+				}
+				out.Flush()
+				t.AddUp(len(data) - 10)
 				continue
 			}
+
 			data = data[10:]
+			t.AddUp(len(data))
 
-			mlog.Debug("request udp to " + dstAddr.String())
-			mlog.Debug(fmt.Sprintf("write to %s with %d bytes", dstAddr.String(), n))
+			t.Log().Debug("request udp to " + dstAddr.String())
+			t.Log().Debug(fmt.Sprintf("write to %s with %d bytes", dstAddr.String(), n))
+
+			// Datagrams are queued to their session, so each gets its own
+			// copy.
+			data = bytes.Clone(data)
 
 			value, ok := dstHm.Load(id + dstAddr.String())
 			if ok {
-				work := value.(*DstWork)
-				work.Input <- data
+				value.(*DstWork).send(data)
 				continue
 			}
 
 			work := &DstWork{
 				ID:      id,
 				Input:   make(chan []byte, 1024),
+				done:    make(chan struct{}),
 				UDPConn: l,
 				Stream:  stream,
 				Dst:     dstAddr,
 				Key:     id + dstAddr.String(),
+				Track:   t,
 			}
 
 			go work.write()
 			go work.read()
 			dstHm.Store(id+dstAddr.String(), work)
+			metrics.UDPSessions.With(udpSideEndpoint).Inc()
 
-			work.Input <- data
+			work.send(data)
 		}
 	}
 }
 
-func handleStreamOut(ctx context.Context, src *quic.Stream, outTag, id string) {
+// routeUDP returns the outbound datagrams to dst are routed to.
+func routeUDP(dst *net.UDPAddr, user string) string {
+	route := router.Router{
+		Network: shared.NetworkUDP,
+		DstAddr: dst.IP,
+		DstPort: uint16(dst.Port),
+		User:    user,
+	}
+	return route.Process()
+}
+
+// forwardUDP opens a UDP stream to the node of outTag and relays its replies
+// to src. It returns nil when the outbound cannot be reached.
+func forwardUDP(ctx context.Context, src *quic.Stream, outTag, id string, t *conntrack.Conn) *io.Pipe {
 	info, ok := internal.GetOsi(outTag)
 	if !ok {
-		mlog.Error("outbound not found: " + outTag)
-		return
+		t.Log().Error("outbound not found: " + outTag)
+		return nil
 	}
-	remoteAddr := &models.NetAddr{Address: info.Address, Port: info.NodePort}
 
-	newStream, err := protocol.StreamPool(ctx, remoteAddr)
-	if err != nil {
-		mlog.Error(err.Error())
-		return
-	}
-	defer func(newStream *quic.Stream) {
-		err := newStream.Close()
-		if err != nil {
-			return
-		}
-	}(newStream)
-
-	i := models.InitialPacket{
+	out, err := internal.OpenStream(ctx, info, &models.InitialPacket{
 		Protocol: shared.SOCKS,
 		Request: &models.Request{
 			Network: shared.NetworkUDP,
 			ID:      id,
 		},
-	}
-
-	payload, err := json.Marshal(i)
-	if err != nil {
-		mlog.Error(err.Error())
-		return
-	}
-
-	_, err = newStream.Write(payload)
+		ConnID: t.ID(),
+	})
 	if err != nil {
-		mlog.Error(err.Error())
-		return
+		t.Log().Error(err.Error())
+		return nil
 	}
-	newStream.Flush()
 
-	input := io.Pipe{Stream: src}
-	output := io.Pipe{Stream: newStream}
-
-	io.Copy(&output, &input)
+	go func() {
+		buff := make([]byte, 1500)
+		for {
+			n, err := out.Read(buff)
+			if err != nil {
+				return
+			}
+			// The node acknowledges the stream as this endpoint did.
+			if string(buff[:n]) == "OK" {
+				continue
+			}
+			if _, err = src.Write(buff[:n]); err != nil {
+				return
+			}
+			src.Flush()
+			t.AddDown(n)
+		}
+	}()
+	return out
 }
 
 var dstHm sync.Map
@@ -198,10 +275,27 @@ type DstWork struct {
 	Stream  *quic.Stream
 	Dst     *net.UDPAddr
 	Key     string
+	Track   *conntrack.Conn
+
+	// done is closed when read returns. Input is never closed, so sending
+	// to a session that ended cannot panic.
+	done chan struct{}
+}
+
+// send queues data for the session, dropping it when the session is behind
+// or has ended.
+func (d *DstWork) send(data []byte) {
+	select {
+	case d.Input <- data:
+	default:
+	}
 }
 
 func (d *DstWork) write() {
-	defer dstHm.Delete(d.Key)
+	defer func() {
+		dstHm.Delete(d.Key)
+		metrics.UDPSessions.With(udpSideEndpoint).Dec()
+	}()
 	defer func(UDPConn *net.UDPConn) {
 		err := UDPConn.Close()
 		if err != nil {
@@ -217,14 +311,12 @@ func (d *DstWork) write() {
 
 	for {
 		select {
-		case v, ok := <-d.Input:
-			if !ok {
-				return
-			}
-
+		case <-d.done:
+			return
+		case v := <-d.Input:
 			_, err := d.UDPConn.WriteToUDP(v, d.Dst)
 			if err != nil {
-				mlog.Error(err.Error())
+				d.Track.Log().Error(err.Error())
 				return
 			}
 		}
@@ -232,14 +324,14 @@ func (d *DstWork) write() {
 }
 
 func (d *DstWork) read() {
-	defer close(d.Input)
+	defer close(d.done)
 
 	buff := make([]byte, 1500)
 
 	for {
 		n, addr, err := d.UDPConn.ReadFromUDP(buff)
 		if err != nil {
-			mlog.Error(err.Error())
+			d.Track.Log().Error(err.Error())
 			return
 		}
 
@@ -250,14 +342,15 @@ func (d *DstWork) read() {
 
 		m, err := json.Marshal(&p)
 		if err != nil {
-			mlog.Error(err.Error())
+			d.Track.Log().Error(err.Error())
 			continue
 		}
 		_, err = d.Stream.Write(m)
 		if err != nil {
-			mlog.Error(err.Error())
+			d.Track.Log().Error(err.Error())
 			return
 		}
 		d.Stream.Flush()
+		d.Track.AddDown(n)
 	}
 }
@@ -0,0 +1,68 @@
+package router
+
+import "net/netip"
+
+// cidrTree is a binary prefix tree holding IPv4 and IPv6 prefixes. Lookups
+// cost at most one step per address bit regardless of the number of prefixes.
+type cidrTree struct {
+	v4   cidrNode
+	v6   cidrNode
+	size int
+}
+
+type cidrNode struct {
+	child [2]*cidrNode
+	end   bool
+}
+
+func (t *cidrTree) insert(p netip.Prefix) {
+	addr := p.Addr().Unmap()
+	root := &t.v6
+	if addr.Is4() {
+		root = &t.v4
+	}
+	bits := p.Bits()
+	if p.Addr().Is4In6() {
+		// parsePrefix rejects mapped prefixes shorter than /96, which
+		// would otherwise cover all of IPv4.
+		if bits < 96 {
+			return
+		}
+		bits -= 96
+	}
+
+	b := addr.AsSlice()
+	cur := root
+	for i := 0; i < bits; i++ {
+		if cur.end {
+			break
+		}
+		bit := b[i/8] >> (7 - i%8) & 1
+		if cur.child[bit] == nil {
+			cur.child[bit] = &cidrNode{}
+		}
+		cur = cur.child[bit]
+	}
+	cur.end = true
+	t.size++
+}
+
+func (t *cidrTree) contains(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	cur := &t.v6
+	if addr.Is4() {
+		cur = &t.v4
+	}
+
+	b := addr.AsSlice()
+	for i := 0; i < len(b)*8; i++ {
+		if cur.end {
+			return true
+		}
+		cur = cur.child[b[i/8]>>(7-i%8)&1]
+		if cur == nil {
+			return false
+		}
+	}
+	return cur.end
+}
@@ -0,0 +1,70 @@
+package router
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestCIDRTree(t *testing.T) {
+	var tree cidrTree
+	for _, p := range []string{"10.0.0.0/8", "10.1.0.0/16", "192.0.2.128/25", "2001:db8::/32", "fe80::1/128"} {
+		tree.insert(netip.MustParsePrefix(p))
+	}
+	if tree.size != 5 {
+		t.Errorf("size = %d, want 5", tree.size)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.0.0.0", true},
+		{"10.255.255.255", true},
+		{"10.1.2.3", true},
+		{"11.0.0.0", false},
+		{"192.0.2.127", false},
+		{"192.0.2.128", true},
+		{"192.0.2.255", true},
+		{"::ffff:10.2.3.4", true},
+		{"::ffff:11.2.3.4", false},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::", false},
+		{"fe80::1", true},
+		{"fe80::2", false},
+		// IPv4 and IPv6 are kept apart: ::a00:0 is not 10.0.0.0.
+		{"::a00:0", false},
+	}
+	for _, tt := range tests {
+		if got := tree.contains(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("contains(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestCIDRTreeDefault(t *testing.T) {
+	var tree cidrTree
+	tree.insert(netip.MustParsePrefix("0.0.0.0/0"))
+
+	if !tree.contains(netip.MustParseAddr("203.0.113.9")) {
+		t.Error("0.0.0.0/0 does not contain an IPv4 address")
+	}
+	if tree.contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Error("0.0.0.0/0 contains an IPv6 address")
+	}
+}
+
+func TestCIDRTreeMapped(t *testing.T) {
+	var tree cidrTree
+	tree.insert(netip.MustParsePrefix("::ffff:192.0.2.0/120"))
+	tree.insert(netip.MustParsePrefix("::ffff:0:0/64"))
+
+	if tree.size != 1 {
+		t.Errorf("size = %d, want 1", tree.size)
+	}
+	if !tree.contains(netip.MustParseAddr("192.0.2.1")) {
+		t.Error("mapped /120 does not contain 192.0.2.1")
+	}
+	if tree.contains(netip.MustParseAddr("198.51.100.1")) {
+		t.Error("mapped /64 was inserted as an IPv4 prefix")
+	}
+}
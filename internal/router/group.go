@@ -0,0 +1,166 @@
+package router
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"myproxy/internal"
+	"myproxy/internal/health"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/models"
+	"myproxy/pkg/protocol"
+	"myproxy/pkg/shared"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StrategyRoundRobin    = "roundRobin"
+	StrategyRandom        = "random"
+	StrategyLeastActive   = "leastActive"
+	StrategyLowestLatency = "lowestLatency"
+	StrategyFailover      = "failover"
+
+	// maxFailures consecutive pool failures take a node out of its groups
+	// until failCooldown has passed since the last one.
+	maxFailures  = 3
+	failCooldown = 30 * time.Second
+)
+
+var (
+	groups   = make(map[string]*group)
+	groupsMu sync.RWMutex
+)
+
+type group struct {
+	*models.OutboundGroup
+	next atomic.Uint64
+}
+
+type member struct {
+	tag   string
+	state protocol.PoolState
+	rtt   time.Duration
+}
+
+// RunGroups replaces the outbound groups that rules may target by tag.
+func RunGroups(v []*models.OutboundGroup) error {
+	m, err := buildGroups(v)
+	if err != nil {
+		return err
+	}
+
+	groupsMu.Lock()
+	groups = m
+	groupsMu.Unlock()
+	return nil
+}
+
+// CheckGroups reports the first invalid group without installing any.
+func CheckGroups(v []*models.OutboundGroup) error {
+	_, err := buildGroups(v)
+	return err
+}
+
+func buildGroups(v []*models.OutboundGroup) (map[string]*group, error) {
+	m := make(map[string]*group, len(v))
+	for i, g := range v {
+		if g.Tag == "" {
+			return nil, fmt.Errorf("outboundGroups[%d]: missing tag", i)
+		}
+		if len(g.Outbounds) == 0 {
+			return nil, fmt.Errorf("outboundGroups[%d]: no outbounds", i)
+		}
+		switch g.Strategy {
+		case "", StrategyRoundRobin, StrategyRandom, StrategyLeastActive, StrategyLowestLatency, StrategyFailover:
+		default:
+			return nil, fmt.Errorf("outboundGroups[%d].strategy: unknown strategy %q", i, g.Strategy)
+		}
+		m[g.Tag] = &group{OutboundGroup: g}
+	}
+	return m, nil
+}
+
+// pickOutbound resolves a group tag to one of its members. Other tags are
+// returned unchanged.
+func pickOutbound(tag string) string {
+	groupsMu.RLock()
+	g, ok := groups[tag]
+	groupsMu.RUnlock()
+	if !ok {
+		return tag
+	}
+
+	picked := g.pick()
+	mlog.Debug(fmt.Sprintf("group %s picked %s", g.Tag, picked))
+	return picked
+}
+
+func (g *group) pick() string {
+	available := g.available()
+	if len(available) == 0 {
+		mlog.Warn("no available outbound in group " + g.Tag + ", using " + g.Outbounds[0])
+		return g.Outbounds[0]
+	}
+
+	switch g.Strategy {
+	case StrategyRandom:
+		return available[rand.IntN(len(available))].tag
+	case StrategyLeastActive:
+		best := available[0]
+		for _, m := range available[1:] {
+			if m.state.Active < best.state.Active {
+				best = m
+			}
+		}
+		return best.tag
+	case StrategyLowestLatency:
+		best := available[0]
+		for _, m := range available[1:] {
+			if m.rtt > 0 && (best.rtt == 0 || m.rtt < best.rtt) {
+				best = m
+			}
+		}
+		return best.tag
+	case StrategyFailover:
+		return available[0].tag
+	default:
+		return available[(g.next.Add(1)-1)%uint64(len(available))].tag
+	}
+}
+
+// available returns the members that are registered, healthy and not failing
+// in the pool, in the order they are declared. The probed RTT is preferred
+// over the pool's handshake time when both are known.
+func (g *group) available() []member {
+	var members []member
+	for _, tag := range g.Outbounds {
+		switch tag {
+		case shared.OutboundDirect, shared.OutboundBlock, shared.OutboundReject:
+			members = append(members, member{tag: tag})
+			continue
+		}
+
+		info, ok := internal.GetOsi(tag)
+		if !ok {
+			continue
+		}
+
+		status, probed := health.Get(tag)
+		if probed && !status.Up {
+			continue
+		}
+
+		state := protocol.State(&models.NetAddr{Address: info.Address, Port: info.NodePort})
+		if state.Failures >= maxFailures && time.Since(state.LastFail) < failCooldown {
+			continue
+		}
+
+		rtt := state.RTT
+		if probed && status.RTT > 0 {
+			rtt = status.RTT
+		}
+		members = append(members, member{tag: tag, state: state, rtt: rtt})
+	}
+	return members
+}
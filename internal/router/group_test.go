@@ -0,0 +1,73 @@
+package router
+
+import (
+	"myproxy/internal"
+	"myproxy/pkg/models"
+	"myproxy/pkg/shared"
+	"testing"
+)
+
+// register adds outbounds as registered nodes for the duration of the test.
+func register(t *testing.T, tags ...string) {
+	t.Helper()
+	for i, tag := range tags {
+		internal.SwapOsi(tag, internal.OutSeverInfo{Tag: tag, Address: "127.0.0.1", NodePort: uint16(40000 + i)})
+		t.Cleanup(func() { internal.DelOsi(tag) })
+	}
+}
+
+func TestGroupPick(t *testing.T) {
+	register(t, "n1", "n2")
+
+	tests := []struct {
+		name      string
+		strategy  string
+		outbounds []string
+		want      []string
+	}{
+		{"round robin", StrategyRoundRobin, []string{"n1", "n2"}, []string{"n1", "n2", "n1", "n2"}},
+		{"default is round robin", "", []string{"n1", "n2"}, []string{"n1", "n2", "n1"}},
+		{"failover", StrategyFailover, []string{"n1", "n2"}, []string{"n1", "n1"}},
+		{"failover skips unregistered", StrategyFailover, []string{"gone", "n2"}, []string{"n2", "n2"}},
+		{"built-in outbounds", StrategyRoundRobin, []string{"gone", shared.OutboundDirect, shared.OutboundBlock}, []string{shared.OutboundDirect, shared.OutboundBlock}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &group{OutboundGroup: &models.OutboundGroup{Tag: "g", Outbounds: tt.outbounds, Strategy: tt.strategy}}
+			for i, want := range tt.want {
+				if got := g.pick(); got != want {
+					t.Errorf("pick %d = %s, want %s", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupPickRandom(t *testing.T) {
+	register(t, "n1", "n2")
+
+	g := &group{OutboundGroup: &models.OutboundGroup{Tag: "g", Outbounds: []string{"gone", "n1", "n2"}, Strategy: StrategyRandom}}
+	for i := 0; i < 20; i++ {
+		if got := g.pick(); got != "n1" && got != "n2" {
+			t.Fatalf("pick = %s, want n1 or n2", got)
+		}
+	}
+}
+
+func TestBuildGroupsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		v    []*models.OutboundGroup
+	}{
+		{"missing tag", []*models.OutboundGroup{{Outbounds: []string{"a"}}}},
+		{"no outbounds", []*models.OutboundGroup{{Tag: "g"}}},
+		{"bad strategy", []*models.OutboundGroup{{Tag: "g", Outbounds: []string{"a"}, Strategy: "fastest"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckGroups(tt.v); err == nil {
+				t.Error("CheckGroups succeeded")
+			}
+		})
+	}
+}
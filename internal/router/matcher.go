@@ -0,0 +1,260 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"myproxy/internal/mlog"
+	"myproxy/pkg/shared"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+var (
+	namedSets = map[string][]string{
+		// PRIVATE covers every reserved range, like the PRIVATE entries of
+		// the bundled mmdb, loopback and link-local included.
+		"PRIVATE": {
+			"0.0.0.0/8",
+			"10.0.0.0/8",
+			"100.64.0.0/10",
+			"127.0.0.0/8",
+			"169.254.0.0/16",
+			"172.16.0.0/12",
+			"192.0.0.0/24",
+			"192.0.2.0/24",
+			"192.88.99.0/24",
+			"192.168.0.0/16",
+			"198.18.0.0/15",
+			"198.51.100.0/24",
+			"203.0.113.0/24",
+			"224.0.0.0/3",
+			"::/127",
+			"fc00::/7",
+			"fe80::/10",
+			"ff00::/8",
+		},
+		"LOOPBACK": {
+			"127.0.0.0/8",
+			"::1/128",
+		},
+		"LINKLOCAL": {
+			"169.254.0.0/16",
+			"fe80::/10",
+		},
+	}
+)
+
+// ipMatcher matches addresses against CIDRs, named sets and country codes.
+type ipMatcher struct {
+	prefixes  cidrTree
+	countries map[string]struct{}
+}
+
+func newIPMatcher(entries []string) (*ipMatcher, error) {
+	m := &ipMatcher{countries: make(map[string]struct{})}
+	for _, entry := range entries {
+		if err := m.add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *ipMatcher) add(entry string) error {
+	prefix, name, err := parseIPEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		m.prefixes.insert(prefix)
+		return nil
+	}
+	if set, ok := namedSets[name]; ok {
+		for _, s := range set {
+			m.prefixes.insert(netip.MustParsePrefix(s))
+		}
+		return nil
+	}
+
+	m.countries[name] = struct{}{}
+	return nil
+}
+
+// parseIPEntry parses an entry of an IP condition or rule set. An address
+// or CIDR is returned as a prefix, a named set or country code as its
+// upper-case name.
+func parseIPEntry(entry string) (netip.Prefix, string, error) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return netip.Prefix{}, "", errors.New("empty ip entry")
+	}
+
+	name := strings.ToUpper(entry)
+	if _, ok := namedSets[name]; ok {
+		return netip.Prefix{}, name, nil
+	}
+
+	prefix, err := parsePrefix(entry)
+	if err == nil {
+		return prefix, "", nil
+	}
+	if strings.Contains(entry, "/") {
+		return netip.Prefix{}, "", err
+	}
+	if !isCountryCode(entry) {
+		return netip.Prefix{}, "", fmt.Errorf("invalid ip entry %q: not an address, CIDR, named set or two-letter country code", entry)
+	}
+	return netip.Prefix{}, name, nil
+}
+
+// isCountryCode reports whether s has the form of an ISO 3166-1 alpha-2
+// code, which is how the GeoIP database names countries.
+func isCountryCode(s string) bool {
+	if len(s) != 2 {
+		return false
+	}
+	for _, c := range []byte(strings.ToUpper(s)) {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+func (m *ipMatcher) empty() bool {
+	return m == nil || m.prefixes.size == 0 && len(m.countries) == 0
+}
+
+// matchAny reports whether one of ips matches. A destination that resolves
+// to several addresses is in a CIDR or country as soon as one of them is.
+func (m *ipMatcher) matchAny(ips []net.IP) bool {
+	for _, ip := range ips {
+		if m.match(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// filter returns the addresses of ips that match.
+func (m *ipMatcher) filter(ips []net.IP) []net.IP {
+	var matched []net.IP
+	for _, ip := range ips {
+		if m.match(ip) {
+			matched = append(matched, ip)
+		}
+	}
+	return matched
+}
+
+func (m *ipMatcher) match(ip net.IP) bool {
+	if m == nil || ip == nil {
+		return false
+	}
+
+	if addr, ok := netip.AddrFromSlice(ip); ok && m.prefixes.contains(addr.Unmap()) {
+		return true
+	}
+
+	if len(m.countries) == 0 || shared.IPDB == nil {
+		return false
+	}
+
+	country, err := shared.IPDB.Country(ip)
+	if err != nil {
+		mlog.Error("", zap.Error(err))
+		return false
+	}
+	_, ok := m.countries[strings.ToUpper(country.Country.IsoCode)]
+	return ok
+}
+
+type portRange struct {
+	from uint16
+	to   uint16
+}
+
+// portMatcher matches ports against a list such as "53,80,443,1000-2000".
+type portMatcher []portRange
+
+func newPortMatcher(s string) (portMatcher, error) {
+	var m portMatcher
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		from, to, isRange := strings.Cut(part, "-")
+		if !isRange {
+			to = from
+		}
+
+		f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", part)
+		}
+		t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil || t < f {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		m = append(m, portRange{from: uint16(f), to: uint16(t)})
+	}
+	return m, nil
+}
+
+func (m portMatcher) match(port uint16) bool {
+	for _, r := range m {
+		if port >= r.from && port <= r.to {
+			return true
+		}
+	}
+	return false
+}
+
+// networkMatcher matches "tcp", "udp" or a comma separated list of both.
+type networkMatcher map[string]struct{}
+
+func newNetworkMatcher(s string) (networkMatcher, error) {
+	m := make(networkMatcher)
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+
+	for _, part := range strings.Split(s, ",") {
+		network := strings.ToLower(strings.TrimSpace(part))
+		if network != shared.NetworkTCP && network != shared.NetworkUDP {
+			return nil, fmt.Errorf("invalid network %q", part)
+		}
+		m[network] = struct{}{}
+	}
+	return m, nil
+}
+
+func (m networkMatcher) match(network string) bool {
+	_, ok := m[network]
+	return ok
+}
+
+// userMatcher matches the authenticated user of a tunnel stream.
+type userMatcher map[string]struct{}
+
+func newUserMatcher(users []string) userMatcher {
+	if len(users) == 0 {
+		return nil
+	}
+	m := make(userMatcher, len(users))
+	for _, u := range users {
+		m[u] = struct{}{}
+	}
+	return m
+}
+
+func (m userMatcher) match(user string) bool {
+	_, ok := m[user]
+	return ok
+}
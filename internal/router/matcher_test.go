@@ -0,0 +1,128 @@
+package router
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIPMatcher(t *testing.T) {
+	m, err := newIPMatcher([]string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.7", "LOOPBACK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.1", false},
+		{"::ffff:10.9.9.9", true},
+		{"2001:db8:1::1", true},
+		{"2001:db9::1", false},
+		{"192.0.2.7", true},
+		{"192.0.2.8", false},
+		{"127.0.0.1", true},
+		{"::1", true},
+	}
+	for _, tt := range tests {
+		if got := m.match(net.ParseIP(tt.ip)); got != tt.want {
+			t.Errorf("match(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+
+	if m.match(nil) {
+		t.Error("match(nil) = true")
+	}
+	if !m.matchAny([]net.IP{net.ParseIP("8.8.8.8"), net.ParseIP("10.0.0.1")}) {
+		t.Error("matchAny missed the second address")
+	}
+	if m.matchAny(nil) {
+		t.Error("matchAny(nil) = true")
+	}
+}
+
+func TestIPMatcherEntries(t *testing.T) {
+	tests := []struct {
+		entry     string
+		wantErr   bool
+		countries int
+	}{
+		{"10.0.0.0/8", false, 0},
+		{"private", false, 0},
+		{"us", false, 1},
+		{"USA", true, 0},
+		{"u1", true, 0},
+		{"example.com", true, 0},
+		{"", true, 0},
+		{"10.0.0.0/33", true, 0},
+	}
+	for _, tt := range tests {
+		m, err := newIPMatcher([]string{tt.entry})
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newIPMatcher(%q) error = %v, want error %v", tt.entry, err, tt.wantErr)
+			continue
+		}
+		if err == nil && len(m.countries) != tt.countries {
+			t.Errorf("newIPMatcher(%q) has %d countries, want %d", tt.entry, len(m.countries), tt.countries)
+		}
+	}
+}
+
+func TestPortMatcher(t *testing.T) {
+	m, err := newPortMatcher("53, 80,1000-2000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		port uint16
+		want bool
+	}{
+		{53, true},
+		{80, true},
+		{81, false},
+		{999, false},
+		{1000, true},
+		{2000, true},
+		{2001, false},
+	}
+	for _, tt := range tests {
+		if got := m.match(tt.port); got != tt.want {
+			t.Errorf("match(%d) = %v, want %v", tt.port, got, tt.want)
+		}
+	}
+
+	for _, s := range []string{"http", "70000", "20-10", "1-"} {
+		if _, err := newPortMatcher(s); err == nil {
+			t.Errorf("newPortMatcher(%q) succeeded", s)
+		}
+	}
+	if m, err := newPortMatcher(" "); err != nil || len(m) != 0 {
+		t.Errorf("newPortMatcher(blank) = %v, %v", m, err)
+	}
+}
+
+func TestNetworkMatcher(t *testing.T) {
+	tests := []struct {
+		spec    string
+		network string
+		want    bool
+		wantErr bool
+	}{
+		{"tcp", "tcp", true, false},
+		{"tcp", "udp", false, false},
+		{"TCP, udp", "udp", true, false},
+		{"quic", "", false, true},
+	}
+	for _, tt := range tests {
+		m, err := newNetworkMatcher(tt.spec)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("newNetworkMatcher(%q) error = %v", tt.spec, err)
+			continue
+		}
+		if err == nil && m.match(tt.network) != tt.want {
+			t.Errorf("%q match(%q) = %v, want %v", tt.spec, tt.network, !tt.want, tt.want)
+		}
+	}
+}
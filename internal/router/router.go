@@ -1,83 +1,394 @@
 package router
 
 import (
+	"fmt"
 	"go.uber.org/zap"
-	"myproxy/internal"
 	"myproxy/internal/mlog"
 	"myproxy/pkg/models"
 	"myproxy/pkg/shared"
+	"myproxy/pkg/util/domain"
+	net2 "myproxy/pkg/util/net"
 	"net"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 )
 
+// Domain strategies decide whether IP conditions may resolve domain names.
+// With ipOnDemand a name is resolved locally the first time an IP condition
+// is evaluated for it. With asIs it never is: IP conditions see no address
+// for a domain destination, which is then sent by name through the tunnel and
+// resolved by the endpoint.
+const (
+	DomainIPOnDemand = "ipOnDemand"
+	DomainAsIs       = "asIs"
+)
+
 var (
-	rules   []*models.Rule
-	rulesMu sync.RWMutex
+	table   = &routeTable{}
+	tableMu sync.RWMutex
 )
 
-func Run(v []*models.Rule) {
-	rulesMu.Lock()
-	rules = v
-	rulesMu.Unlock()
+type routeTable struct {
+	rules []*rule
+	sets  []*ruleSet
+	final string
+	asIs  bool
 }
 
-type Router struct {
-	InboundTag  string
-	OutboundTag string
-	DstAddr     net.IP
+// Run compiles the routing rules and swaps them in as a whole, so a request
+// is always matched against one consistent rule set. Rule set files are
+// watched and reloaded in place until the next Run or Close.
+func Run(v *models.Routing) error {
+	t, err := build(v)
+	if err != nil {
+		return err
+	}
+	for _, s := range t.sets {
+		mlog.Info(fmt.Sprintf("loaded rule set %s with %d entries", s.Tag, s.size()))
+	}
+
+	if err := watch(t.sets); err != nil {
+		return err
+	}
+
+	tableMu.Lock()
+	table = t
+	tableMu.Unlock()
+	return nil
 }
 
-func (r *Router) Process() string {
-	if r.DstAddr == nil {
-		return getDefaultOutTag()
+// Check compiles the routing rules and loads their rule sets without
+// installing them.
+func Check(v *models.Routing) error {
+	_, err := build(v)
+	return err
+}
+
+func build(v *models.Routing) (*routeTable, error) {
+	t := &routeTable{final: v.Final}
+
+	switch v.DomainStrategy {
+	case "", DomainIPOnDemand:
+	case DomainAsIs:
+		t.asIs = true
+	default:
+		return nil, fmt.Errorf("routing.domainStrategy: unknown strategy %q", v.DomainStrategy)
 	}
 
-	if shared.IPDB == nil {
-		return getDefaultOutTag()
+	sets := make(map[string]*ruleSet, len(v.RuleSets))
+	for i, c := range v.RuleSets {
+		s, err := newRuleSet(c)
+		if err != nil {
+			return nil, fmt.Errorf("routing.ruleSets[%d]: %w", i, err)
+		}
+		if _, ok := sets[s.Tag]; ok {
+			return nil, fmt.Errorf("routing.ruleSets[%d]: duplicate tag %s", i, s.Tag)
+		}
+		sets[s.Tag] = s
+		t.sets = append(t.sets, s)
 	}
 
-	country, err := shared.IPDB.Country(r.DstAddr)
-	if err != nil {
-		mlog.Error("", zap.Error(err))
-		return getDefaultOutTag()
+	for i, r := range v.Rules {
+		c, err := compile(r, sets)
+		if err != nil {
+			return nil, fmt.Errorf("routing.rules[%d]: %w", i, err)
+		}
+		t.rules = append(t.rules, c)
 	}
+	return t, nil
+}
 
-	ctCode := "!" + country.Country.IsoCode
+// Close stops watching rule set files.
+func Close() error {
+	return unwatch()
+}
 
-	var outTag string
-	rulesMu.RLock()
-	for _, rule := range rules {
-		if r.InboundTag == rule.InTag {
-			for _, ip := range rule.IP {
-				if ctCode == strings.ToUpper(ip) {
-					rulesMu.RUnlock()
-					return "direct"
-				}
-			}
-			outTag = rule.OutTag
+func current() *routeTable {
+	tableMu.RLock()
+	defer tableMu.RUnlock()
+	return table
+}
+
+type rule struct {
+	*models.Rule
+	domain    *domain.Matcher
+	notDomain *domain.Matcher
+	ip        *ipMatcher
+	notIP     *ipMatcher
+	source    *ipMatcher
+	notSource *ipMatcher
+	port      portMatcher
+	network   networkMatcher
+	sets      []*ruleSet
+	notSets   []*ruleSet
+	users     userMatcher
+	notUsers  userMatcher
+}
+
+func compile(r *models.Rule, sets map[string]*ruleSet) (*rule, error) {
+	c := &rule{Rule: r}
+
+	tags, notTags := split(r.RuleSet)
+	for _, tag := range tags {
+		s, ok := sets[tag]
+		if !ok {
+			return nil, fmt.Errorf("unknown rule set %s", tag)
+		}
+		c.sets = append(c.sets, s)
+	}
+	for _, tag := range notTags {
+		s, ok := sets[tag]
+		if !ok {
+			return nil, fmt.Errorf("unknown rule set %s", tag)
 		}
+		c.notSets = append(c.notSets, s)
 	}
-	rulesMu.RUnlock()
 
-	if outTag == "" {
-		outTag = getDefaultOutTag()
+	domains, notDomains := split(r.Domain)
+	ips, notIPs := split(r.IP)
+	sources, notSources := split(r.Source)
+
+	var err error
+	if c.domain, err = domain.New(domains); err != nil {
+		return nil, err
+	}
+	if c.notDomain, err = domain.New(notDomains); err != nil {
+		return nil, err
+	}
+	if c.ip, err = newIPMatcher(ips); err != nil {
+		return nil, err
+	}
+	if c.notIP, err = newIPMatcher(notIPs); err != nil {
+		return nil, err
 	}
+	if c.source, err = newIPMatcher(sources); err != nil {
+		return nil, err
+	}
+	if c.notSource, err = newIPMatcher(notSources); err != nil {
+		return nil, err
+	}
+	if c.port, err = newPortMatcher(r.Port); err != nil {
+		return nil, err
+	}
+	if c.network, err = newNetworkMatcher(r.Network); err != nil {
+		return nil, err
+	}
+	users, notUsers := split(r.User)
+	c.users, c.notUsers = newUserMatcher(users), newUserMatcher(notUsers)
+	return c, nil
+}
 
-	return outTag
+// split separates positive entries from "!" prefixed negative ones.
+func split(entries []string) (pos []string, neg []string) {
+	for _, e := range entries {
+		if strings.HasPrefix(e, "!") {
+			neg = append(neg, e[1:])
+		} else {
+			pos = append(pos, e)
+		}
+	}
+	return pos, neg
 }
 
-func getDefaultOutTag() string {
-	var outTag string
+// match reports whether every condition of the rule holds for the request.
+// A condition list holds when one of its positive entries matches, or it has
+// none, and none of its negative entries match. When positive IP conditions
+// hold for only some destination addresses, r.Addrs is set to those.
+func (c *rule) match(r *Router) bool {
+	if c.InTag != "" && c.InTag != r.InboundTag {
+		return false
+	}
+	if len(c.network) > 0 && !c.network.match(r.Network) {
+		return false
+	}
+	if len(c.port) > 0 && !c.port.match(r.DstPort) {
+		return false
+	}
+	if len(c.users) > 0 && !c.users.match(r.User) || c.notUsers.match(r.User) {
+		return false
+	}
+	if !c.source.empty() && !c.source.match(r.SrcAddr) || c.notSource.match(r.SrcAddr) {
+		return false
+	}
+
+	if !c.domain.Empty() || !c.notDomain.Empty() {
+		host := r.domainName()
+		if !c.domain.Empty() && !c.domain.Match(host) || c.notDomain.Match(host) {
+			return false
+		}
+	}
+
+	// addrs are the destination addresses the positive IP conditions hold
+	// for, nil while there is no such condition.
+	var addrs []net.IP
+	if !c.ip.empty() || !c.notIP.empty() {
+		ips := r.dstIPs()
+		if c.notIP.matchAny(ips) {
+			return false
+		}
+		if !c.ip.empty() {
+			if addrs = c.ip.filter(ips); len(addrs) == 0 {
+				return false
+			}
+		}
+	}
 
-	internal.RangeOsi(func(key string, info internal.OutSeverInfo) bool {
-		outTag = info.Tag
+	if len(c.sets) > 0 {
+		ok, matched := matchSets(c.sets, r)
+		if !ok {
+			return false
+		}
+		if matched != nil {
+			if addrs != nil {
+				matched = slices.DeleteFunc(matched, func(ip net.IP) bool {
+					return !slices.ContainsFunc(addrs, ip.Equal)
+				})
+			}
+			if len(matched) == 0 {
+				return false
+			}
+			addrs = matched
+		}
+	}
+	if matchAny(c.notSets, r) {
 		return false
-	})
+	}
+
+	r.Addrs = addrs
+	return true
+}
+
+func matchAny(sets []*ruleSet, r *Router) bool {
+	for _, s := range sets {
+		if s.match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSets reports whether one of sets holds for r. When none of the
+// domain sets holds, it also returns the destination addresses the IP sets
+// matched.
+func matchSets(sets []*ruleSet, r *Router) (bool, []net.IP) {
+	var ipSets []*ipMatcher
+	for _, s := range sets {
+		if s.Type == RuleSetDomain {
+			if s.match(r) {
+				return true, nil
+			}
+			continue
+		}
+		ipSets = append(ipSets, s.ip.Load())
+	}
 
-	if outTag == "" {
-		outTag = "direct"
+	var matched []net.IP
+	for _, ip := range r.dstIPs() {
+		for _, m := range ipSets {
+			if m.match(ip) {
+				matched = append(matched, ip)
+				break
+			}
+		}
 	}
+	return len(matched) > 0, matched
+}
 
-	return outTag
+type Router struct {
+	InboundTag  string
+	OutboundTag string
+	Network     string
+	Host        string
+	DstAddr     net.IP
+	DstPort     uint16
+	SrcAddr     net.IP
+	User        string
+	// AsIs routes Host by name only, as the asIs domain strategy does.
+	AsIs bool
+
+	// Rule is set by Process to the index of the matching rule, or to
+	// RuleFinal when none matched.
+	Rule string
+	// Addrs is set by Process to the destination addresses the IP
+	// conditions of the matching rule hold for, or to nil when any address
+	// of the destination may be used. A direct connection dials only these.
+	Addrs []net.IP
+
+	// addrs caches the destination addresses IP conditions are evaluated
+	// on, resolved is set once Host was resolved, or must not be.
+	addrs    []net.IP
+	resolved bool
+}
+
+const RuleFinal = "final"
+
+// Process returns the outbound tag of the first matching rule, or the final
+// outbound when no rule matches. Group tags are resolved to a member.
+func (r *Router) Process() string {
+	t := current()
+	if t.asIs || r.AsIs {
+		r.resolved = true
+	}
+	r.Addrs = nil
+	for i, rule := range t.rules {
+		if rule.match(r) {
+			r.Rule = strconv.Itoa(i)
+			return pickOutbound(rule.OutTag)
+		}
+	}
+
+	r.Rule = RuleFinal
+
+	if t.final == "" {
+		return shared.OutboundDirect
+	}
+	return pickOutbound(t.final)
+}
+
+func (r *Router) domainName() string {
+	if net.ParseIP(r.Host) != nil {
+		return ""
+	}
+	return r.Host
+}
+
+// dstIPs returns the destination addresses: DstAddr when set, or the
+// addresses Host resolves to that the direct dialer would try, resolved the
+// first time an IP condition needs them unless the domain strategy is asIs.
+func (r *Router) dstIPs() []net.IP {
+	if r.addrs != nil {
+		return r.addrs
+	}
+	if r.DstAddr != nil {
+		r.addrs = []net.IP{r.DstAddr}
+		return r.addrs
+	}
+	if r.Host == "" {
+		return nil
+	}
+	if ip := net.ParseIP(r.Host); ip != nil {
+		r.addrs = []net.IP{ip}
+		return r.addrs
+	}
+	if r.resolved {
+		return nil
+	}
+	r.resolved = true
+
+	ips, err := net2.LookupIP(r.Host)
+	if err != nil {
+		mlog.Error("", zap.Error(err))
+		return nil
+	}
+	// Only the addresses a direct connection would try are considered, so
+	// rules never match on an address of a family the dialer skips.
+	ips = net2.DialOrder(ips)
+	if len(ips) == 0 {
+		mlog.Error("no IPs resolved for " + r.Host)
+		return nil
+	}
+	r.addrs = ips
+	return r.addrs
 }
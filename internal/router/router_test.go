@@ -0,0 +1,215 @@
+package router
+
+import (
+	"context"
+	"fmt"
+	"myproxy/pkg/models"
+	"myproxy/pkg/shared"
+	net2 "myproxy/pkg/util/net"
+	"net"
+	"slices"
+	"testing"
+	"time"
+)
+
+// use installs the rules of v for the duration of the test.
+func use(t *testing.T, v *models.Routing) {
+	t.Helper()
+	rt, err := build(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tableMu.Lock()
+	prev := table
+	table = rt
+	tableMu.Unlock()
+	t.Cleanup(func() {
+		tableMu.Lock()
+		table = prev
+		tableMu.Unlock()
+	})
+}
+
+func TestProcess(t *testing.T) {
+	use(t, &models.Routing{
+		Final: "proxy",
+		Rules: []*models.Rule{
+			{InTag: "a", Domain: []string{"full:blocked.com"}, OutTag: "blocked"},
+			{Port: "53", Network: "udp", OutTag: "dns-out"},
+			{IP: []string{"10.0.0.0/8", "!10.1.0.0/16"}, OutTag: "lan"},
+			{Domain: []string{"!example.com"}, Port: "8080", OutTag: "alt-out"},
+			{Source: []string{"192.168.0.0/16"}, Domain: []string{"src.com"}, OutTag: "src-out"},
+		},
+	})
+
+	public := net.ParseIP("192.0.2.1")
+	tests := []struct {
+		name     string
+		r        Router
+		wantTag  string
+		wantRule string
+	}{
+		{"inbound and domain", Router{InboundTag: "a", Host: "blocked.com", DstAddr: public}, "blocked", "0"},
+		{"other inbound", Router{InboundTag: "b", Host: "blocked.com", DstAddr: public}, "proxy", RuleFinal},
+		{"udp port", Router{Network: "udp", DstAddr: public, DstPort: 53}, "dns-out", "1"},
+		{"tcp port", Router{Network: "tcp", DstAddr: public, DstPort: 53}, "proxy", RuleFinal},
+		{"cidr", Router{DstAddr: net.ParseIP("10.2.3.4")}, "lan", "2"},
+		{"negated cidr", Router{DstAddr: net.ParseIP("10.1.2.3")}, "proxy", RuleFinal},
+		{"ip host", Router{Host: "10.9.9.9"}, "lan", "2"},
+		{"negated domain", Router{Host: "other.com", DstAddr: public, DstPort: 8080}, "alt-out", "3"},
+		{"negated domain excluded", Router{Host: "www.example.com", DstAddr: public, DstPort: 8080}, "proxy", RuleFinal},
+		{"source", Router{SrcAddr: net.ParseIP("192.168.1.2"), Host: "src.com", DstAddr: public}, "src-out", "4"},
+		{"other source", Router{SrcAddr: net.ParseIP("172.16.0.1"), Host: "src.com", DstAddr: public}, "proxy", RuleFinal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.r
+			if got := r.Process(); got != tt.wantTag || r.Rule != tt.wantRule {
+				t.Errorf("Process() = %s by rule %s, want %s by rule %s", got, r.Rule, tt.wantTag, tt.wantRule)
+			}
+		})
+	}
+}
+
+func TestProcessFinal(t *testing.T) {
+	use(t, &models.Routing{})
+
+	r := Router{DstAddr: net.ParseIP("192.0.2.1")}
+	if got := r.Process(); got != "direct" || r.Rule != RuleFinal {
+		t.Errorf("Process() = %s by rule %s, want direct by final", got, r.Rule)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		v    *models.Routing
+	}{
+		{"bad port", &models.Routing{Rules: []*models.Rule{{Port: "x", OutTag: "a"}}}},
+		{"bad network", &models.Routing{Rules: []*models.Rule{{Network: "sctp", OutTag: "a"}}}},
+		{"bad cidr", &models.Routing{Rules: []*models.Rule{{IP: []string{"10.0.0.0/40"}, OutTag: "a"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := build(tt.v); err == nil {
+				t.Error("build succeeded")
+			}
+		})
+	}
+}
+
+func TestDomainStrategy(t *testing.T) {
+	var queries int
+	resolve := func(context.Context, string) ([]net.IP, time.Duration, error) {
+		queries++
+		return []net.IP{net.ParseIP("192.0.2.1")}, time.Minute, nil
+	}
+	t.Cleanup(func() { net2.SetResolver(nil) })
+
+	tests := []struct {
+		strategy    string
+		host        string
+		want        string
+		wantQueries int
+	}{
+		{"", "a.test", "ip-out", 1},
+		{DomainIPOnDemand, "a.test", "ip-out", 1},
+		{DomainAsIs, "a.test", "proxy", 0},
+		{DomainAsIs, "b.test", "b-out", 0},
+		{DomainAsIs, "192.0.2.7", "ip-out", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy+"/"+tt.host, func(t *testing.T) {
+			use(t, &models.Routing{
+				Final:          "proxy",
+				DomainStrategy: tt.strategy,
+				Rules: []*models.Rule{
+					{IP: []string{"192.0.2.0/24"}, OutTag: "ip-out"},
+					{Domain: []string{"b.test"}, OutTag: "b-out"},
+				},
+			})
+			// Installing the resolver again flushes the answers cached
+			// by the previous case.
+			net2.SetResolver(resolve)
+			queries = 0
+
+			r := Router{Host: tt.host}
+			if got := r.Process(); got != tt.want || queries != tt.wantQueries {
+				t.Errorf("Process() = %s after %d lookups, want %s after %d", got, queries, tt.want, tt.wantQueries)
+			}
+		})
+	}
+
+	if _, err := build(&models.Routing{DomainStrategy: "preferIP"}); err == nil {
+		t.Error("build accepted an unknown domain strategy")
+	}
+}
+
+func TestProcessAsIs(t *testing.T) {
+	var queries int
+	net2.SetResolver(func(context.Context, string) ([]net.IP, time.Duration, error) {
+		queries++
+		return []net.IP{net.ParseIP("192.0.2.1")}, time.Minute, nil
+	})
+	t.Cleanup(func() { net2.SetResolver(nil) })
+	use(t, &models.Routing{
+		Final: "proxy",
+		Rules: []*models.Rule{{IP: []string{"192.0.2.0/24"}, OutTag: shared.OutboundReject}},
+	})
+
+	// A fake name is routed by name alone, whatever the domain strategy.
+	r := Router{Host: "a.test", AsIs: true}
+	if got := r.Process(); got != "proxy" || queries != 0 {
+		t.Errorf("Process() = %s after %d lookups, want proxy without any", got, queries)
+	}
+	r = Router{Host: "a.test"}
+	if got := r.Process(); got != shared.OutboundReject || queries != 1 {
+		t.Errorf("Process() = %s after %d lookups, want %s after 1", got, queries, shared.OutboundReject)
+	}
+}
+
+func TestProcessAddrs(t *testing.T) {
+	net2.SetResolver(func(context.Context, string) ([]net.IP, time.Duration, error) {
+		return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("198.51.100.1"), net.ParseIP("2001:db8::1")}, time.Minute, nil
+	})
+	t.Cleanup(func() {
+		net2.SetResolver(nil)
+		_ = net2.SetDirect(nil)
+	})
+	use(t, &models.Routing{
+		Final: "proxy",
+		Rules: []*models.Rule{
+			{IP: []string{"192.0.2.0/24", "2001:db8::/32"}, Port: "80", OutTag: "lan"},
+			{IP: []string{"!203.0.113.0/24"}, Port: "443", OutTag: "direct"},
+		},
+	})
+
+	tests := []struct {
+		strategy  string
+		port      uint16
+		want      string
+		wantAddrs []string
+	}{
+		{"", 80, "lan", []string{"2001:db8::1", "192.0.2.1"}},
+		{net2.StrategyIPv4Only, 80, "lan", []string{"192.0.2.1"}},
+		{net2.StrategyIPv6Only, 80, "lan", []string{"2001:db8::1"}},
+		{"", 443, "direct", nil},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.strategy, tt.port), func(t *testing.T) {
+			if err := net2.SetDirect(&models.Direct{Strategy: tt.strategy}); err != nil {
+				t.Fatal(err)
+			}
+			r := Router{Host: "a.test", DstPort: tt.port}
+			got := r.Process()
+			var addrs []string
+			for _, ip := range r.Addrs {
+				addrs = append(addrs, ip.String())
+			}
+			if got != tt.want || !slices.Equal(addrs, tt.wantAddrs) {
+				t.Errorf("Process() = %s with addresses %q, want %s with %q", got, addrs, tt.want, tt.wantAddrs)
+			}
+		})
+	}
+}
@@ -0,0 +1,336 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"myproxy/pkg/models"
+	"myproxy/pkg/util/domain"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	RuleSetDomain = "domain"
+	RuleSetIP     = "ip"
+
+	RuleSetText   = "text"
+	RuleSetBinary = "binary"
+
+	ruleSetMagic   = "MPRS"
+	ruleSetVersion = 1
+	maxEntryLen    = 1024
+
+	typeDomain byte = 1
+	typeIP     byte = 2
+)
+
+const (
+	entrySuffix byte = iota
+	entryFull
+	entryKeyword
+	entryRegexp
+)
+
+// Families of binary IP entries. Country codes and named sets are stored by
+// name.
+const (
+	familyName byte = 0
+	familyIPv4 byte = 4
+	familyIPv6 byte = 6
+)
+
+// ruleSet is an external list of domains or addresses. The compiled matcher
+// is swapped atomically when the file is reloaded.
+type ruleSet struct {
+	*models.RuleSet
+	domain atomic.Pointer[domain.Matcher]
+	ip     atomic.Pointer[ipMatcher]
+}
+
+func newRuleSet(c *models.RuleSet) (*ruleSet, error) {
+	if c.Tag == "" {
+		return nil, errors.New("rule set without tag")
+	}
+	if c.Type != RuleSetDomain && c.Type != RuleSetIP {
+		return nil, fmt.Errorf("rule set %s: unknown type %q", c.Tag, c.Type)
+	}
+	if c.Format != "" && c.Format != RuleSetText && c.Format != RuleSetBinary {
+		return nil, fmt.Errorf("rule set %s: unknown format %q", c.Tag, c.Format)
+	}
+
+	s := &ruleSet{RuleSet: c}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ruleSet) load() error {
+	f, err := os.Open(s.Path)
+	if err != nil {
+		return fmt.Errorf("rule set %s: %w", s.Tag, err)
+	}
+	defer f.Close()
+
+	var entries []string
+	if s.Format == RuleSetBinary {
+		entries, err = decodeRuleSet(f, s.Type)
+	} else {
+		entries, err = ReadEntries(f)
+	}
+	if err != nil {
+		return fmt.Errorf("rule set %s: %w", s.Tag, err)
+	}
+
+	switch s.Type {
+	case RuleSetDomain:
+		m, err := domain.New(entries)
+		if err != nil {
+			return fmt.Errorf("rule set %s: %w", s.Tag, err)
+		}
+		s.domain.Store(m)
+	case RuleSetIP:
+		m, err := newIPMatcher(entries)
+		if err != nil {
+			return fmt.Errorf("rule set %s: %w", s.Tag, err)
+		}
+		s.ip.Store(m)
+	}
+	return nil
+}
+
+func (s *ruleSet) match(r *Router) bool {
+	switch s.Type {
+	case RuleSetDomain:
+		return s.domain.Load().Match(r.domainName())
+	case RuleSetIP:
+		return s.ip.Load().matchAny(r.dstIPs())
+	}
+	return false
+}
+
+func (s *ruleSet) size() int {
+	if s.Type == RuleSetDomain {
+		return s.domain.Load().Len()
+	}
+	return s.ip.Load().prefixes.size + len(s.ip.Load().countries)
+}
+
+// ReadEntries returns the entries of a plain list: one per line, with blank
+// lines and "#" comments skipped.
+func ReadEntries(r io.Reader) ([]string, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line != "" {
+			entries = append(entries, line)
+		}
+	}
+	return entries, scanner.Err()
+}
+
+var domainKinds = []struct {
+	kind   byte
+	prefix string
+}{
+	{entrySuffix, "domain:"},
+	{entryFull, "full:"},
+	{entryKeyword, "keyword:"},
+	{entryRegexp, "regexp:"},
+}
+
+// EncodeRuleSet writes entries in the compact binary rule set form:
+//
+//	"MPRS" | version | type | count (uvarint) | entries
+//
+// Domain entries are a kind byte followed by a uvarint length and the name.
+// IP entries are the family (4 or 6), the prefix length and the address
+// bytes, or family 0 followed by a uvarint length and the name of a country
+// or named set. Entries are checked as a text rule set would check them.
+func EncodeRuleSet(w io.Writer, typ string, entries []string) error {
+	buf := bytes.NewBufferString(ruleSetMagic)
+	buf.WriteByte(ruleSetVersion)
+
+	switch typ {
+	case RuleSetDomain:
+		if _, err := domain.New(entries); err != nil {
+			return err
+		}
+		buf.WriteByte(typeDomain)
+	case RuleSetIP:
+		buf.WriteByte(typeIP)
+	default:
+		return fmt.Errorf("unknown rule set type %q", typ)
+	}
+	buf.Write(binary.AppendUvarint(nil, uint64(len(entries))))
+
+	for _, entry := range entries {
+		switch typ {
+		case RuleSetDomain:
+			kind, name := entrySuffix, strings.TrimPrefix(entry, "*.")
+			for _, k := range domainKinds {
+				if strings.HasPrefix(entry, k.prefix) {
+					kind, name = k.kind, entry[len(k.prefix):]
+					break
+				}
+			}
+			buf.WriteByte(kind)
+			buf.Write(binary.AppendUvarint(nil, uint64(len(name))))
+			buf.WriteString(name)
+		case RuleSetIP:
+			prefix, name, err := parseIPEntry(entry)
+			if err != nil {
+				return err
+			}
+			switch {
+			case name != "":
+				buf.WriteByte(familyName)
+				buf.Write(binary.AppendUvarint(nil, uint64(len(name))))
+				buf.WriteString(name)
+				continue
+			case prefix.Addr().Is4():
+				buf.WriteByte(familyIPv4)
+			default:
+				buf.WriteByte(familyIPv6)
+			}
+			buf.WriteByte(byte(prefix.Bits()))
+			buf.Write(prefix.Addr().AsSlice())
+		}
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func decodeRuleSet(r io.Reader, typ string) ([]string, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, len(ruleSetMagic)+2)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if string(header[:len(ruleSetMagic)]) != ruleSetMagic || header[len(ruleSetMagic)] != ruleSetVersion {
+		return nil, errors.New("not a binary rule set")
+	}
+	want := typeIP
+	if typ == RuleSetDomain {
+		want = typeDomain
+	}
+	if header[len(ruleSetMagic)+1] != want {
+		return nil, fmt.Errorf("binary rule set is not of type %s", typ)
+	}
+
+	count, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]string, 0, min(count, 1<<20))
+	for i := uint64(0); i < count; i++ {
+		kind, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if typ == RuleSetIP && kind != familyName {
+			entry, err := readPrefix(br, kind)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+			continue
+		}
+
+		var prefix string
+		if typ == RuleSetDomain {
+			var ok bool
+			if prefix, ok = domainPrefix(kind); !ok {
+				return nil, fmt.Errorf("unknown domain entry kind %d", kind)
+			}
+		}
+
+		l, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		if l > maxEntryLen {
+			return nil, errors.New("invalid entry length")
+		}
+		name := make([]byte, l)
+		if _, err := io.ReadFull(br, name); err != nil {
+			return nil, err
+		}
+		entries = append(entries, prefix+string(name))
+	}
+	return entries, nil
+}
+
+// readPrefix reads the prefix length and address of an IP entry of family.
+func readPrefix(br *bufio.Reader, family byte) (string, error) {
+	var b []byte
+	switch family {
+	case familyIPv4:
+		b = make([]byte, net.IPv4len)
+	case familyIPv6:
+		b = make([]byte, net.IPv6len)
+	default:
+		return "", fmt.Errorf("unknown ip entry family %d", family)
+	}
+
+	bits, err := br.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if int(bits) > len(b)*8 {
+		return "", fmt.Errorf("invalid prefix length %d", bits)
+	}
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", err
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return netip.PrefixFrom(addr, int(bits)).String(), nil
+}
+
+func domainPrefix(kind byte) (string, bool) {
+	for _, k := range domainKinds {
+		if k.kind == kind {
+			return k.prefix, true
+		}
+	}
+	return "", false
+}
+
+// parsePrefix parses an address or CIDR entry of an IP rule set.
+func parsePrefix(entry string) (netip.Prefix, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		// An IPv4-mapped prefix is only an IPv4 prefix from /96 on; a
+		// shorter one also covers addresses that are not mapped.
+		if prefix.Addr().Is4In6() {
+			if prefix.Bits() < 96 {
+				return netip.Prefix{}, fmt.Errorf("%q mixes IPv4-mapped and IPv6 addresses", entry)
+			}
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an address or CIDR", entry)
+	}
+	return netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()), nil
+}
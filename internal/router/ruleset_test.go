@@ -0,0 +1,207 @@
+package router
+
+import (
+	"bytes"
+	"io"
+	"myproxy/pkg/models"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRuleSetRoundTrip(t *testing.T) {
+	tests := []struct {
+		typ     string
+		entries []string
+		want    []string
+	}{
+		{
+			RuleSetDomain,
+			[]string{"a.com", "*.b.com", "domain:c.com", "full:d.com", "keyword:ads", `regexp:^x\d$`},
+			[]string{"domain:a.com", "domain:b.com", "domain:c.com", "full:d.com", "keyword:ads", `regexp:^x\d$`},
+		},
+		{
+			RuleSetIP,
+			[]string{"10.0.0.0/8", "10.1.2.3/8", "192.0.2.1", "2001:db8::/32", "::ffff:198.51.100.0/120", "::ffff:203.0.113.9", "us", "private"},
+			[]string{"10.0.0.0/8", "10.0.0.0/8", "192.0.2.1/32", "2001:db8::/32", "198.51.100.0/24", "203.0.113.9/32", "US", "PRIVATE"},
+		},
+		{RuleSetIP, nil, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := EncodeRuleSet(&buf, tt.typ, tt.entries); err != nil {
+				t.Fatal(err)
+			}
+			got, err := decodeRuleSet(&buf, tt.typ)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeRuleSetErrors(t *testing.T) {
+	tests := []struct {
+		typ     string
+		entries []string
+	}{
+		{RuleSetIP, []string{"USA"}},
+		{RuleSetIP, []string{"10.0.0.0/33"}},
+		{RuleSetIP, []string{"example.com"}},
+		{RuleSetDomain, []string{"regexp:("}},
+		{"port", nil},
+	}
+	for _, tt := range tests {
+		if err := EncodeRuleSet(io.Discard, tt.typ, tt.entries); err == nil {
+			t.Errorf("EncodeRuleSet(%s, %q) succeeded", tt.typ, tt.entries)
+		}
+	}
+}
+
+func TestRuleSetDecodeErrors(t *testing.T) {
+	var domains bytes.Buffer
+	if err := EncodeRuleSet(&domains, RuleSetDomain, []string{"a.com"}); err != nil {
+		t.Fatal(err)
+	}
+	// raw returns a version 1 rule set with the given type and entries.
+	raw := func(b ...byte) []byte {
+		return append([]byte{'M', 'P', 'R', 'S', ruleSetVersion}, b...)
+	}
+
+	tests := []struct {
+		name string
+		data []byte
+		typ  string
+	}{
+		{"wrong type", domains.Bytes(), RuleSetIP},
+		{"not a rule set", []byte("a.com\nb.com\n"), RuleSetDomain},
+		{"truncated", domains.Bytes()[:domains.Len()-1], RuleSetDomain},
+		{"empty", nil, RuleSetDomain},
+		{"unknown type", raw(9, 0), RuleSetIP},
+		{"unknown domain kind", raw(typeDomain, 1, 7, 1, 'a'), RuleSetDomain},
+		{"unknown family", raw(typeIP, 1, 5, 8, 10, 0, 0, 0), RuleSetIP},
+		{"prefix too long", raw(typeIP, 1, familyIPv4, 33, 10, 0, 0, 0), RuleSetIP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := decodeRuleSet(bytes.NewReader(tt.data), tt.typ); err == nil {
+				t.Error("decode succeeded")
+			}
+		})
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    string
+		wantErr bool
+	}{
+		{"10.1.2.3/8", "10.0.0.0/8", false},
+		{" 192.0.2.1 ", "192.0.2.1/32", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"::ffff:192.0.2.1", "192.0.2.1/32", false},
+		{"::ffff:192.0.2.0/120", "192.0.2.0/24", false},
+		{"::ffff:0:0/96", "0.0.0.0/0", false},
+		{"::ffff:0:0/95", "", true},
+		{"::ffff:0:0/64", "", true},
+		{"10.0.0.0/33", "", true},
+		{"example.com", "", true},
+	}
+	for _, tt := range tests {
+		got, err := parsePrefix(tt.entry)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePrefix(%q) error = %v, want error %v", tt.entry, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("parsePrefix(%q) = %s, want %s", tt.entry, got, tt.want)
+		}
+	}
+}
+
+func TestReadEntries(t *testing.T) {
+	got, err := ReadEntries(strings.NewReader("# list\na.com\n\n  b.com  # trailing\n#c.com\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.com", "b.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadEntries() = %q, want %q", got, want)
+	}
+}
+
+func TestRuleSetRules(t *testing.T) {
+	dir := t.TempDir()
+	domains := filepath.Join(dir, "domains.txt")
+	if err := os.WriteFile(domains, []byte("ads.com\n# comment\nfull:track.net\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ips := filepath.Join(dir, "ips.bin")
+	var buf bytes.Buffer
+	if err := EncodeRuleSet(&buf, RuleSetIP, []string{"198.51.100.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(ips, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	use(t, &models.Routing{
+		Final: "proxy",
+		RuleSets: []*models.RuleSet{
+			{Tag: "ads", Type: RuleSetDomain, Path: domains},
+			{Tag: "cdn", Type: RuleSetIP, Format: RuleSetBinary, Path: ips},
+		},
+		Rules: []*models.Rule{
+			{RuleSet: []string{"ads"}, OutTag: "block"},
+			{RuleSet: []string{"cdn", "!ads"}, OutTag: "cdn-out"},
+		},
+	})
+
+	tests := []struct {
+		host string
+		ip   string
+		want string
+	}{
+		{"x.ads.com", "192.0.2.1", "block"},
+		{"track.net", "192.0.2.1", "block"},
+		{"www.track.net", "192.0.2.1", "proxy"},
+		{"img.example", "198.51.100.7", "cdn-out"},
+		{"img.example", "192.0.2.1", "proxy"},
+	}
+	for _, tt := range tests {
+		r := Router{Host: tt.host, DstAddr: net.ParseIP(tt.ip)}
+		if got := r.Process(); got != tt.want {
+			t.Errorf("Process(%s, %s) = %s, want %s", tt.host, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestNewRuleSetErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *models.RuleSet
+	}{
+		{"no tag", &models.RuleSet{Type: RuleSetDomain, Path: "x"}},
+		{"bad type", &models.RuleSet{Tag: "a", Type: "port", Path: "x"}},
+		{"bad format", &models.RuleSet{Tag: "a", Type: RuleSetIP, Format: "json", Path: "x"}},
+		{"missing file", &models.RuleSet{Tag: "a", Type: RuleSetIP, Path: filepath.Join(t.TempDir(), "none")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newRuleSet(tt.c); err == nil {
+				t.Error("newRuleSet succeeded")
+			}
+		})
+	}
+
+	if _, err := build(&models.Routing{Rules: []*models.Rule{{RuleSet: []string{"missing"}, OutTag: "a"}}}); err == nil {
+		t.Error("build accepted a rule with an unknown rule set")
+	}
+}
@@ -0,0 +1,131 @@
+package router
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"go.uber.org/zap"
+	"myproxy/internal/mlog"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const reloadDelay = 500 * time.Millisecond
+
+var (
+	watcher   *fsnotify.Watcher
+	watched   map[string]*ruleSet
+	timers    map[string]*time.Timer
+	watcherMu sync.Mutex
+)
+
+// watch replaces the set of watched rule set files. Directories are watched
+// rather than files so that lists replaced by rename are picked up too.
+func watch(sets []*ruleSet) error {
+	watcherMu.Lock()
+	defer watcherMu.Unlock()
+
+	// Reloads still pending belong to the sets being replaced.
+	for _, t := range timers {
+		t.Stop()
+	}
+	if watcher != nil {
+		_ = watcher.Close()
+		watcher = nil
+	}
+	watched = make(map[string]*ruleSet)
+	timers = make(map[string]*time.Timer)
+
+	if len(sets) == 0 {
+		return nil
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	dirs := make(map[string]struct{})
+	for _, s := range sets {
+		path, err := filepath.Abs(s.Path)
+		if err != nil {
+			_ = w.Close()
+			return err
+		}
+		watched[path] = s
+		dirs[filepath.Dir(path)] = struct{}{}
+	}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			_ = w.Close()
+			return err
+		}
+	}
+
+	watcher = w
+	go loop(w)
+	return nil
+}
+
+func unwatch() error {
+	watcherMu.Lock()
+	defer watcherMu.Unlock()
+
+	for _, t := range timers {
+		t.Stop()
+	}
+	timers = nil
+	if watcher == nil {
+		return nil
+	}
+	err := watcher.Close()
+	watcher = nil
+	return err
+}
+
+func loop(w *fsnotify.Watcher) {
+	for {
+		select {
+		case event, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+				continue
+			}
+			schedule(w, filepath.Clean(event.Name))
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			mlog.Error("rule set watcher", zap.Error(err))
+		}
+	}
+}
+
+// schedule reloads a rule set once its file has been quiet for reloadDelay,
+// so a list written in several chunks is only parsed once.
+func schedule(w *fsnotify.Watcher, path string) {
+	watcherMu.Lock()
+	defer watcherMu.Unlock()
+
+	if w != watcher {
+		return
+	}
+	s, ok := watched[path]
+	if !ok {
+		return
+	}
+
+	if t, ok := timers[path]; ok {
+		t.Reset(reloadDelay)
+		return
+	}
+	timers[path] = time.AfterFunc(reloadDelay, func() {
+		if err := s.load(); err != nil {
+			mlog.Error("reload rule set, keeping previous entries", zap.Error(err))
+			return
+		}
+		mlog.Warn(fmt.Sprintf("reloaded rule set %s with %d entries", s.Tag, s.size()))
+	})
+}
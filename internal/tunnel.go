@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"myproxy/internal/auth"
+	"myproxy/pkg/io"
+	"myproxy/pkg/models"
+	"myproxy/pkg/protocol"
+	"myproxy/pkg/util/packet"
+)
+
+// OpenStream opens a pooled stream to the node of an outbound and sends the
+// initial packet, signed with the outbound's credentials.
+func OpenStream(ctx context.Context, info OutSeverInfo, i *models.InitialPacket) (*io.Pipe, error) {
+	stream, err := protocol.StreamPool(ctx, info.NodeAddr())
+	if err != nil {
+		return nil, err
+	}
+
+	i.Proof = auth.Sign(info.User, info.Token)
+
+	payload, err := json.Marshal(i)
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+
+	// The proof may carry a certificate, so the packet is length-prefixed
+	// rather than read in one go.
+	_, err = stream.Write(packet.EnPacket(payload))
+	if err != nil {
+		_ = stream.Close()
+		return nil, err
+	}
+	stream.Flush()
+
+	return stream, nil
+}
@@ -4,3 +4,17 @@ type Future interface {
 	Run() error
 	Close() error
 }
+
+// Reloadable is a Future that can apply a changed config section in place.
+// A nil section means the section was removed from the config.
+type Reloadable interface {
+	Future
+	Reload(v any) error
+}
+
+// Checker is a Reloadable that can tell whether it would accept a section
+// without applying it.
+type Checker interface {
+	Reloadable
+	Check(v any) error
+}
@@ -36,7 +36,14 @@ func Copy(dst io.ReadWriteCloser, src io.ReadWriteCloser) {
 }
 
 type Pipe struct {
-	Stream *quic.Stream
+	Stream  *quic.Stream
+	release func()
+	once    sync.Once
+}
+
+// NewPipe wraps stream and calls release once when the pipe is closed.
+func NewPipe(stream *quic.Stream, release func()) *Pipe {
+	return &Pipe{Stream: stream, release: release}
 }
 
 func (p *Pipe) Read(b []byte) (n int, err error) {
@@ -47,6 +54,13 @@ func (p *Pipe) Write(b []byte) (n int, err error) {
 	return p.Stream.Write(b)
 }
 
+func (p *Pipe) Flush() {
+	p.Stream.Flush()
+}
+
 func (p *Pipe) Close() error {
+	if p.release != nil {
+		p.once.Do(p.release)
+	}
 	return p.Stream.Close()
 }
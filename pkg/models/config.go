@@ -7,10 +7,27 @@ import (
 	"time"
 )
 
+// InitialPacket opens a tunnel stream. ConnID is the ID the client gave the
+// connection at its inbound, logged on both sides.
 type InitialPacket struct {
 	Protocol string   `json:"protocol"`
 	Content  []byte   `json:"content"`
 	Request  *Request `json:"request"`
+	Proof    *Proof   `json:"proof,omitempty"`
+	ConnID   string   `json:"connId,omitempty"`
+}
+
+// Proof authenticates a client without sending its token: MAC is the
+// HMAC-SHA256 of "user|time|nonce" keyed with the user's token, or with the
+// pre-shared key when User is empty. Clients with a certificate also send it
+// as Cert with Sig, a signature of the same message made with its key.
+type Proof struct {
+	User  string `json:"user"`
+	Time  int64  `json:"time"`
+	Nonce string `json:"nonce"`
+	MAC   string `json:"mac,omitempty"`
+	Cert  []byte `json:"cert,omitempty"`
+	Sig   []byte `json:"sig,omitempty"`
 }
 
 type Request struct {
@@ -25,18 +42,126 @@ type Packet struct {
 }
 
 type Config struct {
-	Log       *Log        `json:"log"`
-	Transfer  *Transfer   `json:"transfer"`
-	Inbounds  []*Inbound  `json:"inbounds"`
-	Outbounds []*Outbound `json:"outbounds"`
-	Endpoint  *Endpoint   `json:"endpoint"`
-	Routing   *Routing    `json:"routing"`
+	Log            *Log             `json:"log"`
+	Transfer       *Transfer        `json:"transfer"`
+	Inbounds       []*Inbound       `json:"inbounds"`
+	Outbounds      []*Outbound      `json:"outbounds"`
+	OutboundGroups []*OutboundGroup `json:"outboundGroups"`
+	Endpoint       *Endpoint        `json:"endpoint"`
+	Routing        *Routing         `json:"routing"`
+	DNS            *DNS             `json:"dns"`
+	Direct         *Direct          `json:"direct"`
+	Admin          *Admin           `json:"admin"`
+	Metrics        *Metrics         `json:"metrics"`
+}
+
+// DNS selects the upstream servers destinations are resolved with. Names
+// matched by a rule go to its server, others to Final, or to the first server
+// when Final is empty. Without servers the system resolver is used.
+type DNS struct {
+	Servers []*DNSServer `json:"servers"`
+	Rules   []*DNSRule   `json:"rules"`
+	Final   string       `json:"final"`
+	Cache   *DNSCache    `json:"cache"`
+	FakeIP  *FakeIP      `json:"fakeIP"`
+}
+
+// FakeIP makes dns inbounds answer A queries with addresses drawn from
+// Range, 198.18.0.0/15 by default, and AAAA queries with no address. Inbounds
+// map connections to these addresses back to the name, so they are routed
+// and dialed by name. Only names matching Domain, written as in routing
+// rules, are faked; all are when it is empty. Once Range is exhausted the
+// oldest addresses are handed out again.
+type FakeIP struct {
+	Range  string   `json:"range"`
+	Domain []string `json:"domain"`
+}
+
+// DNSCache bounds the cache of resolved names. Size is the number of names
+// kept, 1024 by default. Addresses are kept for their TTL clamped to MinTTL
+// and MaxTTL, 10 seconds and an hour by default, and names that do not exist
+// for NegativeTTL, 30 seconds by default; all are in seconds. With Prefetch,
+// names looked up often are refreshed in the background shortly before they
+// expire.
+type DNSCache struct {
+	Size        int           `json:"size"`
+	MinTTL      time.Duration `json:"minTTL"`
+	MaxTTL      time.Duration `json:"maxTTL"`
+	NegativeTTL time.Duration `json:"negativeTTL"`
+	Prefetch    bool          `json:"prefetch"`
+}
+
+// DNSServer is an upstream resolver. Address is "udp://host:port",
+// "tcp://host:port", "tls://host:port" for DNS over TLS, "quic://host:port"
+// for DNS over QUIC or an "https://" URL for DNS over HTTPS; a bare
+// "host:port" is plain UDP. Ports default to 53, or 853 for tls and quic.
+// ServerName overrides the name the TLS certificate is verified against.
+// Timeout bounds one query, in seconds.
+type DNSServer struct {
+	Tag        string        `json:"tag"`
+	Address    string        `json:"address"`
+	ServerName string        `json:"serverName"`
+	Timeout    time.Duration `json:"timeout"`
+}
+
+// DNSRule sends the names matching Domain, written as in routing rules, to
+// the server tagged Server.
+type DNSRule struct {
+	Domain []string `json:"domain"`
+	Server string   `json:"server"`
+}
+
+// Direct configures how the direct outbound connects to the addresses a
+// destination resolves to. Strategy is "happyEyeballs" (default) to race
+// IPv6 and IPv4 addresses as in RFC 8305, "preferIPv4" or "preferIPv6" to
+// try the addresses of one family first, "ipv4Only" or "ipv6Only". Timeout
+// bounds each connection attempt, in seconds, 10 by default. AttemptDelay is
+// how long happyEyeballs waits on an attempt before starting the next one,
+// in milliseconds, 250 by default.
+type Direct struct {
+	Strategy     string        `json:"strategy"`
+	Timeout      time.Duration `json:"timeout"`
+	AttemptDelay time.Duration `json:"attemptDelay"`
+}
+
+// Admin enables the local admin API. Listen is a loopback host:port or
+// "unix:" followed by a socket path. When Token is set, requests must carry
+// it as a bearer token.
+type Admin struct {
+	Listen string `json:"listen"`
+	Token  string `json:"token"`
+}
+
+// Metrics enables the Prometheus endpoint, served at /metrics on Listen.
+type Metrics struct {
+	Listen string `json:"listen"`
 }
 
+// Log configures the diagnostic log. Output is empty to log to the console
+// and to daily files in LogFilePath, "stderr" or "journald" to log to the
+// standard error only. Format is "console" (default) or "json". A file is
+// rotated once it reaches MaxSize megabytes; rotated files are gzipped when
+// Compress is set and removed beyond MaxBackups files or MaxAge days. Zero
+// limits are disabled.
 type Log struct {
-	ConsoleLevel string `json:"consoleLevel"`
-	FileLevel    string `json:"fileLevel"`
-	LogFilePath  string `json:"logFilePath"`
+	ConsoleLevel string     `json:"consoleLevel"`
+	FileLevel    string     `json:"fileLevel"`
+	LogFilePath  string     `json:"logFilePath"`
+	Output       string     `json:"output"`
+	Format       string     `json:"format"`
+	MaxSize      int        `json:"maxSize"`
+	MaxAge       int        `json:"maxAge"`
+	MaxBackups   int        `json:"maxBackups"`
+	Compress     bool       `json:"compress"`
+	Access       *AccessLog `json:"access"`
+}
+
+// AccessLog writes one record per finished connection to Path, or to the
+// standard output when Path is "stdout". Format is "json" (default) for JSON
+// lines or "text". Records are written whatever the log levels are.
+type AccessLog struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
 }
 
 type Transfer struct {
@@ -52,9 +177,22 @@ type Obfuscation struct {
 
 type Endpoint struct {
 	RandPort string `json:"randPort"`
+	Auth     *Auth  `json:"auth"`
 	*NetAddr
 }
 
+// Auth lists the credentials the endpoint accepts: a pre-shared key for all
+// clients and tokens for named users.
+type Auth struct {
+	Psk   string  `json:"psk"`
+	Users []*User `json:"users"`
+}
+
+type User struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+}
+
 type QUICConfig struct {
 	MaxBidiRemoteStreams     uint64        `json:"maxBidiRemoteStreams"`
 	MaxUniRemoteStreams      uint64        `json:"maxUniRemoteStreams"`
@@ -67,10 +205,21 @@ type QUICConfig struct {
 	KeepAlivePeriod          time.Duration `json:"keepAlivePeriod"`
 }
 
+// Tls configures the tunnel certificates. Crt and Key are this node's
+// certificate: the server certificate on an endpoint, the client certificate
+// on a client. Ca verifies the endpoint, ClientCa verifies clients according
+// to ClientAuth: "none", "request", "verifyIfGiven" or "require", which is
+// the default once ClientCa is set. Without Crt and Key the endpoint uses a
+// self-signed certificate; its key is kept at GeneratedKey when set, so pins
+// on that key survive restarts.
 type Tls struct {
-	Crt      string `json:"crt"`
-	Key      string `json:"key"`
-	Insecure bool   `json:"insecure"`
+	Crt          string `json:"crt"`
+	Key          string `json:"key"`
+	Ca           string `json:"ca"`
+	ClientCa     string `json:"clientCa"`
+	ClientAuth   string `json:"clientAuth"`
+	GeneratedKey string `json:"generatedKey"`
+	Insecure     bool   `json:"insecure"`
 }
 
 type NetAddr struct {
@@ -100,18 +249,65 @@ type Setting struct {
 }
 
 type Outbound struct {
-	Tag      string `json:"tag"`
-	Address  string `json:"address"`
-	Port     uint16 `json:"port"`
-	NodePort uint16 `json:"nodePort"`
+	Tag      string       `json:"tag"`
+	Address  string       `json:"address"`
+	Port     uint16       `json:"port"`
+	NodePort uint16       `json:"nodePort"`
+	User     string       `json:"user"`
+	Token    string       `json:"token"`
+	Pins     []string     `json:"pins"`
+	Health   *HealthCheck `json:"health"`
+}
+
+// HealthCheck tunes the outbound prober. Interval and Timeout are in seconds,
+// Rise and Fall are the consecutive successes and failures needed to mark the
+// outbound up and down.
+type HealthCheck struct {
+	Interval time.Duration `json:"interval"`
+	Timeout  time.Duration `json:"timeout"`
+	Rise     int           `json:"rise"`
+	Fall     int           `json:"fall"`
+}
+
+// OutboundGroup balances traffic over several outbounds. Strategy is one of
+// roundRobin (default), random, leastActive, lowestLatency or failover.
+type OutboundGroup struct {
+	Tag       string   `json:"tag"`
+	Outbounds []string `json:"outbounds"`
+	Strategy  string   `json:"strategy"`
 }
 
 type Routing struct {
-	Rules []*Rule `json:"rules"`
+	Rules    []*Rule    `json:"rules"`
+	RuleSets []*RuleSet `json:"ruleSets"`
+	// Final is the outbound used when no rule matches. It is required when
+	// more than one outbound or group is declared; otherwise it defaults to
+	// the only outbound, or direct if there is none.
+	Final string `json:"final"`
+	// DomainStrategy is "ipOnDemand" (default) to resolve domain
+	// destinations locally when an IP condition is evaluated for them, or
+	// "asIs" to never resolve them locally: IP conditions only match IP
+	// destinations and domains are resolved by the endpoint.
+	DomainStrategy string `json:"domainStrategy"`
 }
 
 type Rule struct {
-	InTag  string   `json:"inTag"`
-	OutTag string   `json:"outTag"`
-	IP     []string `json:"ip"`
+	InTag   string   `json:"inTag"`
+	OutTag  string   `json:"outTag"`
+	IP      []string `json:"ip"`
+	Domain  []string `json:"domain"`
+	Source  []string `json:"source"`
+	Port    string   `json:"port"`
+	Network string   `json:"network"`
+	RuleSet []string `json:"ruleSet"`
+	User    []string `json:"user"`
+}
+
+// RuleSet is an external domain or IP list referenced by rules through its
+// tag. Type is "domain" or "ip", Format is "text" (default) or "binary".
+type RuleSet struct {
+	Tag    string `json:"tag"`
+	Type   string `json:"type"`
+	Format string `json:"format"`
+	Path   string `json:"path"`
 }
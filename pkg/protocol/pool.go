@@ -4,9 +4,13 @@ import (
 	"context"
 	"fmt"
 	"golang.org/x/net/quic"
+	"myproxy/internal/metrics"
+	"myproxy/pkg/io"
 	"myproxy/pkg/models"
 	net2 "myproxy/pkg/util/net"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type poolEntry struct {
@@ -14,13 +18,47 @@ type poolEntry struct {
 	endpoint *quic.Endpoint
 }
 
+type poolStats struct {
+	active   atomic.Int64
+	rtt      atomic.Int64
+	failures atomic.Int64
+	lastFail atomic.Int64
+}
+
 type ConnPool struct {
 	mu    sync.Mutex
 	conns map[string]*poolEntry
+	stats map[string]*poolStats
+}
+
+// PoolState is a snapshot of the pooled connection to one remote address.
+type PoolState struct {
+	Connected bool
+	Active    int64
+	RTT       time.Duration
+	Failures  int64
+	LastFail  time.Time
 }
 
 var defaultPool = &ConnPool{
 	conns: make(map[string]*poolEntry),
+	stats: make(map[string]*poolStats),
+}
+
+func (p *ConnPool) statsOf(key string) *poolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.stats[key]
+	if !ok {
+		s = &poolStats{}
+		p.stats[key] = s
+	}
+	return s
+}
+
+func (s *poolStats) fail() {
+	s.failures.Add(1)
+	s.lastFail.Store(time.Now().UnixNano())
 }
 
 func GetConn(ctx context.Context, remoteAddr *models.NetAddr) (*quic.Conn, error) {
@@ -38,10 +76,13 @@ func GetConn(ctx context.Context, remoteAddr *models.NetAddr) (*quic.Conn, error
 		return nil, err
 	}
 
+	start := time.Now()
 	conn, err := GetEndPointDial(ctx, ep, remoteAddr)
 	if err != nil {
+		_ = ep.Close(context.Background())
 		return nil, err
 	}
+	defaultPool.statsOf(key).rtt.Store(int64(time.Since(start)))
 
 	defaultPool.mu.Lock()
 	if entry, ok := defaultPool.conns[key]; ok {
@@ -51,6 +92,7 @@ func GetConn(ctx context.Context, remoteAddr *models.NetAddr) (*quic.Conn, error
 	}
 	defaultPool.conns[key] = &poolEntry{conn: conn, endpoint: ep}
 	defaultPool.mu.Unlock()
+	metrics.PoolConns.Inc()
 	return conn, nil
 }
 
@@ -59,26 +101,65 @@ func RemoveConn(netAddr *models.NetAddr) {
 	defaultPool.mu.Lock()
 	if entry, ok := defaultPool.conns[key]; ok {
 		delete(defaultPool.conns, key)
+		metrics.PoolConns.Dec()
 		entry.conn.Close()
 		entry.endpoint.Close(context.Background())
 	}
 	defaultPool.mu.Unlock()
 }
 
-func StreamPool(ctx context.Context, remoteAddr *models.NetAddr) (*quic.Stream, error) {
+// StreamPool opens a stream on the pooled connection to remoteAddr, redialing
+// once if the connection is gone. The stream counts as active until the
+// returned pipe is closed.
+func StreamPool(ctx context.Context, remoteAddr *models.NetAddr) (*io.Pipe, error) {
+	stats := defaultPool.statsOf(remoteAddr.String())
+
 	conn, err := GetConn(ctx, remoteAddr)
 	if err != nil {
+		stats.fail()
 		return nil, fmt.Errorf("pool dial %s: %w", remoteAddr.String(), err)
 	}
 
 	stream, err := conn.NewStream(ctx)
 	if err != nil {
 		RemoveConn(remoteAddr)
+		metrics.PoolReconnects.Inc()
 		conn, err = GetConn(ctx, remoteAddr)
 		if err != nil {
+			stats.fail()
 			return nil, fmt.Errorf("pool redial %s: %w", remoteAddr.String(), err)
 		}
-		return conn.NewStream(ctx)
+		stream, err = conn.NewStream(ctx)
+		if err != nil {
+			stats.fail()
+			return nil, err
+		}
+	}
+
+	stats.failures.Store(0)
+	stats.active.Add(1)
+	return io.NewPipe(stream, func() {
+		stats.active.Add(-1)
+	}), nil
+}
+
+// State returns the pool state of remoteAddr.
+func State(remoteAddr *models.NetAddr) PoolState {
+	key := remoteAddr.String()
+
+	defaultPool.mu.Lock()
+	_, connected := defaultPool.conns[key]
+	defaultPool.mu.Unlock()
+
+	s := defaultPool.statsOf(key)
+	state := PoolState{
+		Connected: connected,
+		Active:    s.active.Load(),
+		RTT:       time.Duration(s.rtt.Load()),
+		Failures:  s.failures.Load(),
+	}
+	if t := s.lastFail.Load(); t != 0 {
+		state.LastFail = time.Unix(0, t)
 	}
-	return stream, nil
+	return state
 }
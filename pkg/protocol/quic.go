@@ -2,15 +2,18 @@ package protocol
 
 import (
 	"context"
+	tls2 "crypto/tls"
 	"golang.org/x/net/quic"
 	"myproxy/pkg/models"
 	"myproxy/pkg/shared"
 	"myproxy/pkg/util/tls"
+	"sync"
 	"time"
 )
 
 var (
 	Transfer *models.Transfer
+	pins     sync.Map
 )
 
 const (
@@ -31,32 +34,73 @@ func GetEndpoint(addr *models.NetAddr) (*quic.Endpoint, error) {
 }
 
 func GetEndPointDial(ctx context.Context, endpoint *quic.Endpoint, addr *models.NetAddr) (*quic.Conn, error) {
-	dial, err := endpoint.Dial(ctx, shared.NetworkQUIC, addr.String(), getCliCfg(addr.Address))
+	dial, err := endpoint.Dial(ctx, shared.NetworkQUIC, addr.String(), getCliCfg(addr))
 	return dial, err
 }
 
-func getSrvCfg() *quic.Config {
-	q := quic.Config{
-		TLSConfig: tls.GetTLSConfig(shared.ServerTLS, "", false),
+// DialQUIC connects to addr from a new client-only endpoint with tlsConfig
+// instead of the tunnel TLS settings, for protocols other than the tunnel.
+// Closing the endpoint closes the connection.
+func DialQUIC(ctx context.Context, addr string, tlsConfig *tls2.Config) (*quic.Endpoint, *quic.Conn, error) {
+	endpoint, err := quic.Listen(shared.NetworkQUIC, ":0", nil)
+	if err != nil {
+		return nil, nil, err
 	}
+
+	q := quic.Config{TLSConfig: tlsConfig}
 	convertToQUIC(&q)
+	conn, err := endpoint.Dial(ctx, shared.NetworkQUIC, addr, &q)
+	if err != nil {
+		_ = endpoint.Close(ctx)
+		return nil, nil, err
+	}
+	return endpoint, conn, nil
+}
 
-	if Transfer != nil && Transfer.TLS != nil {
-		q.TLSConfig = tls.GetTLSConfigWithCustom(shared.ServerTLS, "", Transfer.TLS.Crt, Transfer.TLS.Key, false)
+// SetPins sets the SPKI pins the server at addr must match, or clears them
+// when p is empty. Pins are kept per host and port, as endpoints sharing a
+// host may use different certificates.
+func SetPins(addr *models.NetAddr, p [][]byte) {
+	if len(p) == 0 {
+		pins.Delete(addr.String())
+		return
 	}
+	pins.Store(addr.String(), p)
+}
 
-	return &q
+func pinsOf(addr *models.NetAddr) [][]byte {
+	if p, ok := pins.Load(addr.String()); ok {
+		return p.([][]byte)
+	}
+	return nil
 }
 
-func getCliCfg(addr string) *quic.Config {
-	insecure := false
+func getSrvCfg() *quic.Config {
 	if Transfer != nil && Transfer.TLS != nil {
-		insecure = Transfer.TLS.Insecure
+		q := quic.Config{
+			TLSConfig: tls.GetTLSConfigWithCustom(shared.ServerTLS, "", Transfer.TLS, nil),
+		}
+		convertToQUIC(&q)
+		return &q
+	}
+
+	q := quic.Config{
+		TLSConfig: tls.GetTLSConfig(shared.ServerTLS, "", false, nil),
 	}
+	convertToQUIC(&q)
+	return &q
+}
+
+func getCliCfg(addr *models.NetAddr) *quic.Config {
 	q := quic.Config{
-		TLSConfig: tls.GetTLSConfig(shared.ClientTLS, addr, insecure),
+		TLSConfig: tls.GetTLSConfig(shared.ClientTLS, addr.Address, false, pinsOf(addr)),
 	}
 	convertToQUIC(&q)
+
+	if Transfer != nil && Transfer.TLS != nil {
+		q.TLSConfig = tls.GetTLSConfigWithCustom(shared.ClientTLS, addr.Address, Transfer.TLS, pinsOf(addr))
+	}
+
 	return &q
 }
 
@@ -13,4 +13,10 @@ const (
 	NetworkTCP          = "tcp"
 	HTTP                = "http"
 	SOCKS               = "socks"
+	DNS                 = "dns"
+	PING                = "ping"
+	PONG                = "pong"
+	OutboundDirect      = "direct"
+	OutboundBlock       = "block"
+	OutboundReject      = "reject"
 )
@@ -0,0 +1,157 @@
+package domain
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+const (
+	prefixFull    = "full:"
+	prefixDomain  = "domain:"
+	prefixKeyword = "keyword:"
+	prefixRegexp  = "regexp:"
+	wildcard      = "*."
+)
+
+// Matcher matches host names against full, suffix, keyword and regexp entries.
+//
+// Entries are written as "full:a.com", "domain:a.com", "keyword:ads" or
+// "regexp:^.+\.a\.com$". An entry without a prefix, or written as "*.a.com",
+// is a suffix entry: it matches the domain itself and all of its subdomains.
+// Full and suffix entries are looked up in constant time per label, so large
+// lists cost no more to match than small ones.
+type Matcher struct {
+	full    map[string]struct{}
+	suffix  *node
+	keyword []string
+	regex   []*regexp.Regexp
+	size    int
+}
+
+func New(entries []string) (*Matcher, error) {
+	m := &Matcher{full: make(map[string]struct{}), suffix: &node{}}
+	for _, entry := range entries {
+		if err := m.Add(entry); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *Matcher) Add(entry string) error {
+	entry = strings.TrimSpace(entry)
+	switch {
+	case entry == "":
+		return errors.New("empty domain entry")
+	case strings.HasPrefix(entry, prefixFull):
+		m.full[Normalize(entry[len(prefixFull):])] = struct{}{}
+	case strings.HasPrefix(entry, prefixDomain):
+		m.suffix.insert(Normalize(entry[len(prefixDomain):]))
+	case strings.HasPrefix(entry, prefixKeyword):
+		m.keyword = append(m.keyword, strings.ToLower(entry[len(prefixKeyword):]))
+	case strings.HasPrefix(entry, prefixRegexp):
+		re, err := regexp.Compile(entry[len(prefixRegexp):])
+		if err != nil {
+			return err
+		}
+		m.regex = append(m.regex, re)
+	case strings.HasPrefix(entry, wildcard):
+		m.suffix.insert(Normalize(entry[len(wildcard):]))
+	default:
+		m.suffix.insert(Normalize(entry))
+	}
+	m.size++
+	return nil
+}
+
+func (m *Matcher) Match(host string) bool {
+	if m == nil || host == "" {
+		return false
+	}
+	host = Normalize(host)
+
+	if _, ok := m.full[host]; ok {
+		return true
+	}
+	if m.suffix.match(host) {
+		return true
+	}
+	for _, k := range m.keyword {
+		if strings.Contains(host, k) {
+			return true
+		}
+	}
+	for _, re := range m.regex {
+		if re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *Matcher) Empty() bool {
+	return m == nil || m.size == 0
+}
+
+// Len returns the number of entries added to the matcher.
+func (m *Matcher) Len() int {
+	if m == nil {
+		return 0
+	}
+	return m.size
+}
+
+func Normalize(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// node is a label trie keyed from the top-level domain down.
+type node struct {
+	children map[string]*node
+	end      bool
+}
+
+func (n *node) insert(domain string) {
+	cur := n
+	for domain != "" {
+		i := strings.LastIndexByte(domain, '.')
+		label := domain[i+1:]
+
+		if cur.children == nil {
+			cur.children = make(map[string]*node)
+		}
+		child, ok := cur.children[label]
+		if !ok {
+			child = &node{}
+			cur.children[label] = child
+		}
+		cur = child
+
+		if i < 0 {
+			break
+		}
+		domain = domain[:i]
+	}
+	cur.end = true
+}
+
+func (n *node) match(host string) bool {
+	cur := n
+	for host != "" {
+		i := strings.LastIndexByte(host, '.')
+		cur = cur.children[host[i+1:]]
+		if cur == nil {
+			return false
+		}
+		if cur.end {
+			return true
+		}
+
+		if i < 0 {
+			break
+		}
+		host = host[:i]
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package domain
+
+import "testing"
+
+func TestMatcher(t *testing.T) {
+	m, err := New([]string{
+		"full:exact.com",
+		"domain:suffix.com",
+		"keyword:ads",
+		`regexp:^cdn\d+\.img\.net$`,
+		"*.wild.org",
+		"plain.io",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"exact.com", true},
+		{"www.exact.com", false},
+		{"suffix.com", true},
+		{"a.b.suffix.com", true},
+		{"notsuffix.com", false},
+		{"myads.example", true},
+		{"cdn12.img.net", true},
+		{"cdn.img.net", false},
+		{"wild.org", true},
+		{"x.wild.org", true},
+		{"plain.io", true},
+		{"sub.plain.io", true},
+		{"io", false},
+		{"EXACT.COM.", true},
+		{"Sub.Suffix.Com", true},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := m.Match(tt.host); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+	}{
+		{"empty entry", []string{"a.com", "  "}},
+		{"bad regexp", []string{"regexp:("}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := New(tt.entries); err == nil {
+				t.Errorf("New(%q) succeeded", tt.entries)
+			}
+		})
+	}
+}
+
+func TestEmpty(t *testing.T) {
+	var nilMatcher *Matcher
+	if !nilMatcher.Empty() || nilMatcher.Match("a.com") || nilMatcher.Len() != 0 {
+		t.Error("nil matcher is not empty")
+	}
+
+	m, err := New([]string{"a.com", "full:b.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Empty() || m.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", m.Len())
+	}
+}
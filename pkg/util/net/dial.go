@@ -0,0 +1,247 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"myproxy/pkg/models"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// Strategies of the direct dialer.
+const (
+	StrategyHappyEyeballs = "happyEyeballs"
+	StrategyPreferIPv4    = "preferIPv4"
+	StrategyPreferIPv6    = "preferIPv6"
+	StrategyIPv4Only      = "ipv4Only"
+	StrategyIPv6Only      = "ipv6Only"
+
+	defaultAttemptTimeout = 10 * time.Second
+	defaultAttemptDelay   = 250 * time.Millisecond
+)
+
+var direct atomic.Pointer[dialer]
+
+func init() {
+	d, _ := newDialer(nil)
+	direct.Store(d)
+}
+
+type dialer struct {
+	strategy string
+	timeout  time.Duration
+	delay    time.Duration
+}
+
+func newDialer(c *models.Direct) (*dialer, error) {
+	if c == nil {
+		c = &models.Direct{}
+	}
+
+	d := &dialer{strategy: c.Strategy}
+	switch c.Strategy {
+	case "":
+		d.strategy = StrategyHappyEyeballs
+	case StrategyHappyEyeballs, StrategyPreferIPv4, StrategyPreferIPv6, StrategyIPv4Only, StrategyIPv6Only:
+	default:
+		return nil, fmt.Errorf("direct.strategy: unknown strategy %q", c.Strategy)
+	}
+	if c.Timeout < 0 || c.AttemptDelay < 0 {
+		return nil, errors.New("direct: negative duration")
+	}
+	d.timeout = orDefault(c.Timeout*time.Second, defaultAttemptTimeout)
+	d.delay = orDefault(c.AttemptDelay*time.Millisecond, defaultAttemptDelay)
+	return d, nil
+}
+
+// SetDirect configures the direct dialer, with the defaults when c is nil.
+func SetDirect(c *models.Direct) error {
+	d, err := newDialer(c)
+	if err != nil {
+		return err
+	}
+	direct.Store(d)
+	return nil
+}
+
+// CheckDirect checks c without applying it.
+func CheckDirect(c *models.Direct) error {
+	_, err := newDialer(c)
+	return err
+}
+
+// DialOrder returns the addresses of ips the direct dialer would try, in the
+// order it would try them.
+func DialOrder(ips []net.IP) []net.IP {
+	return direct.Load().order(ips)
+}
+
+type addrsKey struct{}
+
+type dialAddrs struct {
+	host string
+	ips  []net.IP
+}
+
+// WithAddrs returns a context in which DialContext connects to host only
+// through ips, the addresses a routing rule matched. ctx is returned as is
+// when ips is nil.
+func WithAddrs(ctx context.Context, host string, ips []net.IP) context.Context {
+	if ips == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, addrsKey{}, dialAddrs{host, ips})
+}
+
+// Dial connects to address with the direct dialer.
+func Dial(network, address string) (net.Conn, error) {
+	return DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address, resolving its host through LookupIP
+// unless ctx restricts it to addresses set by WithAddrs, and tries its
+// addresses as the strategy of the direct dialer says. Each attempt is
+// bounded by the attempt timeout.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IP
+	if a, ok := ctx.Value(addrsKey{}).(dialAddrs); ok && a.host == host {
+		ips = a.ips
+	} else if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else if ips, err = LookupIP(host); err != nil {
+		return nil, err
+	}
+
+	d := direct.Load()
+	ips = d.order(ips)
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no address for " + d.strategy, Name: host}
+	}
+	if d.strategy == StrategyHappyEyeballs && len(ips) > 1 {
+		return d.race(ctx, network, port, ips)
+	}
+
+	for _, ip := range ips {
+		var conn net.Conn
+		conn, err = d.attempt(ctx, network, ip, port)
+		if err == nil || ctx.Err() != nil {
+			return conn, err
+		}
+	}
+	return nil, err
+}
+
+// order returns the addresses to try, in the order to try them. The
+// addresses of ips, which may be shared, are not reordered in place.
+func (d *dialer) order(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch d.strategy {
+	case StrategyIPv4Only:
+		return v4
+	case StrategyIPv6Only:
+		return v6
+	case StrategyPreferIPv4:
+		return append(v4, v6...)
+	case StrategyPreferIPv6:
+		return append(v6, v4...)
+	}
+
+	// Happy Eyeballs alternates the families, starting with IPv6.
+	all := make([]net.IP, 0, len(ips))
+	for i := 0; i < max(len(v4), len(v6)); i++ {
+		if i < len(v6) {
+			all = append(all, v6[i])
+		}
+		if i < len(v4) {
+			all = append(all, v4[i])
+		}
+	}
+	return all
+}
+
+func (d *dialer) attempt(ctx context.Context, network string, ip net.IP, port string) (net.Conn, error) {
+	nd := net.Dialer{Timeout: d.timeout}
+	return nd.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+}
+
+// race connects to the first of ips that answers, as in RFC 8305. An attempt
+// is started every attempt delay, or as soon as the previous one fails,
+// until one succeeds; the others are then cancelled.
+func (d *dialer) race(ctx context.Context, network, port string, ips []net.IP) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	// Buffered for every attempt, so late ones never block.
+	results := make(chan result, len(ips))
+
+	next, pending := 0, 0
+	timer := time.NewTimer(d.delay)
+	defer timer.Stop()
+	start := func() {
+		ip := ips[next]
+		next++
+		pending++
+		go func() {
+			conn, err := d.attempt(ctx, network, ip, port)
+			results <- result{conn, err}
+		}()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(d.delay)
+	}
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// Attempts may connect before they see the cancellation.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if late := <-results; late.conn != nil {
+							_ = late.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) && ctx.Err() == nil {
+				start()
+			}
+		case <-timer.C:
+			if next < len(ips) && ctx.Err() == nil {
+				start()
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,201 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"myproxy/pkg/models"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func ips(addrs ...string) []net.IP {
+	var v []net.IP
+	for _, a := range addrs {
+		v = append(v, net.ParseIP(a))
+	}
+	return v
+}
+
+func TestDialerOrder(t *testing.T) {
+	mixed := ips("192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1", "2001:db8::2")
+	tests := []struct {
+		strategy string
+		in       []net.IP
+		want     []net.IP
+	}{
+		{StrategyHappyEyeballs, mixed, ips("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3")},
+		{StrategyHappyEyeballs, ips("192.0.2.1", "192.0.2.2"), ips("192.0.2.1", "192.0.2.2")},
+		{StrategyHappyEyeballs, ips("2001:db8::1", "::ffff:192.0.2.1"), ips("2001:db8::1", "::ffff:192.0.2.1")},
+		{StrategyPreferIPv4, mixed, ips("192.0.2.1", "192.0.2.2", "192.0.2.3", "2001:db8::1", "2001:db8::2")},
+		{StrategyPreferIPv6, mixed, ips("2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2", "192.0.2.3")},
+		{StrategyIPv4Only, mixed, ips("192.0.2.1", "192.0.2.2", "192.0.2.3")},
+		{StrategyIPv6Only, mixed, ips("2001:db8::1", "2001:db8::2")},
+		{StrategyIPv6Only, ips("192.0.2.1"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.strategy, func(t *testing.T) {
+			in := append([]net.IP(nil), tt.in...)
+			d := &dialer{strategy: tt.strategy}
+			if got := d.order(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order() = %v, want %v", got, tt.want)
+			}
+			if !reflect.DeepEqual(tt.in, in) {
+				t.Errorf("order() reordered its argument to %v", tt.in)
+			}
+		})
+	}
+}
+
+func TestNewDialer(t *testing.T) {
+	tests := []struct {
+		name    string
+		c       *models.Direct
+		want    *dialer
+		wantErr bool
+	}{
+		{"defaults", nil, &dialer{StrategyHappyEyeballs, defaultAttemptTimeout, defaultAttemptDelay}, false},
+		{"configured", &models.Direct{Strategy: StrategyIPv4Only, Timeout: 3, AttemptDelay: 100},
+			&dialer{StrategyIPv4Only, 3 * time.Second, 100 * time.Millisecond}, false},
+		{"unknown strategy", &models.Direct{Strategy: "fastest"}, nil, true},
+		{"negative timeout", &models.Direct{Timeout: -1}, nil, true},
+		{"negative delay", &models.Direct{AttemptDelay: -1}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newDialer(tt.c)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newDialer() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && *d != *tt.want {
+				t.Errorf("newDialer() = %+v, want %+v", *d, *tt.want)
+			}
+		})
+	}
+}
+
+// listen accepts connections on 127.0.0.1 until the test is done and
+// returns the port.
+func listen(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return port
+}
+
+func TestDialerRace(t *testing.T) {
+	port := listen(t)
+	// Nothing listens on 127.0.0.2, so attempts to it are refused at once.
+	// With a long attempt delay, the tests pass in time only if a failed
+	// attempt starts the next one straight away.
+	d := &dialer{strategy: StrategyHappyEyeballs, timeout: time.Second, delay: time.Minute}
+
+	tests := []struct {
+		name    string
+		ips     []net.IP
+		wantErr bool
+	}{
+		{"first", ips("127.0.0.1", "127.0.0.2"), false},
+		{"after a failure", ips("127.0.0.2", "127.0.0.2", "127.0.0.1"), false},
+		{"all fail", ips("127.0.0.2", "127.0.0.2"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			conn, err := d.race(ctx, "tcp", port, tt.ips)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("race() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if got := conn.RemoteAddr().(*net.TCPAddr).IP.String(); got != "127.0.0.1" {
+				t.Errorf("race() connected to %s", got)
+			}
+		})
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	port := listen(t)
+	t.Cleanup(func() { _ = SetDirect(nil) })
+
+	if err := SetDirect(&models.Direct{Strategy: StrategyIPv4Only}); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("Dial() = %v", err)
+	}
+	_ = conn.Close()
+
+	if err = SetDirect(&models.Direct{Strategy: StrategyIPv6Only}); err != nil {
+		t.Fatal(err)
+	}
+	var dnsErr *net.DNSError
+	if _, err = Dial("tcp", net.JoinHostPort("127.0.0.1", port)); !errors.As(err, &dnsErr) {
+		t.Errorf("Dial() = %v, want no address for %s", err, StrategyIPv6Only)
+	}
+
+	if err = SetDirect(&models.Direct{Strategy: "fastest"}); err == nil {
+		t.Error("SetDirect accepted an unknown strategy")
+	}
+	if got := direct.Load().strategy; got != StrategyIPv6Only {
+		t.Errorf("a rejected config replaced the dialer, strategy %s", got)
+	}
+}
+
+func TestDialWithAddrs(t *testing.T) {
+	port := listen(t)
+	SetResolver(func(context.Context, string) ([]net.IP, time.Duration, error) {
+		return ips("127.0.0.2", "127.0.0.1"), time.Minute, nil
+	})
+	t.Cleanup(func() {
+		SetResolver(nil)
+		_ = SetDirect(nil)
+	})
+	if err := SetDirect(&models.Direct{Strategy: StrategyPreferIPv4, Timeout: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	address := net.JoinHostPort("a.test", port)
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		wantErr bool
+	}{
+		{"every address", context.Background(), false},
+		{"matched address", WithAddrs(context.Background(), "a.test", ips("127.0.0.1")), false},
+		{"unmatched address", WithAddrs(context.Background(), "a.test", ips("127.0.0.2")), true},
+		{"other host", WithAddrs(context.Background(), "b.test", ips("127.0.0.2")), false},
+		{"no restriction", WithAddrs(context.Background(), "a.test", nil), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := DialContext(tt.ctx, "tcp", address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DialContext() error = %v, want error %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				_ = conn.Close()
+			}
+		})
+	}
+}
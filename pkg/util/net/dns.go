@@ -1,39 +1,305 @@
 package net
 
 import (
+	"container/list"
+	"context"
+	"errors"
+	"myproxy/internal/metrics"
+	"myproxy/pkg/models"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Resolver looks up the addresses of host and how long they may be cached. A
+// negative TTL means the resolver does not know it.
+type Resolver func(ctx context.Context, host string) ([]net.IP, time.Duration, error)
+
+const (
+	defaultCacheSize   = 1024
+	defaultMinTTL      = 10 * time.Second
+	defaultMaxTTL      = time.Hour
+	defaultNegativeTTL = 30 * time.Second
+
+	// unknownTTL is used for answers of resolvers that do not report TTLs.
+	unknownTTL = 5 * time.Minute
+	// A hot entry is prefetched once less than 1/prefetchRatio of its TTL
+	// is left. Entries looked up prefetchHits times since they were stored
+	// are hot.
+	prefetchRatio = 10
+	prefetchHits  = 2
+	// Expired entries are swept at most once per sweepInterval.
+	sweepInterval = time.Minute
+)
+
+var (
+	resolver atomic.Pointer[Resolver]
+	cache    = newDNSCache(nil)
+)
+
+// SetResolver makes LookupIP resolve through r, or through the system
+// resolver when r is nil. Cached answers are dropped.
+func SetResolver(r Resolver) {
+	if r == nil {
+		resolver.Store(nil)
+	} else {
+		resolver.Store(&r)
+	}
+	cache.flush()
+}
+
+// SetCache applies the limits of c to the DNS cache, the defaults when c is
+// nil.
+func SetCache(c *models.DNSCache) {
+	cache.configure(c)
+}
+
+// CacheStats describes the DNS cache.
+type CacheStats struct {
+	Entries    int    `json:"entries"`
+	Size       int    `json:"size"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Prefetches uint64 `json:"prefetches"`
+}
+
+func DNSCacheStats() CacheStats {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	return CacheStats{
+		Entries:    cache.lru.Len(),
+		Size:       cache.size,
+		Hits:       metrics.DNSCacheHits.Value(),
+		Misses:     metrics.DNSCacheMisses.Value(),
+		Prefetches: metrics.DNSCachePrefetches.Value(),
+	}
+}
+
+// LookupIP returns the addresses of host from the cache, or resolves them.
+// Concurrent lookups of a name that is not cached share one query.
+func LookupIP(host string) ([]net.IP, error) {
+	ips, _, err := cache.lookup(host)
+	return ips, err
+}
+
+// LookupIPTTL is LookupIP that also returns how long the answer stays
+// cached, the TTL to pass on to DNS clients.
+func LookupIPTTL(host string) ([]net.IP, time.Duration, error) {
+	return cache.lookup(host)
+}
+
+func lookup(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	if r := resolver.Load(); r != nil {
+		return (*r)(ctx, host)
+	}
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+	return ips, -1, err
+}
+
 type dnsEntry struct {
+	host      string
 	ips       []net.IP
+	err       error
+	ttl       time.Duration
 	expiresAt time.Time
+	hits      int
 }
 
-var (
-	dnsCache sync.Map
-	dnsTTL   = 5 * time.Minute
-)
+// call is a lookup in flight, waited for by the lookups of the same name.
+type call struct {
+	done chan struct{}
+	ips  []net.IP
+	ttl  time.Duration
+	err  error
+}
 
-func LookupIP(host string) ([]net.IP, error) {
-	if entry, ok := dnsCache.Load(host); ok {
-		e := entry.(*dnsEntry)
-		if time.Now().Before(e.expiresAt) {
-			return e.ips, nil
+// dnsCache is a least recently used cache of answers. Addresses are kept for
+// their TTL clamped to minTTL and maxTTL, names that do not exist for
+// negativeTTL.
+type dnsCache struct {
+	mu          sync.Mutex
+	size        int
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+	prefetch    bool
+
+	lru       *list.List
+	entries   map[string]*list.Element
+	calls     map[string]*call
+	lastSweep time.Time
+}
+
+func newDNSCache(c *models.DNSCache) *dnsCache {
+	d := &dnsCache{
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		calls:   make(map[string]*call),
+	}
+	d.configure(c)
+	return d
+}
+
+func (d *dnsCache) configure(c *models.DNSCache) {
+	if c == nil {
+		c = &models.DNSCache{}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.size = orDefault(c.Size, defaultCacheSize)
+	d.minTTL = orDefault(c.MinTTL*time.Second, defaultMinTTL)
+	d.maxTTL = orDefault(c.MaxTTL*time.Second, defaultMaxTTL)
+	d.negativeTTL = orDefault(c.NegativeTTL*time.Second, defaultNegativeTTL)
+	d.prefetch = c.Prefetch
+	d.evict()
+}
+
+func orDefault[T int | time.Duration](v, def T) T {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+func (d *dnsCache) flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.lru.Init()
+	clear(d.entries)
+	metrics.DNSCacheEntries.Set(0)
+}
+
+func (d *dnsCache) lookup(host string) ([]net.IP, time.Duration, error) {
+	now := time.Now()
+
+	d.mu.Lock()
+	if e, ok := d.get(host, now); ok {
+		ips, ttl, err := e.ips, e.expiresAt.Sub(now), e.err
+		refresh := d.prefetch && err == nil && e.hits >= prefetchHits &&
+			e.expiresAt.Sub(now) < e.ttl/prefetchRatio && d.calls[host] == nil
+		if refresh {
+			// Counting again from zero keeps the next lookups from
+			// starting another prefetch.
+			e.hits = 0
 		}
-		dnsCache.Delete(host)
+		d.mu.Unlock()
+
+		metrics.DNSCacheHits.Inc()
+		if refresh {
+			metrics.DNSCachePrefetches.Inc()
+			go func() {
+				_, _, _ = d.resolve(host)
+			}()
+		}
+		return ips, ttl, err
 	}
+	d.mu.Unlock()
 
-	ips, err := net.LookupIP(host)
+	metrics.DNSCacheMisses.Inc()
+	return d.resolve(host)
+}
+
+// resolve looks host up and caches the answer, or waits for the lookup of
+// host already in flight.
+func (d *dnsCache) resolve(host string) ([]net.IP, time.Duration, error) {
+	d.mu.Lock()
+	if c, ok := d.calls[host]; ok {
+		d.mu.Unlock()
+		<-c.done
+		return c.ips, c.ttl, c.err
+	}
+	c := &call{done: make(chan struct{})}
+	d.calls[host] = c
+	d.mu.Unlock()
+
+	ips, ttl, err := lookup(context.Background(), host)
+
+	d.mu.Lock()
+	delete(d.calls, host)
+	ttl = d.store(host, ips, ttl, err, time.Now())
+	d.mu.Unlock()
+
+	c.ips, c.ttl, c.err = ips, ttl, err
+	close(c.done)
+	return ips, ttl, err
+}
+
+// get returns the live entry of host and marks it as recently used. It must
+// be called with mu held.
+func (d *dnsCache) get(host string, now time.Time) (*dnsEntry, bool) {
+	elem, ok := d.entries[host]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*dnsEntry)
+	if !now.Before(e.expiresAt) {
+		d.remove(elem)
+		return nil, false
+	}
+	d.lru.MoveToFront(elem)
+	e.hits++
+	return e, true
+}
+
+// store caches an answer and returns how long it is kept. Failures other
+// than a name not existing are not cached, so they neither replace a good
+// entry nor outlive the outage. It must be called with mu held.
+func (d *dnsCache) store(host string, ips []net.IP, ttl time.Duration, err error, now time.Time) time.Duration {
 	if err != nil {
-		return nil, err
+		var dnsErr *net.DNSError
+		if !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			return 0
+		}
+		ttl = d.negativeTTL
+	} else {
+		if ttl < 0 {
+			ttl = unknownTTL
+		}
+		ttl = min(max(ttl, d.minTTL), d.maxTTL)
+	}
+
+	e := &dnsEntry{host: host, ips: ips, err: err, ttl: ttl, expiresAt: now.Add(ttl)}
+	if elem, ok := d.entries[host]; ok {
+		elem.Value = e
+		d.lru.MoveToFront(elem)
+	} else {
+		d.entries[host] = d.lru.PushFront(e)
 	}
 
-	dnsCache.Store(host, &dnsEntry{
-		ips:       ips,
-		expiresAt: time.Now().Add(dnsTTL),
-	})
+	if now.Sub(d.lastSweep) >= sweepInterval {
+		d.lastSweep = now
+		d.sweep(now)
+	}
+	d.evict()
+	return ttl
+}
+
+// sweep removes the expired entries. It must be called with mu held.
+func (d *dnsCache) sweep(now time.Time) {
+	for elem := d.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if !now.Before(elem.Value.(*dnsEntry).expiresAt) {
+			d.remove(elem)
+		}
+		elem = next
+	}
+}
+
+// evict removes the least recently used entries beyond size. It must be
+// called with mu held.
+func (d *dnsCache) evict() {
+	for d.lru.Len() > d.size {
+		d.remove(d.lru.Back())
+	}
+	metrics.DNSCacheEntries.Set(int64(d.lru.Len()))
+}
 
-	return ips, nil
+func (d *dnsCache) remove(elem *list.Element) {
+	delete(d.entries, elem.Value.(*dnsEntry).host)
+	d.lru.Remove(elem)
+	metrics.DNSCacheEntries.Set(int64(d.lru.Len()))
 }
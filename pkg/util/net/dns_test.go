@@ -0,0 +1,162 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"myproxy/pkg/models"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	answer     = []net.IP{net.ParseIP("192.0.2.1")}
+	notFound   = &net.DNSError{Err: "no such host", Name: "gone.test", IsNotFound: true}
+	errTimeout = &net.DNSError{Err: "i/o timeout", Name: "slow.test", IsTimeout: true}
+)
+
+// useResolver installs a resolver answering from answers for the duration of
+// the test and returns the number of queries it received.
+func useResolver(t *testing.T, answers map[string]error) *atomic.Int32 {
+	t.Helper()
+	var queries atomic.Int32
+	SetResolver(func(_ context.Context, host string) ([]net.IP, time.Duration, error) {
+		queries.Add(1)
+		if err := answers[host]; err != nil {
+			return nil, 0, err
+		}
+		return answer, time.Minute, nil
+	})
+	t.Cleanup(func() { SetResolver(nil) })
+	return &queries
+}
+
+func TestDNSCacheTTL(t *testing.T) {
+	tests := []struct {
+		name string
+		c    *models.DNSCache
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{"below min", nil, time.Second, defaultMinTTL},
+		{"within limits", nil, time.Minute, time.Minute},
+		{"above max", nil, 2 * time.Hour, defaultMaxTTL},
+		{"unknown", nil, -1, unknownTTL},
+		{"configured min", &models.DNSCache{MinTTL: 30, MaxTTL: 60}, 10 * time.Second, 30 * time.Second},
+		{"configured max", &models.DNSCache{MinTTL: 30, MaxTTL: 60}, time.Hour, time.Minute},
+		{"unknown above max", &models.DNSCache{MaxTTL: 60}, -1, time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDNSCache(tt.c)
+			now := time.Now()
+			if got := d.store("a.test", answer, tt.ttl, nil, now); got != tt.want {
+				t.Errorf("store() = %v, want %v", got, tt.want)
+			}
+			if _, ok := d.get("a.test", now.Add(tt.want-time.Nanosecond)); !ok {
+				t.Error("entry expired before its TTL")
+			}
+			if _, ok := d.get("a.test", now.Add(tt.want)); ok {
+				t.Error("entry outlived its TTL")
+			}
+		})
+	}
+}
+
+func TestDNSCacheErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		want   time.Duration
+		cached bool
+	}{
+		{"not found", notFound, defaultNegativeTTL, true},
+		{"timeout", errTimeout, 0, false},
+		{"other", errors.New("connection refused"), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDNSCache(nil)
+			now := time.Now()
+			if got := d.store("a.test", nil, time.Hour, tt.err, now); got != tt.want {
+				t.Errorf("store() = %v, want %v", got, tt.want)
+			}
+			e, ok := d.get("a.test", now)
+			if ok != tt.cached {
+				t.Fatalf("cached = %v, want %v", ok, tt.cached)
+			}
+			if ok && e.err != tt.err {
+				t.Errorf("cached error = %v, want %v", e.err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDNSCacheKeepsAnswerOnFailure(t *testing.T) {
+	d := newDNSCache(nil)
+	now := time.Now()
+	d.store("a.test", answer, time.Minute, nil, now)
+	d.store("a.test", nil, 0, errTimeout, now)
+
+	e, ok := d.get("a.test", now)
+	if !ok || e.err != nil || !e.ips[0].Equal(answer[0]) {
+		t.Errorf("a failed lookup replaced the cached answer")
+	}
+}
+
+func TestDNSCacheLRU(t *testing.T) {
+	d := newDNSCache(&models.DNSCache{Size: 2})
+	now := time.Now()
+	d.store("a.test", answer, time.Minute, nil, now)
+	d.store("b.test", answer, time.Minute, nil, now)
+	d.get("a.test", now)
+	d.store("c.test", answer, time.Minute, nil, now)
+
+	for host, want := range map[string]bool{"a.test": true, "b.test": false, "c.test": true} {
+		if _, ok := d.get(host, now); ok != want {
+			t.Errorf("%s cached = %v, want %v", host, ok, want)
+		}
+	}
+
+	d.configure(&models.DNSCache{Size: 1})
+	if d.lru.Len() != 1 {
+		t.Errorf("%d entries after shrinking to 1", d.lru.Len())
+	}
+}
+
+func TestDNSCacheLookup(t *testing.T) {
+	queries := useResolver(t, map[string]error{"gone.test": notFound, "slow.test": errTimeout})
+
+	tests := []struct {
+		host        string
+		wantErr     error
+		wantQueries int32
+	}{
+		{"a.test", nil, 1},
+		{"gone.test", notFound, 1},
+		{"slow.test", errTimeout, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			queries.Store(0)
+			for i := 0; i < 3; i++ {
+				if _, _, err := LookupIPTTL(tt.host); !errors.Is(err, tt.wantErr) {
+					t.Fatalf("LookupIPTTL() = %v, want %v", err, tt.wantErr)
+				}
+			}
+			if got := queries.Load(); got != tt.wantQueries {
+				t.Errorf("%d queries, want %d", got, tt.wantQueries)
+			}
+		})
+	}
+
+	queries.Store(0)
+	SetResolver(func(context.Context, string) ([]net.IP, time.Duration, error) {
+		queries.Add(1)
+		return answer, time.Minute, nil
+	})
+	if _, err := LookupIP("a.test"); err != nil || queries.Load() != 1 {
+		t.Errorf("SetResolver did not flush the cache")
+	}
+}
@@ -64,3 +64,13 @@ func GetUdpListener() (*net.UDPConn, uint16, error) {
 
 	return l, uint16(l.LocalAddr().(*net.UDPAddr).Port), nil
 }
+
+func AddrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
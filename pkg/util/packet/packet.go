@@ -8,7 +8,10 @@ import (
 	"io"
 )
 
-const maxPayloadSize = 16 * 1024 * 1024
+// maxPayloadSize bounds a packet, which is read whole into memory before it
+// is authenticated. The largest legitimate packet is an HTTP initial packet:
+// up to 64KB of request, base64-encoded in JSON, with a certificate proof.
+const maxPayloadSize = 128 * 1024
 
 var (
 	xorKey  byte
@@ -65,12 +68,14 @@ func EnPacket(data []byte) []byte {
 	binary.Write(buffer, binary.BigEndian, l)
 	buffer.Write(data)
 
+	// DePacket always reads the padding length, even when it is zero, as
+	// data may follow the packet on the same stream.
 	if padding {
 		padLen := pad()
+		binary.Write(buffer, binary.BigEndian, uint8(padLen))
 		if padLen > 0 {
 			padBuf := make([]byte, padLen)
 			_, _ = rand.Read(padBuf)
-			binary.Write(buffer, binary.BigEndian, uint8(padLen))
 			buffer.Write(padBuf)
 		}
 	}
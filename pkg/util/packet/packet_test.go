@@ -0,0 +1,33 @@
+package packet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, pad := range []bool{false, true} {
+		InitObfuscation("key", pad)
+		var b bytes.Buffer
+		b.Write(EnPacket([]byte("first")))
+		b.Write(EnPacket([]byte("second")))
+		for _, want := range []string{"first", "second"} {
+			got, err := DePacket(&b)
+			if err != nil || string(got) != want {
+				t.Fatalf("padding %v: DePacket() = %q, %v, want %q", pad, got, err, want)
+			}
+		}
+	}
+	InitObfuscation("", false)
+}
+
+func TestDePacketTooLarge(t *testing.T) {
+	for _, l := range []int64{-1, maxPayloadSize + 1} {
+		var b bytes.Buffer
+		_ = binary.Write(&b, binary.BigEndian, l)
+		if _, err := DePacket(&b); err == nil {
+			t.Errorf("DePacket accepted length %d", l)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package tls
+
+import (
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIssue(t *testing.T) {
+	ca, err := NewCA("test ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.Cert.IsCA || ca.Cert.Subject.CommonName != "test ca" {
+		t.Fatalf("NewCA() = %+v", ca.Cert.Subject)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+
+	server, _, err := ca.IssueServer("endpoint", []string{"192.0.2.1", "proxy.example"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.IPAddresses[0].Equal(net.ParseIP("192.0.2.1")) || server.DNSNames[0] != "proxy.example" {
+		t.Errorf("IssueServer() SANs = %v %v", server.IPAddresses, server.DNSNames)
+	}
+	if _, err = server.Verify(x509.VerifyOptions{Roots: roots, DNSName: "proxy.example"}); err != nil {
+		t.Errorf("server certificate does not verify: %v", err)
+	}
+	if _, err = server.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err == nil {
+		t.Error("server certificate verifies for client auth")
+	}
+
+	client, _, err := ca.IssueClient("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.Subject.CommonName != "alice" {
+		t.Errorf("IssueClient() common name = %s", client.Subject.CommonName)
+	}
+	if _, err = client.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		t.Errorf("client certificate does not verify: %v", err)
+	}
+}
+
+func TestLoadIssuer(t *testing.T) {
+	ca, err := NewCA("test ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caPEM := EncodeCertificate(ca.Cert)
+	keyPEM, err := EncodeKey(ca.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _, err := ca.IssueClient("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cert    []byte
+		key     []byte
+		wantErr bool
+	}{
+		{"ok", caPEM, keyPEM, false},
+		{"not a CA", EncodeCertificate(leaf), keyPEM, true},
+		{"no certificate", keyPEM, keyPEM, true},
+		{"no key", caPEM, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := LoadIssuer(tt.cert, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadIssuer() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && !got.Cert.Equal(ca.Cert) {
+				t.Error("LoadIssuer() returned another certificate")
+			}
+		})
+	}
+}
+
+func TestPinOfPEM(t *testing.T) {
+	ca, err := NewCA("test ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, key, err := ca.IssueServer("endpoint", nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM, err := EncodeKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Pin(cert)
+
+	tests := []struct {
+		name    string
+		in      []byte
+		wantErr bool
+	}{
+		{"certificate", EncodeCertificate(cert), false},
+		{"key", keyPEM, false},
+		// The first certificate or key is pinned, whatever comes before it.
+		{"after other blocks", append([]byte("-----BEGIN NOTE-----\n-----END NOTE-----\n"), keyPEM...), false},
+		{"empty", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PinOfPEM(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PinOfPEM() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got != want {
+				t.Errorf("PinOfPEM() = %s, want %s", got, want)
+			}
+		})
+	}
+}
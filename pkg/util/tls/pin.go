@@ -0,0 +1,57 @@
+package tls
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const pinPrefix = "sha256/"
+
+var errPinMismatch = errors.New("server certificate matches no pin")
+
+// ParsePins decodes SPKI SHA-256 pins written as base64, optionally prefixed
+// with "sha256/".
+func ParsePins(pins []string) ([][]byte, error) {
+	var out [][]byte
+	for _, p := range pins {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(p, pinPrefix))
+		if err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %s", p)
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
+// Pin returns the SPKI SHA-256 pin of cert in the form ParsePins accepts.
+func Pin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins returns a VerifyPeerCertificate callback accepting the server
+// when the public key of its leaf certificate matches one of pins. Several
+// pins may be active at once to rotate keys.
+func verifyPins(pins [][]byte) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errPinMismatch
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		for _, p := range pins {
+			if bytes.Equal(p, sum[:]) {
+				return nil
+			}
+		}
+		return errPinMismatch
+	}
+}
@@ -0,0 +1,112 @@
+package tls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// selfSigned returns the DER of a throwaway self-signed certificate.
+func selfSigned(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func TestParsePins(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+	tests := []struct {
+		name    string
+		pins    []string
+		wantErr bool
+	}{
+		{"plain", []string{pin}, false},
+		{"prefixed", []string{pinPrefix + pin}, false},
+		{"several", []string{pin, pinPrefix + pin}, false},
+		{"none", nil, false},
+		{"not base64", []string{"sha256/!!"}, true},
+		{"short", []string{base64.StdEncoding.EncodeToString(sum[:16])}, true},
+		{"other prefix", []string{"sha1/" + pin}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePins(tt.pins)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParsePins() error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(got) != len(tt.pins) {
+				t.Errorf("ParsePins() returned %d pins, want %d", len(got), len(tt.pins))
+			}
+		})
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	der := selfSigned(t)
+	pin := Pin(mustParse(t, der))
+	if !strings.HasPrefix(pin, pinPrefix) {
+		t.Fatalf("Pin() = %s, want prefix %s", pin, pinPrefix)
+	}
+	other := Pin(mustParse(t, selfSigned(t)))
+
+	tests := []struct {
+		name     string
+		pins     []string
+		rawCerts [][]byte
+		wantErr  error
+	}{
+		{"match", []string{pin}, [][]byte{der}, nil},
+		{"rotation", []string{other, pin}, [][]byte{der}, nil},
+		{"mismatch", []string{other}, [][]byte{der}, errPinMismatch},
+		{"no certificate", []string{pin}, nil, errPinMismatch},
+		// Only the leaf is pinned, not the chain behind it.
+		{"pinned intermediate", []string{pin}, [][]byte{selfSigned(t), der}, errPinMismatch},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pins, err := ParsePins(tt.pins)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = verifyPins(pins)(tt.rawCerts, nil); !errors.Is(err, tt.wantErr) {
+				t.Errorf("verify = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	if err := verifyPins(nil)([][]byte{[]byte("garbage")}, nil); err == nil {
+		t.Error("verify accepted a malformed certificate")
+	}
+}
+
+func mustParse(t *testing.T, der []byte) *x509.Certificate {
+	t.Helper()
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
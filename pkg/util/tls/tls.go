@@ -8,14 +8,30 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"myproxy/internal/mlog"
+	"myproxy/pkg/models"
 	"myproxy/pkg/shared"
 	"myproxy/pkg/util/id"
 	"os"
+	"sync"
 	"time"
 )
 
+const (
+	ClientAuthNone          = "none"
+	ClientAuthRequest       = "request"
+	ClientAuthVerifyIfGiven = "verifyIfGiven"
+	ClientAuthRequire       = "require"
+)
+
+var (
+	keys   = make(map[string]*ecdsa.PrivateKey)
+	keysMu sync.Mutex
+)
+
 var (
 	cipherSuites = []uint16{
 		tls.TLS_AES_128_GCM_SHA256,
@@ -24,30 +40,151 @@ var (
 	}
 )
 
-func GetTLSConfig(prefix int, host string, insecure bool) *tls.Config {
+func GetTLSConfig(prefix int, host string, insecure bool, pins [][]byte) *tls.Config {
 	switch prefix {
 	case shared.ServerTLS:
-		return newServerTLSConfig("", "", "")
+		return newServerTLSConfig("", "", "", "", tls.NoClientCert)
 	case shared.ClientTLS:
-		return newClientTLSConfig("", "", "", host, insecure)
+		return newClientTLSConfig("", "", "", host, insecure, pins)
 	}
 	return nil
 }
 
-func GetTLSConfigWithCustom(prefix int, host string, crt string, key string, insecure bool) *tls.Config {
+func GetTLSConfigWithCustom(prefix int, host string, c *models.Tls, pins [][]byte) *tls.Config {
 	switch prefix {
 	case shared.ServerTLS:
-		return newServerTLSConfig(crt, key, "")
+		clientAuth, err := ClientAuthType(c)
+		if err != nil {
+			mlog.Error(err.Error())
+			return nil
+		}
+		return newServerTLSConfig(c.Crt, c.Key, c.ClientCa, c.GeneratedKey, clientAuth)
 	case shared.ClientTLS:
-		return newClientTLSConfig(crt, key, "", host, insecure)
+		return newClientTLSConfig(c.Crt, c.Key, c.Ca, host, c.Insecure, pins)
 	}
 	return nil
 }
 
-func newCertificate() tls.Certificate {
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// ServerPin returns the pin of the certificate an endpoint configured with c
+// presents. It is empty for ephemeral self-signed certificates, whose key
+// changes on every start.
+func ServerPin(c *models.Tls) (string, error) {
+	if c == nil {
+		return "", nil
+	}
+
+	var cert *tls.Certificate
+	switch {
+	case c.Crt != "" && c.Key != "":
+		crt, err := newTLSKey(c.Crt, c.Key)
+		if err != nil {
+			return "", err
+		}
+		cert = crt
+	case c.GeneratedKey != "":
+		key, err := loadOrCreateKey(c.GeneratedKey)
+		if err != nil {
+			return "", err
+		}
+		crt := newCertificate(key)
+		cert = &crt
+	default:
+		return "", nil
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
 	if err != nil {
-		panic(err)
+		return "", err
+	}
+	return Pin(leaf), nil
+}
+
+// ClientAuthType returns the client certificate policy of c. Without a
+// policy, client certificates are required once a client CA is set.
+func ClientAuthType(c *models.Tls) (tls.ClientAuthType, error) {
+	switch c.ClientAuth {
+	case "":
+		if c.ClientCa != "" {
+			return tls.RequireAndVerifyClientCert, nil
+		}
+		return tls.NoClientCert, nil
+	case ClientAuthNone:
+		return tls.NoClientCert, nil
+	case ClientAuthRequest:
+		return tls.RequestClientCert, nil
+	case ClientAuthVerifyIfGiven:
+		return tls.VerifyClientCertIfGiven, nil
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client auth policy %s", c.ClientAuth)
+}
+
+// LoadCertPool reads the PEM certificates at caPath into a new pool.
+func LoadCertPool(caPath string) (*x509.CertPool, error) {
+	return newCertPool(caPath)
+}
+
+// LoadKeyPair reads a PEM certificate and its private key.
+func LoadKeyPair(certPath, keyPath string) (*tls.Certificate, error) {
+	return newTLSKey(certPath, keyPath)
+}
+
+// loadOrCreateKey returns the private key kept at path, generating and
+// saving a new one the first time.
+func loadOrCreateKey(path string) (*ecdsa.PrivateKey, error) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	if key, ok := keys[path]; ok {
+		return key, nil
+	}
+
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, errors.New("no PEM key found in " + path)
+		}
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(*ecdsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("generated key " + path + " is not an ECDSA key")
+		}
+		keys[path] = key
+		return key, nil
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	keys[path] = key
+	return key, nil
+}
+
+func newCertificate(privateKey *ecdsa.PrivateKey) tls.Certificate {
+	if privateKey == nil {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		privateKey = key
 	}
 
 	serial := id.GetSnowflakeID().Int64()
@@ -91,7 +228,7 @@ func newCertificate() tls.Certificate {
 	return tlsCert
 }
 
-func newServerTLSConfig(certPath, keyPath, caPath string) *tls.Config {
+func newServerTLSConfig(certPath, keyPath, caPath, generatedKey string, clientAuth tls.ClientAuthType) *tls.Config {
 	base := &tls.Config{
 		MinVersion:   tls.VersionTLS13,
 		CipherSuites: cipherSuites,
@@ -99,7 +236,16 @@ func newServerTLSConfig(certPath, keyPath, caPath string) *tls.Config {
 	}
 
 	if certPath == "" || keyPath == "" {
-		cert := newCertificate()
+		var key *ecdsa.PrivateKey
+		if generatedKey != "" {
+			k, err := loadOrCreateKey(generatedKey)
+			if err != nil {
+				mlog.Error(err.Error())
+				return nil
+			}
+			key = k
+		}
+		cert := newCertificate(key)
 		base.Certificates = []tls.Certificate{cert}
 	} else {
 		cert, err := newTLSKey(certPath, keyPath)
@@ -116,13 +262,16 @@ func newServerTLSConfig(certPath, keyPath, caPath string) *tls.Config {
 			mlog.Error(err.Error())
 			return nil
 		}
-		base.ClientAuth = tls.RequireAndVerifyClientCert
 		base.ClientCAs = pool
 	}
+	base.ClientAuth = clientAuth
 	return base
 }
 
-func newClientTLSConfig(certPath, keyPath, caPath, serverName string, insecure bool) *tls.Config {
+// newClientTLSConfig verifies the server against caPath, or the system pool
+// without it. With pins, the server is verified by the public key of its
+// certificate alone, which suits self-signed endpoints.
+func newClientTLSConfig(certPath, keyPath, caPath, serverName string, insecure bool, pins [][]byte) *tls.Config {
 	base := &tls.Config{
 		MinVersion:   tls.VersionTLS13,
 		CipherSuites: cipherSuites,
@@ -157,6 +306,11 @@ func newClientTLSConfig(certPath, keyPath, caPath, serverName string, insecure b
 
 	base.InsecureSkipVerify = insecure
 
+	if len(pins) > 0 {
+		base.InsecureSkipVerify = true
+		base.VerifyPeerCertificate = verifyPins(pins)
+	}
+
 	return base
 }
 
@@ -174,6 +328,8 @@ func newCertPool(caPath string) (*x509.CertPool, error) {
 	if err != nil {
 		return nil, err
 	}
-	pool.AppendCertsFromPEM(caCrt)
+	if !pool.AppendCertsFromPEM(caCrt) {
+		return nil, errors.New("no certificates found in " + caPath)
+	}
 	return pool, nil
 }